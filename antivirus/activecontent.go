@@ -0,0 +1,484 @@
+package antivirus
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultActiveContentValue is written for clean objects that contain
+// JavaScript, automatic actions or macros, when the policy checks for them.
+const DefaultActiveContentValue = "active-content"
+
+// Active content found in documents, which is recorded as the reason.
+const (
+	ActiveContentJavaScript = "pdf-javascript"
+	ActiveContentOpenAction = "pdf-open-action"
+	ActiveContentLaunch     = "pdf-launch"
+	ActiveContentMacros     = "office-macros"
+)
+
+const (
+	// pdfHeaderLen is how far into a file the PDF header is looked for, as
+	// readers accept junk before it.
+	pdfHeaderLen = 1024
+	// maxObjectStreamSize limits how much of each compressed PDF object
+	// stream is read.
+	maxObjectStreamSize = 64 << 20
+	// maxEmbeddedSize limits the size of OLE objects embedded in Office
+	// documents that are checked for macros.
+	maxEmbeddedSize = 64 << 20
+	// maxPartSize limits how much of an Office document's content types
+	// part is read.
+	maxPartSize = 1 << 20
+
+	oleMagic      = "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"
+	oleMaxSector  = 0xfffffffa
+	oleEntrySize  = 128
+	oleHeaderSize = 512
+)
+
+// pdfActiveNames maps the PDF names that start scripts or actions to the
+// active content they show.
+var pdfActiveNames = map[string]string{
+	"JavaScript": ActiveContentJavaScript,
+	"JS":         ActiveContentJavaScript,
+	"OpenAction": ActiveContentOpenAction,
+	"Launch":     ActiveContentLaunch,
+}
+
+// oleMacroNames are the storages and streams, in upper case, that hold a VBA
+// project in an OLE file.
+var oleMacroNames = []string{"_VBA_PROJECT_CUR", "_VBA_PROJECT", "MACROS"}
+
+var errNotOLE = errors.New("not an OLE file")
+
+// WithActiveContent sets whether the default policy checks clean PDF and
+// Office documents for active content.
+func WithActiveContent(enabled bool) Option {
+	return func(p *Pipeline) {
+		p.checkActiveContent = enabled
+	}
+}
+
+// DetectActiveContent looks for JavaScript, open actions and launch actions
+// in a PDF, and for VBA macros in an Office document, whether OOXML or OLE.
+// It returns what it found, sorted, or nothing for other files. Documents that
+// cannot be parsed are left to the scanner.
+func DetectActiveContent(f *os.File) ([]string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	header := make([]byte, pdfHeaderLen)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	header = header[:n]
+
+	found := map[string]bool{}
+
+	switch {
+	case bytes.Contains(header, []byte("%PDF-")):
+		lexer := &pdfLexer{r: bufio.NewReader(io.NewSectionReader(f, 0, info.Size())), found: found, objectStreams: true}
+		if err := lexer.run(); err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		if zipHasMacros(f, info.Size()) {
+			found[ActiveContentMacros] = true
+		}
+
+	case bytes.HasPrefix(header, []byte(oleMagic)):
+		if oleHasMacros(f) {
+			found[ActiveContentMacros] = true
+		}
+	}
+
+	return slices.Sorted(maps.Keys(found)), nil
+}
+
+// pdfLexer records the active names in a PDF. Strings, comments and stream
+// data are skipped, so that text cannot fake a name and binary data cannot
+// hide one, but compressed object streams are read as they hold objects.
+type pdfLexer struct {
+	r     *bufio.Reader
+	found map[string]bool
+	// objectStreams decompresses object streams, which cannot be nested.
+	objectStreams bool
+	// objStm and flate are set by the names in the current object.
+	objStm, flate bool
+}
+
+func (l *pdfLexer) run() error {
+	for {
+		c, err := l.r.ReadByte()
+		if err != nil {
+			return endOfInput(err)
+		}
+
+		switch {
+		case c == '%':
+			err = l.skipLine()
+		case c == '(':
+			err = l.skipString()
+		case c == '<':
+			if next, _ := l.r.Peek(1); len(next) == 1 && next[0] == '<' {
+				_, err = l.r.ReadByte()
+			} else {
+				err = l.skipPast(">")
+			}
+		case c == '/':
+			err = l.name()
+		case isPDFRegular(c):
+			err = l.keyword(c)
+		}
+
+		if err != nil {
+			return endOfInput(err)
+		}
+	}
+}
+
+func (l *pdfLexer) name() error {
+	raw, err := l.token()
+	if err != nil {
+		return err
+	}
+
+	// #xx escapes let a name be written without its usual letters.
+	var name strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && i+2 < len(raw) {
+			if b, err := strconv.ParseUint(string(raw[i+1:i+3]), 16, 8); err == nil {
+				name.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		name.WriteByte(raw[i])
+	}
+
+	switch name.String() {
+	case "ObjStm":
+		l.objStm = true
+	case "FlateDecode", "Fl":
+		l.flate = true
+	}
+
+	if finding, ok := pdfActiveNames[name.String()]; ok {
+		l.found[finding] = true
+	}
+
+	return nil
+}
+
+func (l *pdfLexer) keyword(first byte) error {
+	rest, err := l.token()
+	if err != nil {
+		return err
+	}
+
+	switch string(first) + string(rest) {
+	case "stream":
+		return l.stream()
+	case "endobj":
+		l.objStm, l.flate = false, false
+	}
+
+	return nil
+}
+
+// token reads the rest of a name or keyword, which is cut short at 128 bytes.
+func (l *pdfLexer) token() ([]byte, error) {
+	var token []byte
+	for {
+		next, err := l.r.Peek(1)
+		if err != nil {
+			return token, endOfInput(err)
+		}
+		if !isPDFRegular(next[0]) {
+			return token, nil
+		}
+
+		c, _ := l.r.ReadByte()
+		if len(token) < 128 {
+			token = append(token, c)
+		}
+	}
+}
+
+func (l *pdfLexer) stream() error {
+	if next, _ := l.r.Peek(1); len(next) == 1 && next[0] == '\r' {
+		_, _ = l.r.ReadByte()
+	}
+	if next, _ := l.r.Peek(1); len(next) == 1 && next[0] == '\n' {
+		_, _ = l.r.ReadByte()
+	}
+
+	if l.objectStreams && l.objStm && l.flate {
+		// Errors from corrupt streams are ignored, the rest of the stream
+		// is skipped below.
+		if zr, err := zlib.NewReader(l.r); err == nil {
+			objects := &pdfLexer{r: bufio.NewReader(io.LimitReader(zr, maxObjectStreamSize)), found: l.found}
+			_ = objects.run()
+			_ = zr.Close()
+		}
+	}
+
+	l.objStm, l.flate = false, false
+
+	return l.skipPast("endstream")
+}
+
+func (l *pdfLexer) skipLine() error {
+	for {
+		c, err := l.r.ReadByte()
+		if err != nil || c == '\r' || c == '\n' {
+			return err
+		}
+	}
+}
+
+func (l *pdfLexer) skipString() error {
+	depth := 1
+	for depth > 0 {
+		c, err := l.r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch c {
+		case '\\':
+			if _, err := l.r.ReadByte(); err != nil {
+				return err
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+	}
+
+	return nil
+}
+
+// skipPast reads up to and including the next occurrence of token.
+func (l *pdfLexer) skipPast(token string) error {
+	var tail []byte
+	for {
+		chunk, err := l.r.ReadSlice(token[len(token)-1])
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+
+		tail = append(tail, chunk...)
+		if err == nil && bytes.HasSuffix(tail, []byte(token)) {
+			return nil
+		}
+		if len(tail) > len(token) {
+			tail = append(tail[:0], tail[len(tail)-len(token):]...)
+		}
+	}
+}
+
+// isPDFRegular reports whether c is part of a name or keyword, rather than
+// whitespace or a delimiter.
+func isPDFRegular(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ', '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return false
+	}
+
+	return true
+}
+
+func endOfInput(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+
+	return err
+}
+
+// zipHasMacros reports whether an OOXML document has a VBA project or Excel
+// 4.0 macro sheets, either directly or in an embedded OLE object.
+func zipHasMacros(r io.ReaderAt, size int64) bool {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+
+	for _, file := range zr.File {
+		name := strings.ToLower(file.Name)
+
+		switch {
+		case path.Base(name) == "vbaproject.bin", strings.HasPrefix(name, "xl/macrosheets/"):
+			return true
+		case name == "[content_types].xml":
+			// A renamed VBA project is still declared by its content type.
+			if content, ok := readZipMember(file, maxPartSize); ok && bytes.Contains(bytes.ToLower(content), []byte("ms-office.vbaproject")) {
+				return true
+			}
+		case strings.Contains(name, "/embeddings/"):
+			if content, ok := readZipMember(file, maxEmbeddedSize); ok && bytes.HasPrefix(content, []byte(oleMagic)) && oleHasMacros(bytes.NewReader(content)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func readZipMember(file *zip.File, maxSize int64) ([]byte, bool) {
+	if isEncrypted(file) || file.UncompressedSize64 > uint64(maxSize) { //nolint:gosec // maxSize is a positive constant
+		return nil, false
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return nil, false
+	}
+	defer rc.Close() //nolint:errcheck // no need to check error when closing member
+
+	content, err := io.ReadAll(io.LimitReader(rc, maxSize))
+	if err != nil {
+		return nil, false
+	}
+
+	return content, true
+}
+
+// oleHasMacros reports whether an OLE file has a VBA project.
+func oleHasMacros(r io.ReaderAt) bool {
+	names, err := oleDirectoryNames(r)
+	if err != nil {
+		return false
+	}
+
+	for _, name := range names {
+		if slices.Contains(oleMacroNames, strings.ToUpper(name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// oleDirectoryNames lists the names of the storages and streams in an OLE
+// compound file.
+func oleDirectoryNames(r io.ReaderAt) ([]string, error) {
+	header := make([]byte, oleHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(oleMagic)) {
+		return nil, errNotOLE
+	}
+
+	shift := binary.LittleEndian.Uint16(header[0x1e:])
+	if shift != 9 && shift != 12 {
+		return nil, errNotOLE
+	}
+	sectorSize := int64(1) << shift
+
+	sector := func(n uint32) ([]byte, error) {
+		buf := make([]byte, sectorSize)
+		_, err := r.ReadAt(buf, (int64(n)+1)*sectorSize)
+		return buf, err
+	}
+
+	// The sectors of the allocation table are listed in the header, then
+	// in a chain of further sectors.
+	var fatSectors []uint32
+	for i := range 109 {
+		fatSectors = append(fatSectors, binary.LittleEndian.Uint32(header[0x4c+4*i:]))
+	}
+
+	seen := map[uint32]bool{}
+	for next := binary.LittleEndian.Uint32(header[0x44:]); next < oleMaxSector && !seen[next]; {
+		seen[next] = true
+
+		buf, err := sector(next)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := int64(0); i < sectorSize-4; i += 4 {
+			fatSectors = append(fatSectors, binary.LittleEndian.Uint32(buf[i:]))
+		}
+		next = binary.LittleEndian.Uint32(buf[sectorSize-4:])
+	}
+
+	var fat []uint32
+	for _, n := range fatSectors {
+		if n >= oleMaxSector {
+			continue
+		}
+
+		buf, err := sector(n)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := int64(0); i < sectorSize; i += 4 {
+			fat = append(fat, binary.LittleEndian.Uint32(buf[i:]))
+		}
+	}
+
+	var names []string
+	seen = map[uint32]bool{}
+	for n := binary.LittleEndian.Uint32(header[0x30:]); n < oleMaxSector && int(n) < len(fat) && !seen[n]; n = fat[n] {
+		seen[n] = true
+
+		buf, err := sector(n)
+		if err != nil {
+			return nil, err
+		}
+
+		for entry := range slices.Chunk(buf, oleEntrySize) {
+			size := int(binary.LittleEndian.Uint16(entry[0x40:]))
+			if entry[0x42] == 0 || size < 2 || size > 64 {
+				continue
+			}
+
+			name := make([]uint16, size/2-1)
+			for i := range name {
+				name[i] = binary.LittleEndian.Uint16(entry[2*i:])
+			}
+			names = append(names, string(utf16.Decode(name)))
+		}
+	}
+
+	return names, nil
+}
+
+// detectActiveContent checks a clean document for active content.
+func (p *Pipeline) detectActiveContent(ctx context.Context, obj Object, f *os.File) (found []string, err error) {
+	_, span := tracer.Start(ctx, "antivirus.detect_active_content", objectAttributes(obj))
+	defer func() {
+		span.SetAttributes(attribute.StringSlice("antivirus.active_content", found))
+		tracing.End(span, err)
+	}()
+
+	return DetectActiveContent(f)
+}
@@ -0,0 +1,208 @@
+package antivirus
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const cleanPDF = `%PDF-1.7
+1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj
+2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj
+3 0 obj << /Type /Page /Parent 2 0 R /Contents 4 0 R >> endobj
+4 0 obj << /Length 44 >>
+stream
+BT /F1 12 Tf (See /JavaScript docs) Tj ET
+endstream
+endobj
+% /Launch in a comment
+trailer << /Root 1 0 R >>
+%%EOF
+`
+
+// objectStreamPDF hides objects in a compressed object stream.
+func objectStreamPDF(t *testing.T, objects string) []byte {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write([]byte(objects)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n5 0 obj << /Type /ObjStm /N 1 /First 4 /Filter /FlateDecode >>\nstream\r\n")
+	buf.Write(compressed.Bytes())
+	buf.WriteString("\r\nendstream\nendobj\n%%EOF\n")
+	return buf.Bytes()
+}
+
+// oleBytes creates an OLE compound file with 512 byte sectors, an allocation
+// table in sector 0 and the directory, of up to three storages, in sector 1.
+func oleBytes(t *testing.T, names ...string) []byte {
+	if len(names) > 3 {
+		t.Fatal("too many names")
+	}
+
+	const endOfChain, fatSector, freeSector = 0xfffffffe, 0xfffffffd, 0xffffffff
+
+	file := make([]byte, 3*512)
+	header, fat, dir := file[:512], file[512:1024], file[1024:]
+
+	copy(header, oleMagic)
+	binary.LittleEndian.PutUint16(header[0x1a:], 3)
+	binary.LittleEndian.PutUint16(header[0x1c:], 0xfffe)
+	binary.LittleEndian.PutUint16(header[0x1e:], 9)
+	binary.LittleEndian.PutUint16(header[0x20:], 6)
+	binary.LittleEndian.PutUint32(header[0x2c:], 1)
+	binary.LittleEndian.PutUint32(header[0x30:], 1)
+	binary.LittleEndian.PutUint32(header[0x3c:], endOfChain)
+	binary.LittleEndian.PutUint32(header[0x44:], endOfChain)
+	for i := range 109 {
+		binary.LittleEndian.PutUint32(header[0x4c+4*i:], freeSector)
+	}
+	binary.LittleEndian.PutUint32(header[0x4c:], 0)
+
+	for i := 0; i < 512; i += 4 {
+		binary.LittleEndian.PutUint32(fat[i:], freeSector)
+	}
+	binary.LittleEndian.PutUint32(fat[0:], fatSector)
+	binary.LittleEndian.PutUint32(fat[4:], endOfChain)
+
+	for i, name := range append([]string{"Root Entry"}, names...) {
+		entry := dir[i*oleEntrySize : (i+1)*oleEntrySize]
+		units := utf16.Encode([]rune(name))
+		for j, u := range units {
+			binary.LittleEndian.PutUint16(entry[2*j:], u)
+		}
+		binary.LittleEndian.PutUint16(entry[0x40:], uint16(2*len(units)+2)) //nolint:gosec // names are short
+		entry[0x42] = 1
+		if i == 0 {
+			entry[0x42] = 5
+		}
+	}
+
+	return file
+}
+
+func TestDetectActiveContent(t *testing.T) {
+	testcases := map[string]struct {
+		content  []byte
+		expected []string
+	}{
+		"not a document": {
+			content: []byte("/JavaScript"),
+		},
+		"pdf": {
+			content: []byte(cleanPDF),
+		},
+		"pdf with javascript": {
+			content:  []byte("%PDF-1.4\n1 0 obj << /OpenAction 2 0 R >> endobj\n2 0 obj << /S /JavaScript /JS (app.alert\\(1\\)) >> endobj\n"),
+			expected: []string{ActiveContentJavaScript, ActiveContentOpenAction},
+		},
+		"pdf with escaped name": {
+			content:  []byte("%PDF-1.4\n1 0 obj << /S /L#61unch /F (cmd.exe) >> endobj\n"),
+			expected: []string{ActiveContentLaunch},
+		},
+		"pdf after junk": {
+			content:  []byte("junk\n%PDF-1.4\n1 0 obj << /S /Launch >> endobj\n"),
+			expected: []string{ActiveContentLaunch},
+		},
+		"pdf with object stream": {
+			content:  objectStreamPDF(t, "6 0 << /S /JavaScript /JS (app.alert\\(1\\)) >>"),
+			expected: []string{ActiveContentJavaScript},
+		},
+		"docx": {
+			content: zipBytes(t,
+				archiveMember{"[Content_Types].xml", []byte(`<Types><Default Extension="xml" ContentType="application/xml"/></Types>`)},
+				archiveMember{"word/document.xml", []byte("<w:document/>")},
+			),
+		},
+		"docm": {
+			content: zipBytes(t,
+				archiveMember{"word/document.xml", []byte("<w:document/>")},
+				archiveMember{"word/vbaProject.bin", oleBytes(t, "VBA", "_VBA_PROJECT")},
+			),
+			expected: []string{ActiveContentMacros},
+		},
+		"renamed vba project": {
+			content: zipBytes(t,
+				archiveMember{"[Content_Types].xml", []byte(`<Types><Override PartName="/word/data.bin" ContentType="application/vnd.ms-office.vbaProject"/></Types>`)},
+				archiveMember{"word/data.bin", oleBytes(t, "VBA")},
+			),
+			expected: []string{ActiveContentMacros},
+		},
+		"macro sheet": {
+			content:  zipBytes(t, archiveMember{"xl/macrosheets/sheet1.xml", []byte("<xm:macrosheet/>")}),
+			expected: []string{ActiveContentMacros},
+		},
+		"embedded document with macros": {
+			content:  zipBytes(t, archiveMember{"word/embeddings/oleObject1.bin", oleBytes(t, "Macros")}),
+			expected: []string{ActiveContentMacros},
+		},
+		"doc": {
+			content: oleBytes(t, "WordDocument", "1Table"),
+		},
+		"doc with macros": {
+			content:  oleBytes(t, "WordDocument", "Macros"),
+			expected: []string{ActiveContentMacros},
+		},
+		"xls with macros": {
+			content:  oleBytes(t, "Workbook", "_VBA_PROJECT_CUR"),
+			expected: []string{ActiveContentMacros},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			found, err := DetectActiveContent(tempFile(t, tc.content))
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, found)
+		})
+	}
+}
+
+func TestScanWithActiveContent(t *testing.T) {
+	content := []byte("%PDF-1.4\n1 0 obj << /OpenAction << /S /JavaScript /JS (app.alert\\(1\\)) >> >> endobj\n")
+
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(content)),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{Clean: true}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("virus-scan-status"), Value: aws.String("active-content")},
+		{Key: aws.String("virus-scan-status-reason"), Value: aws.String("pdf-javascript pdf-open-action")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTempDir(t.TempDir()),
+		WithActiveContent(true),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "active-content", result.Status)
+	assert.True(t, result.Verdict.Clean)
+	assert.Equal(t, []string{ActiveContentJavaScript, ActiveContentOpenAction}, result.ActiveContent)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
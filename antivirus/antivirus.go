@@ -0,0 +1,188 @@
+// Package antivirus contains the scanning pipeline used by the opg-s3-antivirus
+// lambda, so that the same download, scan and tagging semantics can be reused
+// by other binaries.
+package antivirus
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type Downloader interface {
+	GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+type Tagger interface {
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+}
+
+// A Scanner checks a file on disk. StartDaemon is called once before any scans
+// so that engines with a long start up can do it outside of an invocation.
+type Scanner interface {
+	StartDaemon() error
+	ScanFile(ctx context.Context, path string) (Verdict, error)
+}
+
+// Verdict is the outcome of scanning a single file.
+type Verdict struct {
+	Clean bool
+	// Signature is the name of the signature that matched, if the engine
+	// reported one, or the note given for a block listed hash.
+	Signature string
+	// Reason records what decided the verdict, one of ReasonEngine,
+	// ReasonAllowList or ReasonBlockList, which are only set when the
+	// pipeline has hash lists, or the ArchiveLimit a suspicious archive
+	// exceeded.
+	Reason string
+	// Engines records each engine's verdict when the scanner is a
+	// MultiScanner.
+	Engines []EngineVerdict
+}
+
+// Object identifies the S3 object to scan. VersionID, Size and ETag are
+// optional and are taken from the triggering event when available.
+type Object struct {
+	Bucket    string
+	Key       string
+	VersionID string
+	Size      int64
+	ETag      string
+}
+
+// Result is returned by Pipeline.Scan once an object has been tagged.
+type Result struct {
+	Object  Object
+	Verdict Verdict
+	// Status is the tag value that was written.
+	Status string
+	// Skipped is set when the policy for the object skipped scanning.
+	Skipped bool
+	// Quarantined is where an infected object was moved to, if anywhere.
+	Quarantined *Object
+	// FileType is the type detected from the object's contents, it is only
+	// set when the policy has AllowedTypes.
+	FileType string
+	// ArchiveViolation is the limit a suspicious archive exceeded, such
+	// archives are not scanned.
+	ArchiveViolation *ArchiveViolation
+	// InfectedMembers lists the files inside an infected archive that are
+	// infected themselves, when the policy has ScanMembers or the archive was
+	// decrypted.
+	InfectedMembers []InfectedMember
+	// ActiveContent lists what was found in a clean document tagged with
+	// TagValues.ActiveContent.
+	ActiveContent []string
+	// SHA256 is the hex encoded digest of the downloaded object.
+	SHA256 string
+	// DefinitionsVersion describes the signature databases used for the scan.
+	DefinitionsVersion string
+	// Duration is the time taken to handle the object.
+	Duration time.Duration
+	// Timings breaks Duration down into the steps of the scan.
+	Timings Timings
+	// BytesScanned is the number of bytes downloaded and scanned.
+	BytesScanned int64
+	// RecordFailures counts the recorders that failed to record the result
+	// before the one it is passed to.
+	RecordFailures int
+}
+
+// Timings records how long each step of a scan took. Steps that were not run
+// are zero.
+type Timings struct {
+	Download time.Duration
+	Scan     time.Duration
+	Write    time.Duration
+}
+
+// A Recorder keeps an audit record of each result once it has been written to
+// the object.
+type Recorder interface {
+	Record(ctx context.Context, result Result) error
+}
+
+// TagValues are written to the tag key to record the verdict. Values other
+// than Pass and Fail fall back to their defaults when empty. The same values
+// are read from the config file and from rules, under the JSON names.
+type TagValues struct {
+	Pass string `json:"pass"`
+	Fail string `json:"fail"`
+	// Oversize is written instead of scanning objects larger than the
+	// policy's MaxSize.
+	Oversize string `json:"oversize"`
+	// StaleDefinitions is written instead of scanning when the definitions
+	// check fails under the DefinitionsTagStale policy.
+	StaleDefinitions string `json:"staleDefinitions"`
+	// DisallowedType is written instead of Pass for clean objects whose file
+	// type is not allowed by the policy.
+	DisallowedType string `json:"disallowedType"`
+	// SuspiciousArchive is written instead of scanning archives that exceed
+	// the pipeline's ArchiveLimits.
+	SuspiciousArchive string `json:"suspiciousArchive"`
+	// Encrypted is written instead of Pass for encrypted archives whose
+	// contents could not be decrypted and scanned.
+	Encrypted string `json:"encrypted"`
+	// ActiveContent is written instead of Pass for documents with
+	// JavaScript, automatic actions or macros, when the policy checks for
+	// them.
+	ActiveContent string `json:"activeContent"`
+}
+
+// tagValueField is one of the TagValues, named as in JSON.
+type tagValueField struct {
+	name  string
+	value *string
+}
+
+func (v *TagValues) fields() []tagValueField {
+	return []tagValueField{
+		{"pass", &v.Pass},
+		{"fail", &v.Fail},
+		{"oversize", &v.Oversize},
+		{"staleDefinitions", &v.StaleDefinitions},
+		{"disallowedType", &v.DisallowedType},
+		{"suspiciousArchive", &v.SuspiciousArchive},
+		{"encrypted", &v.Encrypted},
+		{"activeContent", &v.ActiveContent},
+	}
+}
+
+// Overlay returns v with the values set in other in place of its own.
+func (v TagValues) Overlay(other TagValues) TagValues {
+	theirs := other.fields()
+	for i, field := range v.fields() {
+		if value := *theirs[i].value; value != "" {
+			*field.value = value
+		}
+	}
+
+	return v
+}
+
+// WithDefaults returns v with the values the pipeline writes by default in
+// place of any that are empty. Pass and Fail have no defaults.
+func (v TagValues) WithDefaults() TagValues {
+	if v.Oversize == "" {
+		v.Oversize = DefaultOversizeValue
+	}
+	if v.StaleDefinitions == "" {
+		v.StaleDefinitions = DefaultStaleDefinitionsValue
+	}
+	if v.DisallowedType == "" {
+		v.DisallowedType = DefaultDisallowedTypeValue
+	}
+	if v.SuspiciousArchive == "" {
+		v.SuspiciousArchive = DefaultSuspiciousArchiveValue
+	}
+	if v.Encrypted == "" {
+		v.Encrypted = DefaultEncryptedValue
+	}
+	if v.ActiveContent == "" {
+		v.ActiveContent = DefaultActiveContentValue
+	}
+
+	return v
+}
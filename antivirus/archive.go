@@ -0,0 +1,484 @@
+package antivirus
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultSuspiciousArchiveValue is written instead of scanning archives that
+// exceed the pipeline's ArchiveLimits.
+const DefaultSuspiciousArchiveValue = "suspicious-archive"
+
+// Names of the archive limits, which are recorded as the reason for a
+// suspicious archive.
+const (
+	ArchiveLimitRatio   = "compression-ratio"
+	ArchiveLimitEntries = "entries"
+	ArchiveLimitSize    = "uncompressed-size"
+	ArchiveLimitDepth   = "depth"
+)
+
+// DefaultArchiveLimits are in line with the limits clamd applies to archives.
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxRatio:   100,
+	MaxEntries: 10000,
+	MaxSize:    400 << 20,
+	MaxDepth:   5,
+}
+
+// ArchiveLimits bound what a zip, tar or gzip file may expand to. Each limit
+// is off when zero.
+type ArchiveLimits struct {
+	// MaxRatio is the largest uncompressed to compressed size of any member.
+	MaxRatio int64
+	// MaxEntries is the most files across the archive and any archives inside
+	// it.
+	MaxEntries int64
+	// MaxSize is the largest total uncompressed size, in bytes.
+	MaxSize int64
+	// MaxDepth is the most archives that may be nested inside each other,
+	// counting the outer archive.
+	MaxDepth int64
+}
+
+// ArchiveViolation describes the first limit an archive exceeded.
+type ArchiveViolation struct {
+	// Limit is one of the ArchiveLimit names.
+	Limit string
+	Value int64
+	Max   int64
+}
+
+func (v *ArchiveViolation) Error() string {
+	return fmt.Sprintf("archive %s %d exceeds %d", v.Limit, v.Value, v.Max)
+}
+
+// WithArchiveLimits inspects zip, tar and gzip files before they are scanned.
+// Archives that exceed limits are given the SuspiciousArchive status without
+// being scanned.
+func WithArchiveLimits(limits ArchiveLimits) Option {
+	return func(p *Pipeline) {
+		p.archiveLimits = limits
+	}
+}
+
+// InspectArchive checks the archive in f against limits, extracting nested
+// archives to tempDir. It returns nil when f is not an archive, or is one
+// within limits. Archives that cannot be read are left for the scanner to
+// judge.
+func InspectArchive(f *os.File, limits ArchiveLimits, tempDir string) (*ArchiveViolation, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect archive: %w", err)
+	}
+
+	inspector := &archiveInspector{limits: limits, tempDir: tempDir}
+
+	err = inspector.inspect(f, info.Size(), 1, "")
+
+	var violation *ArchiveViolation
+	if errors.As(err, &violation) {
+		return violation, nil
+	}
+
+	return nil, err
+}
+
+// archiveInspection is what a single pass over an object found, before it is
+// scanned.
+type archiveInspection struct {
+	// violation is the limit the archive exceeded, if any.
+	violation *ArchiveViolation
+	// encrypted is set when the archive, or one nested in it, has encrypted
+	// members.
+	encrypted bool
+}
+
+// inspectArchive checks the object against the pipeline's ArchiveLimits and
+// notes whether it has encrypted members, in one pass. Without limits of its
+// own, the pipeline still extracts nested archives within
+// DefaultArchiveLimits to look for encrypted members, but does not report
+// exceeding them.
+func (p *Pipeline) inspectArchive(ctx context.Context, obj Object, f *os.File) (inspection archiveInspection, err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.inspect_archive", objectAttributes(obj))
+	defer func() {
+		span.SetAttributes(attribute.Bool("antivirus.encrypted", inspection.encrypted))
+		tracing.End(span, err)
+	}()
+
+	inspector, err := walkArchive(ctx, f, "", p.memberLimits(), p.tempDir, "", nil)
+	inspection.encrypted = inspector.encrypted
+
+	var violation *ArchiveViolation
+	if !errors.As(err, &violation) {
+		return inspection, err
+	}
+
+	if p.archiveLimits != (ArchiveLimits{}) {
+		inspection.violation = violation
+		span.SetAttributes(
+			attribute.String("antivirus.archive_limit", violation.Limit),
+			attribute.Int64("antivirus.archive_value", violation.Value),
+		)
+		span.AddEvent("archive limit exceeded", trace.WithAttributes(attribute.Int64("antivirus.archive_max", violation.Max)))
+	}
+
+	return inspection, nil
+}
+
+// errNotArchive is returned by the format readers when the file cannot be
+// read as the archive its header suggests.
+var errNotArchive = errors.New("not a readable archive")
+
+type archiveInspector struct {
+	limits  ArchiveLimits
+	tempDir string
+	// name is the name of the outer archive, used to name the contents of a
+	// gzip file that does not record one.
+	name string
+	// visit, when set, is called with each member that is not an archive.
+	visit func(path string, r io.Reader) error
+	// password decrypts encrypted zip members, which are otherwise skipped
+	// and recorded in encrypted. Members that cannot be decrypted or read
+	// with the password are recorded in encrypted too.
+	password  string
+	encrypted bool
+	// infected are the members visit found to be infected.
+	infected []InfectedMember
+	entries  int64
+	size     int64
+}
+
+// inspect checks r, which is an archive at depth when its contents show it to
+// be one. name is the path of r within the outer archive, which is empty for
+// the outer archive itself.
+func (a *archiveInspector) inspect(r io.ReaderAt, size int64, depth int64, name string) error {
+	fileType, err := DetectFileType(r)
+	if err != nil {
+		return err
+	}
+
+	switch fileType {
+	case FileTypeZip, FileTypeTar, FileTypeGzip:
+	default:
+		return nil
+	}
+
+	if a.limits.MaxDepth > 0 && depth > a.limits.MaxDepth {
+		return &ArchiveViolation{Limit: ArchiveLimitDepth, Value: depth, Max: a.limits.MaxDepth}
+	}
+
+	switch fileType {
+	case FileTypeZip:
+		err = a.inspectZip(r, size, depth, name)
+	case FileTypeTar:
+		err = a.inspectTar(io.NewSectionReader(r, 0, size), depth, name)
+	case FileTypeGzip:
+		err = a.inspectGzip(io.NewSectionReader(r, 0, size), size, depth, name)
+	}
+
+	if errors.Is(err, errNotArchive) {
+		return nil
+	}
+
+	return err
+}
+
+func (a *archiveInspector) inspectZip(r io.ReaderAt, size int64, depth int64, name string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errNotArchive
+	}
+
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		if err := a.addEntry(int64(file.UncompressedSize64)); err != nil { //nolint:gosec // sizes over MaxInt64 fail the size limit
+			return err
+		}
+		if err := a.checkRatio(int64(file.UncompressedSize64), int64(file.CompressedSize64)); err != nil { //nolint:gosec // as above
+			return err
+		}
+
+		if !isEncrypted(file) {
+			rc, err := file.Open()
+			if err != nil {
+				return errNotArchive
+			}
+
+			err = a.inspectMember(rc, depth, memberPath(name, file.Name))
+			rc.Close() //nolint:errcheck // no need to check error when closing member
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if a.password == "" {
+			a.encrypted = true
+			continue
+		}
+
+		rc, err := openEncrypted(file, a.password)
+		if errors.Is(err, ErrWrongPassword) {
+			return err
+		}
+		if err != nil {
+			// The member uses a method or field that cannot be decrypted, so
+			// it is left encrypted rather than ending the walk as if the
+			// archive could not be read.
+			a.encrypted = true
+			continue
+		}
+
+		member := &memberReader{r: rc}
+		err = a.inspectMember(member, depth, memberPath(name, file.Name))
+		rc.Close() //nolint:errcheck // no need to check error when closing member
+		if member.err != nil && !errors.Is(member.err, ErrWrongPassword) {
+			a.encrypted = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *archiveInspector) inspectTar(r io.Reader, depth int64, name string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return readError(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := a.addEntry(header.Size); err != nil {
+			return err
+		}
+
+		if err := a.inspectMember(tr, depth, memberPath(name, header.Name)); err != nil {
+			return err
+		}
+	}
+}
+
+// inspectGzip checks the single compressed stream in r, which is usually a
+// tar file. The stream is read at most as far as the limits allow, so a
+// header claiming a small size cannot be used to hide a large one.
+func (a *archiveInspector) inspectGzip(r io.Reader, size int64, depth int64, name string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return errNotArchive
+	}
+	defer gr.Close() //nolint:errcheck // no need to check error when closing reader
+
+	content := &limitedArchiveReader{r: gr, inspector: a, compressed: size}
+	br := bufio.NewReaderSize(content, sniffLen)
+
+	header, _ := br.Peek(sniffLen)
+	fileType, _ := DetectFileType(bytes.NewReader(header))
+	isTar := fileType == FileTypeTar
+
+	if isTar {
+		if err := a.inspectTar(br, depth, name); err != nil {
+			return err
+		}
+	} else {
+		if err := a.addEntry(0); err != nil {
+			return err
+		}
+		if err := a.inspectMember(br, depth, memberPath(name, a.gzipMemberName(gr, name))); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return readError(err)
+	}
+
+	if !isTar {
+		return a.addSize(content.read)
+	}
+
+	return nil
+}
+
+// gzipMemberName is the name recorded in a gzip header, or the name of the
+// gzip file without its extension.
+func (a *archiveInspector) gzipMemberName(gr *gzip.Reader, name string) string {
+	if gr.Name != "" {
+		return gr.Name
+	}
+
+	base := path.Base(cmp.Or(name, a.name))
+	if trimmed := strings.TrimSuffix(base, ".gz"); trimmed != base && trimmed != "" {
+		return trimmed
+	}
+
+	return "-"
+}
+
+// inspectMember extracts r to a temporary file when it is an archive, and
+// checks it as one nested inside the archive at depth. Members that are not
+// archives are passed to visit, if there is one, or left for the scanner.
+func (a *archiveInspector) inspectMember(r io.Reader, depth int64, name string) error {
+	br := bufio.NewReaderSize(r, sniffLen)
+
+	header, _ := br.Peek(sniffLen)
+	switch fileType, _ := DetectFileType(bytes.NewReader(header)); fileType {
+	case FileTypeZip, FileTypeTar, FileTypeGzip:
+	default:
+		if a.visit == nil {
+			return nil
+		}
+		return a.visit(name, br)
+	}
+
+	f, err := os.CreateTemp(a.tempDir, "member")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck,gosec // file created above
+	defer f.Close()           //nolint:errcheck // no need to check error when closing file
+
+	var src io.Reader = br
+	if a.limits.MaxSize > 0 {
+		src = io.LimitReader(br, a.limits.MaxSize+1)
+	}
+
+	n, err := io.Copy(f, src)
+	if err != nil {
+		return readError(err)
+	}
+	if a.limits.MaxSize > 0 && n > a.limits.MaxSize {
+		return &ArchiveViolation{Limit: ArchiveLimitSize, Value: n, Max: a.limits.MaxSize}
+	}
+
+	return a.inspect(f, n, depth+1, name)
+}
+
+// memberPath joins the name of a member to the path of the archive holding
+// it.
+func memberPath(archive, member string) string {
+	if archive == "" {
+		return member
+	}
+
+	return archive + "/" + member
+}
+
+func (a *archiveInspector) addEntry(size int64) error {
+	a.entries++
+	if a.limits.MaxEntries > 0 && a.entries > a.limits.MaxEntries {
+		return &ArchiveViolation{Limit: ArchiveLimitEntries, Value: a.entries, Max: a.limits.MaxEntries}
+	}
+
+	return a.addSize(size)
+}
+
+func (a *archiveInspector) addSize(size int64) error {
+	if size < 0 {
+		size = 0
+	}
+
+	a.size += size
+	if a.limits.MaxSize > 0 && (a.size > a.limits.MaxSize || a.size < 0) {
+		return &ArchiveViolation{Limit: ArchiveLimitSize, Value: a.size, Max: a.limits.MaxSize}
+	}
+
+	return nil
+}
+
+func (a *archiveInspector) checkRatio(uncompressed, compressed int64) error {
+	if a.limits.MaxRatio <= 0 || uncompressed <= 0 {
+		return nil
+	}
+
+	ratio := uncompressed / max(compressed, 1)
+	if ratio > a.limits.MaxRatio {
+		return &ArchiveViolation{Limit: ArchiveLimitRatio, Value: ratio, Max: a.limits.MaxRatio}
+	}
+
+	return nil
+}
+
+// readError passes on an ArchiveViolation from a limitedArchiveReader, any
+// other error reading an archive means it is not one that can be inspected.
+func readError(err error) error {
+	var violation *ArchiveViolation
+	if errors.As(err, &violation) {
+		return violation
+	}
+	if errors.Is(err, ErrWrongPassword) {
+		return err
+	}
+
+	return errNotArchive
+}
+
+// memberReader records the first error reading a decrypted member, which
+// would otherwise be taken to mean the member is not an archive.
+type memberReader struct {
+	r   io.Reader
+	err error
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && m.err == nil {
+		m.err = err
+	}
+
+	return n, err
+}
+
+// limitedArchiveReader counts the bytes decompressed from a gzip stream,
+// failing with an ArchiveViolation as soon as the output is too large for the
+// compressed size or the size limit.
+type limitedArchiveReader struct {
+	r          io.Reader
+	inspector  *archiveInspector
+	compressed int64
+	read       int64
+}
+
+func (l *limitedArchiveReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+
+	limits := l.inspector.limits
+	if limits.MaxRatio > 0 && l.read/max(l.compressed, 1) > limits.MaxRatio {
+		return n, &ArchiveViolation{Limit: ArchiveLimitRatio, Value: l.read / max(l.compressed, 1), Max: limits.MaxRatio}
+	}
+	if limits.MaxSize > 0 && l.read > limits.MaxSize {
+		return n, &ArchiveViolation{Limit: ArchiveLimitSize, Value: l.read, Max: limits.MaxSize}
+	}
+
+	return n, err
+}
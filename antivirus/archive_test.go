@@ -0,0 +1,200 @@
+package antivirus
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type archiveMember struct {
+	name    string
+	content []byte
+}
+
+func zipBytes(t *testing.T, members ...archiveMember) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(m.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarBytes(t *testing.T, members ...archiveMember) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		if err := tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0600, Size: int64(len(m.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(m.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tempFile(t *testing.T, content []byte) *os.File {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+
+	return f
+}
+
+func TestInspectArchive(t *testing.T) {
+	zeros := make([]byte, 1<<20)
+	small := []byte("evidence document")
+
+	testcases := map[string]struct {
+		content []byte
+		limits  ArchiveLimits
+		limit   string
+	}{
+		"not an archive": {
+			content: []byte("%PDF-1.7\n"),
+			limits:  DefaultArchiveLimits,
+		},
+		"unreadable zip": {
+			content: []byte("PK\x03\x04 not really a zip"),
+			limits:  DefaultArchiveLimits,
+		},
+		"within limits": {
+			content: zipBytes(t, archiveMember{"a.txt", small}, archiveMember{"b.txt", small}),
+			limits:  DefaultArchiveLimits,
+		},
+		"zip ratio": {
+			content: zipBytes(t, archiveMember{"zeros", zeros}),
+			limits:  ArchiveLimits{MaxRatio: 100},
+			limit:   ArchiveLimitRatio,
+		},
+		"zip entries": {
+			content: zipBytes(t, archiveMember{"a.txt", small}, archiveMember{"b.txt", small}, archiveMember{"c.txt", small}),
+			limits:  ArchiveLimits{MaxEntries: 2},
+			limit:   ArchiveLimitEntries,
+		},
+		"tar size": {
+			content: tarBytes(t, archiveMember{"a.txt", small}, archiveMember{"b.txt", small}),
+			limits:  ArchiveLimits{MaxSize: 20},
+			limit:   ArchiveLimitSize,
+		},
+		"gzip ratio": {
+			content: gzipBytes(t, zeros),
+			limits:  ArchiveLimits{MaxRatio: 100},
+			limit:   ArchiveLimitRatio,
+		},
+		"tgz within limits": {
+			content: gzipBytes(t, tarBytes(t, archiveMember{"a.txt", small})),
+			limits:  ArchiveLimits{MaxRatio: 100, MaxEntries: 1, MaxSize: 1 << 20, MaxDepth: 1},
+		},
+		"nested too deep": {
+			content: zipBytes(t, archiveMember{"outer.zip", zipBytes(t,
+				archiveMember{"inner.tar", tarBytes(t, archiveMember{"a.txt", small})},
+			)}),
+			limits: ArchiveLimits{MaxDepth: 2},
+			limit:  ArchiveLimitDepth,
+		},
+		"nested entries": {
+			content: zipBytes(t, archiveMember{"inner.tar", tarBytes(t,
+				archiveMember{"a.txt", small}, archiveMember{"b.txt", small},
+			)}),
+			limits: ArchiveLimits{MaxEntries: 2},
+			limit:  ArchiveLimitEntries,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			violation, err := InspectArchive(tempFile(t, tc.content), tc.limits, t.TempDir())
+
+			assert.Nil(t, err)
+			if tc.limit == "" {
+				assert.Nil(t, violation)
+			} else if assert.NotNil(t, violation) {
+				assert.Equal(t, tc.limit, violation.Limit)
+				assert.Greater(t, violation.Value, violation.Max)
+			}
+		})
+	}
+}
+
+func TestScanWhenArchiveSuspicious(t *testing.T) {
+	content := zipBytes(t, archiveMember{"zeros", make([]byte, 1<<20)})
+
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(content)),
+	}, nil)
+
+	scanner := new(mockScanner)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("virus-scan-status"), Value: aws.String("suspicious-archive")},
+		{Key: aws.String("virus-scan-status-reason"), Value: aws.String("compression-ratio")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTempDir(t.TempDir()),
+		WithArchiveLimits(DefaultArchiveLimits),
+		WithPolicyResolver(policyFunc(func(obj Object, base Policy) Policy {
+			base.Quarantine = &Location{Bucket: "quarantine"}
+			return base
+		})),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "suspicious-archive", result.Status)
+	assert.Equal(t, Verdict{Reason: ArchiveLimitRatio}, result.Verdict)
+	assert.Equal(t, ArchiveLimitRatio, result.ArchiveViolation.Limit)
+	assert.Nil(t, result.Quarantined)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+	scanner.AssertNotCalled(t, "ScanFile", mock.Anything)
+}
@@ -0,0 +1,248 @@
+package antivirus
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClamdConfig    = "/opt/etc/clamd.conf"
+	DefaultReadyTimeout   = 2 * time.Minute
+	DefaultStartAttempts  = 3
+	DefaultRestartBackoff = time.Second
+)
+
+// ClamAvScanner scans files by passing them to clamd with clamdscan. It owns
+// the daemon: clamd is checked with PING before each scan and restarted if it
+// has stopped answering.
+type ClamAvScanner struct {
+	// ConfigFile is the clamd.conf used by both clamd and clamdscan, when empty
+	// DefaultClamdConfig is used.
+	ConfigFile string
+	// ReadyTimeout is how long to wait for a started clamd to answer PING,
+	// when zero DefaultReadyTimeout is used.
+	ReadyTimeout time.Duration
+	// StartAttempts is how many times to try starting clamd before giving up
+	// with ErrEngineUnavailable, when zero DefaultStartAttempts is used.
+	StartAttempts int
+	// RestartBackoff is the wait before the second attempt, doubling for each
+	// attempt after, when zero DefaultRestartBackoff is used.
+	RestartBackoff time.Duration
+
+	mu   sync.Mutex
+	conf *clamdConf
+	// scans is held for reading by each scan, so that ReloadDatabase waits
+	// for them to finish.
+	scans sync.RWMutex
+
+	// runDaemon starts clamd, it is replaced in tests.
+	runDaemon func(ctx context.Context, configFile string) error
+}
+
+func (s *ClamAvScanner) configFile() string {
+	if s.ConfigFile == "" {
+		return DefaultClamdConfig
+	}
+
+	return s.ConfigFile
+}
+
+func (s *ClamAvScanner) clamdConf() (clamdConf, error) {
+	if s.conf == nil {
+		conf, err := readClamdConf(s.configFile())
+		if err != nil {
+			return clamdConf{}, err
+		}
+		s.conf = &conf
+	}
+
+	return *s.conf, nil
+}
+
+// StartDaemon starts clamd, unless it is already running, and waits until it
+// answers PING.
+func (s *ClamAvScanner) StartDaemon() error {
+	_, err := s.ensureRunning(context.Background())
+	return err
+}
+
+// ensureRunning checks clamd answers PING, restarting it with backoff when it
+// does not. It returns the configuration clamd was checked with, so callers
+// need not read it again without the lock.
+func (s *ClamAvScanner) ensureRunning(ctx context.Context) (clamdConf, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conf, err := s.clamdConf()
+	if err != nil {
+		return clamdConf{}, fmt.Errorf("%w: %w", ErrEngineUnavailable, err)
+	}
+
+	if err := pingClamd(ctx, conf.LocalSocket); err == nil {
+		return conf, nil
+	}
+
+	attempts := cmp.Or(s.StartAttempts, DefaultStartAttempts)
+	backoff := cmp.Or(s.RestartBackoff, DefaultRestartBackoff)
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return clamdConf{}, fmt.Errorf("%w: %w", ErrEngineUnavailable, ctx.Err())
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		slog.InfoContext(ctx, "starting clamd", slog.Int("attempt", attempt))
+
+		if lastErr = s.start(ctx, conf); lastErr == nil {
+			return conf, nil
+		}
+
+		slog.WarnContext(ctx, "clamd failed to start", slog.Int("attempt", attempt), slog.Any("error", lastErr))
+	}
+
+	return clamdConf{}, fmt.Errorf("%w: clamd failed to start after %d attempts: %w", ErrEngineUnavailable, attempts, lastErr)
+}
+
+func (s *ClamAvScanner) start(ctx context.Context, conf clamdConf) error {
+	stopClamd(conf.PidFile)
+
+	runDaemon := s.runDaemon
+	if runDaemon == nil {
+		runDaemon = runClamd
+	}
+
+	if err := runDaemon(ctx, s.configFile()); err != nil {
+		return err
+	}
+
+	return s.waitUntilReady(ctx, conf)
+}
+
+func (s *ClamAvScanner) waitUntilReady(ctx context.Context, conf clamdConf) error {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(s.ReadyTimeout, DefaultReadyTimeout))
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		err := pingClamd(ctx, conf.LocalSocket)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("clamd did not answer PING: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// runClamd starts clamd, which forks into the background once it has loaded
+// its configuration.
+func runClamd(ctx context.Context, configFile string) error {
+	cmd := exec.CommandContext(ctx, "clamd", "--config-file", configFile) //nolint:gosec // config file is set by the binary
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to start clamd, %w: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	slog.DebugContext(ctx, "clamd started", slog.String("output", strings.TrimSpace(output.String())))
+	return nil
+}
+
+// ReloadDatabase asks clamd to reload the signature databases from its
+// DatabaseDirectory. It waits for scans already started to finish, and clamd
+// keeps answering with the old databases until the new ones have loaded.
+func (s *ClamAvScanner) ReloadDatabase(ctx context.Context) error {
+	s.scans.Lock()
+	defer s.scans.Unlock()
+
+	s.mu.Lock()
+	conf, err := s.clamdConf()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	reply, err := clamdCommand(ctx, conf.LocalSocket, "RELOAD")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrEngineUnavailable, err)
+	}
+
+	if reply != "RELOADING" {
+		return fmt.Errorf("unexpected reply to RELOAD: %q", reply)
+	}
+
+	return nil
+}
+
+func (s *ClamAvScanner) ScanFile(ctx context.Context, path string) (Verdict, error) {
+	s.scans.RLock()
+	defer s.scans.RUnlock()
+
+	conf, err := s.ensureRunning(ctx)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, "clamdscan", "--config-file", s.configFile(), "--stdout", path) //nolint:gosec // path is generated by the previous command
+
+	var output, errOutput bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &errOutput
+
+	err = cmd.Run()
+	slog.DebugContext(ctx, "clamdscan finished", slog.String("output", strings.TrimSpace(output.String())), slog.String("errorOutput", strings.TrimSpace(errOutput.String())))
+
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+			return Verdict{Signature: parseSignature(&output)}, nil
+		}
+
+		if pingErr := pingClamd(ctx, conf.LocalSocket); pingErr != nil {
+			return Verdict{}, fmt.Errorf("%w: clamd stopped during scan: %w", ErrEngineUnavailable, pingErr)
+		}
+
+		return Verdict{}, fmt.Errorf("failed to scan file, %w: %s", err, strings.TrimSpace(errOutput.String()))
+	}
+
+	return Verdict{Clean: true}, nil
+}
+
+// parseSignature finds the signature name in clamdscan output lines of the form
+// "/tmp/file123: Win.Test.EICAR_HDB-1 FOUND".
+func parseSignature(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasSuffix(line, " FOUND") {
+			continue
+		}
+
+		if i := strings.LastIndex(line, ": "); i >= 0 {
+			return strings.TrimSuffix(line[i+2:], " FOUND")
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,243 @@
+package antivirus
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignature(t *testing.T) {
+	output := `/tmp/file123: Win.Test.EICAR_HDB-1 FOUND
+
+----------- SCAN SUMMARY -----------
+Infected files: 1
+`
+
+	assert.Equal(t, "Win.Test.EICAR_HDB-1", parseSignature(strings.NewReader(output)))
+	assert.Equal(t, "", parseSignature(strings.NewReader("/tmp/file123: OK\n")))
+}
+
+// fakeClamd answers clamd commands on socket until the test ends.
+func fakeClamd(t *testing.T, socket string, replies map[string]string) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			command, err := bufio.NewReader(conn).ReadString(0)
+			if err == nil {
+				_, _ = conn.Write([]byte(replies[strings.TrimSuffix(strings.TrimPrefix(command, "z"), "\x00")] + "\x00"))
+			}
+			_ = conn.Close()
+		}
+	}()
+}
+
+func writeClamdConf(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "clamd.sock")
+	configFile := filepath.Join(dir, "clamd.conf")
+
+	conf := "# test config\nDatabaseDirectory " + dir + "\nPidFile " + filepath.Join(dir, "clamd.pid") + "\nLocalSocket " + socket + "\n"
+	if err := os.WriteFile(configFile, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return configFile, socket
+}
+
+func TestReadClamdConf(t *testing.T) {
+	configFile, socket := writeClamdConf(t)
+
+	conf, err := readClamdConf(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, socket, conf.LocalSocket)
+	assert.Equal(t, filepath.Join(filepath.Dir(configFile), "clamd.pid"), conf.PidFile)
+
+	noSocket := filepath.Join(t.TempDir(), "clamd.conf")
+	_ = os.WriteFile(noSocket, []byte("TCPSocket 3310\n"), 0600)
+
+	_, err = readClamdConf(noSocket)
+	assert.Equal(t, "clamd config "+noSocket+" does not set LocalSocket", err.Error())
+}
+
+func TestPingClamd(t *testing.T) {
+	_, socket := writeClamdConf(t)
+	fakeClamd(t, socket, map[string]string{"PING": "PONG"})
+
+	assert.Nil(t, pingClamd(context.Background(), socket))
+}
+
+func TestPingClamdUnexpectedReply(t *testing.T) {
+	_, socket := writeClamdConf(t)
+	fakeClamd(t, socket, map[string]string{"PING": "UNKNOWN COMMAND"})
+
+	assert.Equal(t, `unexpected reply to PING: "UNKNOWN COMMAND"`, pingClamd(context.Background(), socket).Error())
+}
+
+func TestPingClamdWhenNoReply(t *testing.T) {
+	defer func(timeout time.Duration) { commandTimeout = timeout }(commandTimeout)
+	commandTimeout = 10 * time.Millisecond
+
+	_, socket := writeClamdConf(t)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	start := time.Now()
+	assert.ErrorIs(t, pingClamd(ctx, socket), os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestStartDaemonWhenRunning(t *testing.T) {
+	configFile, socket := writeClamdConf(t)
+	fakeClamd(t, socket, map[string]string{"PING": "PONG"})
+
+	s := &ClamAvScanner{
+		ConfigFile: configFile,
+		runDaemon: func(ctx context.Context, configFile string) error {
+			t.Error("clamd should not be started when it is running")
+			return nil
+		},
+	}
+
+	assert.Nil(t, s.StartDaemon())
+}
+
+func TestStartDaemon(t *testing.T) {
+	configFile, socket := writeClamdConf(t)
+
+	starts := 0
+	s := &ClamAvScanner{
+		ConfigFile: configFile,
+		runDaemon: func(ctx context.Context, path string) error {
+			assert.Equal(t, configFile, path)
+			starts++
+			fakeClamd(t, socket, map[string]string{"PING": "PONG"})
+			return nil
+		},
+	}
+
+	assert.Nil(t, s.StartDaemon())
+	assert.Equal(t, 1, starts)
+}
+
+func TestStartDaemonRetriesWithBackoff(t *testing.T) {
+	configFile, socket := writeClamdConf(t)
+
+	starts := 0
+	s := &ClamAvScanner{
+		ConfigFile:     configFile,
+		RestartBackoff: time.Millisecond,
+		runDaemon: func(ctx context.Context, path string) error {
+			starts++
+			if starts < 3 {
+				return errors.New("exit status 1")
+			}
+			fakeClamd(t, socket, map[string]string{"PING": "PONG"})
+			return nil
+		},
+	}
+
+	assert.Nil(t, s.StartDaemon())
+	assert.Equal(t, 3, starts)
+}
+
+func TestStartDaemonGivesUp(t *testing.T) {
+	configFile, _ := writeClamdConf(t)
+
+	s := &ClamAvScanner{
+		ConfigFile:     configFile,
+		StartAttempts:  2,
+		RestartBackoff: time.Millisecond,
+		runDaemon: func(ctx context.Context, path string) error {
+			return errors.New("exit status 1")
+		},
+	}
+
+	err := s.StartDaemon()
+	assert.ErrorIs(t, err, ErrEngineUnavailable)
+	assert.Equal(t, "scanning engine unavailable: clamd failed to start after 2 attempts: exit status 1", err.Error())
+}
+
+func TestStartDaemonNotReady(t *testing.T) {
+	configFile, _ := writeClamdConf(t)
+
+	s := &ClamAvScanner{
+		ConfigFile:     configFile,
+		StartAttempts:  1,
+		ReadyTimeout:   50 * time.Millisecond,
+		RestartBackoff: time.Millisecond,
+		runDaemon: func(ctx context.Context, path string) error {
+			return nil
+		},
+	}
+
+	err := s.StartDaemon()
+	assert.ErrorIs(t, err, ErrEngineUnavailable)
+	assert.Contains(t, err.Error(), "clamd did not answer PING")
+}
+
+func TestScanFileWhenEngineUnavailable(t *testing.T) {
+	configFile, _ := writeClamdConf(t)
+
+	s := &ClamAvScanner{
+		ConfigFile:     configFile,
+		StartAttempts:  1,
+		RestartBackoff: time.Millisecond,
+		runDaemon: func(ctx context.Context, path string) error {
+			return errors.New("exit status 1")
+		},
+	}
+
+	_, err := s.ScanFile(context.Background(), "/tmp/file123")
+	assert.ErrorIs(t, err, ErrEngineUnavailable)
+}
+
+func TestReloadDatabase(t *testing.T) {
+	configFile, socket := writeClamdConf(t)
+	fakeClamd(t, socket, map[string]string{"RELOAD": "RELOADING"})
+
+	s := &ClamAvScanner{ConfigFile: configFile}
+
+	assert.Nil(t, s.ReloadDatabase(context.Background()))
+}
+
+func TestReloadDatabaseWhenNotRunning(t *testing.T) {
+	configFile, _ := writeClamdConf(t)
+
+	s := &ClamAvScanner{ConfigFile: configFile}
+
+	assert.ErrorIs(t, s.ReloadDatabase(context.Background()), ErrEngineUnavailable)
+}
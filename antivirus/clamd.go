@@ -0,0 +1,133 @@
+package antivirus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrEngineUnavailable is returned when clamd is not running and could not be
+// restarted, so the object was not scanned.
+var ErrEngineUnavailable = errors.New("scanning engine unavailable")
+
+// commandTimeout bounds each command sent to clamd, whatever the deadline of
+// the invocation, so that a daemon which accepts connections but never replies
+// is found and restarted.
+var commandTimeout = 5 * time.Second
+
+// clamdConf holds the settings read from clamd.conf that the scanner needs to
+// talk to the daemon.
+type clamdConf struct {
+	LocalSocket string
+	PidFile     string
+}
+
+func readClamdConf(path string) (clamdConf, error) {
+	file, err := os.Open(path) //nolint:gosec // config file is set by the binary
+	if err != nil {
+		return clamdConf{}, fmt.Errorf("failed to read clamd config: %w", err)
+	}
+	defer file.Close() //nolint:errcheck // no need to check error when closing file
+
+	var conf clamdConf
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, " ")
+		switch name {
+		case "LocalSocket":
+			conf.LocalSocket = strings.TrimSpace(value)
+		case "PidFile":
+			conf.PidFile = strings.TrimSpace(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return clamdConf{}, fmt.Errorf("failed to read clamd config: %w", err)
+	}
+
+	if conf.LocalSocket == "" {
+		return clamdConf{}, fmt.Errorf("clamd config %s does not set LocalSocket", path)
+	}
+
+	return conf, nil
+}
+
+// clamdCommand sends a command to clamd on socket and returns its reply,
+// using the null terminated form of the protocol. The command fails after
+// commandTimeout, or sooner when ctx ends.
+func clamdCommand(ctx context.Context, socket, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close() //nolint:errcheck // no need to check error when closing socket
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write([]byte("z" + command + "\x00")); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+func pingClamd(ctx context.Context, socket string) error {
+	reply, err := clamdCommand(ctx, socket, "PING")
+	if err != nil {
+		return err
+	}
+
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply to PING: %q", reply)
+	}
+
+	return nil
+}
+
+// stopClamd signals the process named in pidFile to stop, so that a clamd
+// which has stopped answering does not keep hold of the socket.
+func stopClamd(pidFile string) {
+	if pidFile == "" {
+		return
+	}
+
+	b, err := os.ReadFile(pidFile) //nolint:gosec // pid file is set in the clamd config
+	if err != nil {
+		return
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return
+	}
+
+	_ = syscall.Kill(pid, syscall.SIGTERM)
+	_ = os.Remove(pidFile)
+}
@@ -0,0 +1,39 @@
+package antivirus
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const DefaultDefinitionsDir = "/tmp/clamav"
+
+// DefinitionsPolicy decides what the pipeline does when the definitions
+// check fails.
+type DefinitionsPolicy string
+
+const (
+	DefinitionsFailOpen   DefinitionsPolicy = "fail-open"
+	DefinitionsFailClosed DefinitionsPolicy = "fail-closed"
+	DefinitionsTagStale   DefinitionsPolicy = "tag-stale"
+)
+
+var (
+	ErrDefinitionsMissing = errors.New("virus definitions are missing")
+	ErrDefinitionsStale   = errors.New("virus definitions are stale")
+)
+
+// CheckDefinitionsAge returns ErrDefinitionsMissing when built is zero, as it
+// is when no databases were found, and ErrDefinitionsStale when built is more
+// than maxAge before now. A maxAge of zero allows definitions of any age.
+func CheckDefinitionsAge(built time.Time, maxAge time.Duration, now time.Time) error {
+	if built.IsZero() {
+		return ErrDefinitionsMissing
+	}
+
+	if age := now.Sub(built); maxAge > 0 && age > maxAge {
+		return fmt.Errorf("%w: built %s ago, limit is %s", ErrDefinitionsStale, age.Round(time.Minute), maxAge)
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package antivirus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDefinitionsAge(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, CheckDefinitionsAge(now.Add(-time.Hour), 24*time.Hour, now))
+	assert.Nil(t, CheckDefinitionsAge(now.Add(-1000*time.Hour), 0, now))
+	assert.Equal(t, ErrDefinitionsMissing, CheckDefinitionsAge(time.Time{}, 24*time.Hour, now))
+
+	err := CheckDefinitionsAge(now.Add(-30*time.Hour), 24*time.Hour, now)
+	assert.ErrorIs(t, err, ErrDefinitionsStale)
+	assert.Equal(t, "virus definitions are stale: built 30h0m0s ago, limit is 24h0m0s", err.Error())
+}
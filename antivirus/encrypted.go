@@ -0,0 +1,204 @@
+package antivirus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultEncryptedValue is written for encrypted archives whose contents
+// could not be scanned.
+const DefaultEncryptedValue = "encrypted-unscanned"
+
+// DefaultPasswordMetadataKey is the user metadata key holding the reference to
+// an archive's password.
+const DefaultPasswordMetadataKey = "archive-password-ref"
+
+// ErrPasswordNotFound is returned by a PasswordResolver that has no password
+// for a reference.
+var ErrPasswordNotFound = errors.New("archive password not found")
+
+// A PasswordResolver looks up the password for an encrypted archive. ref is
+// taken from the object's metadata, so is chosen by whoever uploaded it.
+type PasswordResolver interface {
+	Password(ctx context.Context, ref string) (string, error)
+}
+
+// WithPasswords decrypts encrypted zip files whose metadata, under
+// metadataKey, names a password known to resolver, so that their contents can
+// be scanned. When metadataKey is empty DefaultPasswordMetadataKey is used.
+func WithPasswords(resolver PasswordResolver, metadataKey string) Option {
+	return func(p *Pipeline) {
+		p.passwords = resolver
+		p.passwordMetadataKey = metadataKey
+	}
+}
+
+// validPasswordRef limits references to names that cannot reach outside of a
+// password file or parameter prefix.
+var validPasswordRef = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// PasswordFile is a map of references to passwords, read from a JSON object.
+type PasswordFile map[string]string
+
+// LoadPasswordFile reads a PasswordFile.
+func LoadPasswordFile(path string) (PasswordFile, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // path is set by infra
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passwords file: %w", err)
+	}
+
+	var passwords PasswordFile
+	if err := json.Unmarshal(data, &passwords); err != nil {
+		return nil, fmt.Errorf("failed to parse passwords file %s: %w", path, err)
+	}
+
+	return passwords, nil
+}
+
+func (f PasswordFile) Password(ctx context.Context, ref string) (string, error) {
+	password, ok := f[ref]
+	if !ok || !validPasswordRef.MatchString(ref) {
+		return "", ErrPasswordNotFound
+	}
+
+	return password, nil
+}
+
+// ParameterPasswords reads passwords from SSM Parameter Store through the AWS
+// Parameters and Secrets Lambda extension, or a stand-in serving the same
+// API. The parameter read is Prefix followed by the reference.
+type ParameterPasswords struct {
+	// Endpoint is the extension's address, such as http://localhost:2773.
+	Endpoint string
+	Prefix   string
+	// Token is sent as X-Aws-Parameters-Secrets-Token, the extension expects
+	// the function's AWS_SESSION_TOKEN.
+	Token  string
+	Client *http.Client
+}
+
+func (p *ParameterPasswords) Password(ctx context.Context, ref string) (string, error) {
+	if !validPasswordRef.MatchString(ref) {
+		return "", ErrPasswordNotFound
+	}
+
+	query := url.Values{
+		"name":           {p.Prefix + ref},
+		"withDecryption": {"true"},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.Endpoint, "/")+"/systemsmanager/parameters/get?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password parameter: %w", err)
+	}
+	req.Header.Set("X-Aws-Parameters-Secrets-Token", p.Token)
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password parameter: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound:
+		return "", ErrPasswordNotFound
+	default:
+		return "", fmt.Errorf("failed to read password parameter: %s", resp.Status)
+	}
+
+	var output struct {
+		Parameter struct {
+			Value string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
+		return "", fmt.Errorf("failed to parse password parameter: %w", err)
+	}
+
+	return output.Parameter.Value, nil
+}
+
+// IsEncryptedArchive reports whether the archive in f, or any archive nested
+// in it, has encrypted members. Nested archives are extracted to tempDir
+// within limits, and when one is exceeded the ArchiveViolation is returned
+// with what was found so far.
+func IsEncryptedArchive(f *os.File, limits ArchiveLimits, tempDir string) (bool, error) {
+	inspector, err := walkArchive(context.Background(), f, "", limits, tempDir, "", nil)
+
+	return inspector.encrypted, err
+}
+
+// scanEncrypted decrypts an archive that inspectArchive found to be encrypted
+// with the password named in its metadata, and scans its members. unscanned is
+// set when its contents could not all be scanned.
+func (p *Pipeline) scanEncrypted(ctx context.Context, obj Object, f *os.File, metadata map[string]string) (infected []InfectedMember, unscanned bool, err error) {
+	limits := p.memberLimits()
+
+	ctx, span := tracer.Start(ctx, "antivirus.scan_encrypted", objectAttributes(obj))
+	defer func() {
+		span.SetAttributes(
+			attribute.Bool("antivirus.unscanned", unscanned),
+			attribute.Int("antivirus.infected_members", len(infected)),
+		)
+		tracing.End(span, err)
+	}()
+
+	ref := metadata[strings.ToLower(p.passwordKey())]
+	if p.passwords == nil || ref == "" {
+		slog.InfoContext(ctx, "encrypted archive has no password")
+		return nil, true, nil
+	}
+
+	password, err := p.passwords.Password(ctx, ref)
+	if errors.Is(err, ErrPasswordNotFound) {
+		slog.WarnContext(ctx, "encrypted archive password not found", slog.String("passwordRef", ref))
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var inspector *archiveInspector
+	inspector, err = walkArchive(ctx, f, path.Base(obj.Key), limits, p.tempDir, password, p.scanner)
+	infected = inspector.infected
+
+	switch {
+	case errors.Is(err, ErrWrongPassword):
+		slog.WarnContext(ctx, "encrypted archive password is wrong", slog.String("passwordRef", ref))
+		return infected, len(infected) == 0, nil
+	case err != nil:
+		if err = ignoreArchiveErrors(err); err != nil {
+			return nil, false, err
+		}
+		slog.WarnContext(ctx, "stopped scanning encrypted archive members")
+		return infected, len(infected) == 0, nil
+	}
+
+	return infected, len(infected) == 0 && inspector.encrypted, nil
+}
+
+func (p *Pipeline) passwordKey() string {
+	if p.passwordMetadataKey == "" {
+		return DefaultPasswordMetadataKey
+	}
+
+	return p.passwordMetadataKey
+}
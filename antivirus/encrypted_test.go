@@ -0,0 +1,383 @@
+package antivirus
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1" //nolint:gosec // WinZip AES is defined with SHA-1
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// zipCryptoBytes creates a zip with its members stored and encrypted with
+// traditional PKWARE encryption.
+func zipCryptoBytes(t *testing.T, password string, members ...archiveMember) []byte {
+	return encryptedZipBytes(t, members, func(m archiveMember) (*zip.FileHeader, []byte) {
+		crc := crc32.ChecksumIEEE(m.content)
+
+		keys := zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+		for _, b := range []byte(password) {
+			keys.update(b)
+		}
+
+		plain := append(make([]byte, 11), byte(crc>>24))
+		plain = append(plain, m.content...)
+		data := make([]byte, len(plain))
+		for i, b := range plain {
+			temp := keys[2] | 2
+			data[i] = b ^ byte((temp*(temp^1))>>8)
+			keys.update(b)
+		}
+
+		return &zip.FileHeader{
+			Name:               m.name,
+			Method:             zip.Store,
+			Flags:              zipFlagEncrypted,
+			CRC32:              crc,
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(m.content)),
+		}, data
+	})
+}
+
+// aesZipBytes creates a zip with its members stored and encrypted with
+// 128-bit WinZip AES.
+func aesZipBytes(t *testing.T, password string, members ...archiveMember) []byte {
+	return encryptedZipBytes(t, members, func(m archiveMember) (*zip.FileHeader, []byte) {
+		salt := []byte("saltsalt")
+		keys, err := pbkdf2.Key(sha1.New, password, salt, 1000, 34)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block, err := aes.NewCipher(keys[:16])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ciphertext := make([]byte, len(m.content))
+		var counter [aes.BlockSize]byte
+		stream := make([]byte, aes.BlockSize)
+		for i := range m.content {
+			if i%aes.BlockSize == 0 {
+				binary.LittleEndian.PutUint64(counter[:], uint64(i/aes.BlockSize+1)) //nolint:gosec // test content is small
+				block.Encrypt(stream, counter[:])
+			}
+			ciphertext[i] = m.content[i] ^ stream[i%aes.BlockSize]
+		}
+
+		mac := hmac.New(sha1.New, keys[16:32])
+		mac.Write(ciphertext) //nolint:errcheck // hash writes do not fail
+
+		data := append(append(append(salt, keys[32:]...), ciphertext...), mac.Sum(nil)[:10]...)
+
+		return &zip.FileHeader{
+			Name:               m.name,
+			Method:             zipMethodAES,
+			Flags:              zipFlagEncrypted,
+			CRC32:              crc32.ChecksumIEEE(m.content),
+			CompressedSize64:   uint64(len(data)),
+			UncompressedSize64: uint64(len(m.content)),
+			Extra:              []byte{0x01, 0x99, 7, 0, 1, 0, 'A', 'E', 1, 0, 0},
+		}, data
+	})
+}
+
+func encryptedZipBytes(t *testing.T, members []archiveMember, encrypt func(archiveMember) (*zip.FileHeader, []byte)) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		header, data := encrypt(m)
+		w, err := zw.CreateRaw(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	content := []byte("a document long enough to need more than one block of the AES stream")
+
+	testcases := map[string][]byte{
+		"zip crypto": zipCryptoBytes(t, "secret", archiveMember{"a.pdf", content}),
+		"aes":        aesZipBytes(t, "secret", archiveMember{"a.pdf", content}),
+	}
+
+	for name, archive := range testcases {
+		t.Run(name, func(t *testing.T) {
+			zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.True(t, isEncrypted(zr.File[0]))
+
+			rc, err := openEncrypted(zr.File[0], "secret")
+			if assert.Nil(t, err) {
+				data, err := io.ReadAll(rc)
+				assert.Nil(t, err)
+				assert.Equal(t, content, data)
+			}
+
+			rc, err = openEncrypted(zr.File[0], "guess")
+			if err == nil {
+				_, err = io.ReadAll(rc)
+			}
+			assert.ErrorIs(t, err, ErrWrongPassword)
+		})
+	}
+}
+
+// TestOpenEncryptedKnownAnswers decrypts archives made by other zip
+// implementations, so that openEncrypted is not only checked against the
+// encryption in this file. The archives in testdata/encrypted hold the same
+// member.txt encrypted with the password "infected", made with
+//
+//	zip -P infected infozip-deflate.zip member.txt
+//	zip -0 -P infected infozip-store.zip member.txt
+//	bsdtar --format zip --options zip:encryption=zipcrypt --passphrase infected -cf libarchive-zipcrypto.zip member.txt
+//	bsdtar --format zip --options zip:encryption=aes128 --passphrase infected -cf libarchive-aes128.zip member.txt
+//	bsdtar --format zip --options zip:encryption=aes256 --passphrase infected -cf libarchive-aes256.zip member.txt
+//	bsdtar --format zip --options zip:encryption=aes256,zip:compression=store --passphrase infected -cf libarchive-aes256-store.zip member.txt
+//
+// using Info-ZIP 3.0 and libarchive 3.7.7.
+func TestOpenEncryptedKnownAnswers(t *testing.T) {
+	var content []byte
+	for i := 1; i <= 6; i++ {
+		content = fmt.Appendf(content, "line %d of a member encrypted by another implementation\n", i)
+	}
+
+	for _, name := range []string{
+		"infozip-deflate.zip",
+		"infozip-store.zip",
+		"libarchive-zipcrypto.zip",
+		"libarchive-aes128.zip",
+		"libarchive-aes256.zip",
+		"libarchive-aes256-store.zip",
+	} {
+		t.Run(name, func(t *testing.T) {
+			zr, err := zip.OpenReader(filepath.Join("testdata", "encrypted", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+
+			assert.Len(t, zr.File, 1)
+			assert.True(t, isEncrypted(zr.File[0]))
+
+			rc, err := openEncrypted(zr.File[0], "infected")
+			if assert.Nil(t, err) {
+				data, err := io.ReadAll(rc)
+				assert.Nil(t, err)
+				assert.Nil(t, rc.Close())
+				assert.Equal(t, content, data)
+			}
+
+			rc, err = openEncrypted(zr.File[0], "guess")
+			if err == nil {
+				_, err = io.ReadAll(rc)
+			}
+			assert.ErrorIs(t, err, ErrWrongPassword)
+		})
+	}
+}
+
+func TestIsEncryptedArchive(t *testing.T) {
+	small := []byte("evidence document")
+
+	testcases := map[string]struct {
+		content   []byte
+		encrypted bool
+	}{
+		"not an archive": {
+			content: []byte("%PDF-1.7\n"),
+		},
+		"zip": {
+			content: zipBytes(t, archiveMember{"a.pdf", small}),
+		},
+		"zip crypto": {
+			content:   zipCryptoBytes(t, "secret", archiveMember{"a.pdf", small}),
+			encrypted: true,
+		},
+		"aes": {
+			content:   aesZipBytes(t, "secret", archiveMember{"a.pdf", small}),
+			encrypted: true,
+		},
+		"nested": {
+			content:   tarBytes(t, archiveMember{"inner.zip", zipCryptoBytes(t, "secret", archiveMember{"a.pdf", small})}),
+			encrypted: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			encrypted, err := IsEncryptedArchive(tempFile(t, tc.content), DefaultArchiveLimits, t.TempDir())
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.encrypted, encrypted)
+		})
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords.json")
+	if err := os.WriteFile(path, []byte(`{"case-123": "secret", "../other": "secret"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	passwords, err := LoadPasswordFile(path)
+	assert.Nil(t, err)
+
+	password, err := passwords.Password(context.Background(), "case-123")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", password)
+
+	_, err = passwords.Password(context.Background(), "case-456")
+	assert.Equal(t, ErrPasswordNotFound, err)
+
+	_, err = passwords.Password(context.Background(), "../other")
+	assert.Equal(t, ErrPasswordNotFound, err)
+}
+
+func TestParameterPasswords(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/systemsmanager/parameters/get", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("withDecryption"))
+		assert.Equal(t, "session-token", r.Header.Get("X-Aws-Parameters-Secrets-Token"))
+
+		switch r.URL.Query().Get("name") {
+		case "/antivirus/passwords/case-123":
+			_, _ = w.Write([]byte(`{"Parameter": {"Name": "/antivirus/passwords/case-123", "Value": "secret"}}`))
+		case "/antivirus/passwords/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	passwords := &ParameterPasswords{
+		Endpoint: server.URL,
+		Prefix:   "/antivirus/passwords/",
+		Token:    "session-token",
+	}
+
+	password, err := passwords.Password(context.Background(), "case-123")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", password)
+
+	_, err = passwords.Password(context.Background(), "case-456")
+	assert.Equal(t, ErrPasswordNotFound, err)
+
+	_, err = passwords.Password(context.Background(), "../case-123")
+	assert.Equal(t, ErrPasswordNotFound, err)
+
+	_, err = passwords.Password(context.Background(), "broken")
+	assert.ErrorContains(t, err, "500 Internal Server Error")
+}
+
+func TestScanEncryptedArchive(t *testing.T) {
+	clean := zipCryptoBytes(t, "secret", archiveMember{"a.pdf", []byte("evidence document")})
+	infected := aesZipBytes(t, "secret",
+		archiveMember{"a.pdf", []byte("evidence document")},
+		archiveMember{"b.pdf", []byte("EICAR test file")},
+	)
+	// The AES extra field names the method of the plain content, here set to
+	// bzip2, which cannot be decompressed.
+	bzip2 := bytes.ReplaceAll(
+		aesZipBytes(t, "secret", archiveMember{"a.pdf", []byte("evidence document")}),
+		[]byte{'A', 'E', 1, 0, 0},
+		[]byte{'A', 'E', 1, 12, 0},
+	)
+
+	testcases := map[string]struct {
+		content  []byte
+		metadata map[string]string
+		status   string
+		members  []InfectedMember
+	}{
+		"no password": {
+			content: clean,
+			status:  "encrypted-unscanned",
+		},
+		"unknown password": {
+			content:  clean,
+			metadata: map[string]string{"archive-password-ref": "case-456"},
+			status:   "encrypted-unscanned",
+		},
+		"wrong password": {
+			content:  clean,
+			metadata: map[string]string{"archive-password-ref": "wrong"},
+			status:   "encrypted-unscanned",
+		},
+		"clean": {
+			content:  clean,
+			metadata: map[string]string{"archive-password-ref": "case-123"},
+			status:   "ok",
+		},
+		"unsupported method": {
+			content:  bzip2,
+			metadata: map[string]string{"archive-password-ref": "case-123"},
+			status:   "encrypted-unscanned",
+		},
+		"infected": {
+			content:  infected,
+			metadata: map[string]string{"archive-password-ref": "case-123"},
+			status:   "infected",
+			members:  []InfectedMember{{Path: "b.pdf", Signature: "Eicar-Signature"}},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			downloader := new(mockDownloader)
+			downloader.On("GetObject", "my-bucket", "evidence.zip").Return(&s3.GetObjectOutput{
+				Body:     io.NopCloser(bytes.NewReader(tc.content)),
+				Metadata: tc.metadata,
+			}, nil)
+
+			mockS3 := new(mockS3Tagger)
+			mockS3.On("GetObjectTagging", "my-bucket", "evidence.zip").Return([]*types.Tag{}, nil)
+			mockS3.On("PutObjectTagging", "my-bucket", "evidence.zip", []*types.Tag{
+				{Key: aws.String("virus-scan-status"), Value: aws.String(tc.status)},
+			}).Return(nil)
+
+			p := New(downloader, mockS3, contentScanner{},
+				WithTempDir(t.TempDir()),
+				WithTagValues(TagValues{Pass: "ok", Fail: "infected"}),
+				WithPasswords(PasswordFile{"case-123": "secret", "wrong": "guess"}, ""),
+			)
+
+			result, err := p.Scan(context.Background(), Object{Bucket: "my-bucket", Key: "evidence.zip"})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.status, result.Status)
+			assert.Equal(t, tc.members, result.InfectedMembers)
+
+			mock.AssertExpectationsForObjects(t, downloader, mockS3)
+		})
+	}
+}
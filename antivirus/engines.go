@@ -0,0 +1,210 @@
+package antivirus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Engine names used in configuration.
+const (
+	EngineClamAV = "clamav"
+	EngineYara   = "yara"
+	EngineICAP   = "icap"
+)
+
+// Modes for running the engines of a MultiScanner.
+const (
+	EngineModeSequence = "sequence"
+	EngineModeParallel = "parallel"
+)
+
+// Consensus policies for combining the verdicts of a MultiScanner's engines.
+const (
+	// ConsensusAnyInfected fails a file when any engine finds it infected.
+	ConsensusAnyInfected = "any-infected"
+	// ConsensusMajority passes a file when more than half of the engines find
+	// it clean and fails it when that many, or half of them, find it
+	// infected. A scan where failed engines could have changed the verdict
+	// returns an error.
+	ConsensusMajority = "majority"
+	// ConsensusPrimary takes the verdict of the first engine. When it fails
+	// the other engines decide as with ConsensusAnyInfected, so the file is
+	// only clean when every one of them has said so.
+	ConsensusPrimary = "primary-with-fallback"
+)
+
+// EngineVerdict is the outcome of one engine's scan of a file.
+type EngineVerdict struct {
+	Engine    string `json:"engine"`
+	Clean     bool   `json:"clean"`
+	Signature string `json:"signature,omitempty"`
+	// Error is set when the engine failed, in which case Clean is
+	// meaningless.
+	Error string `json:"error,omitempty"`
+}
+
+// Engine is a Scanner with the name used to record its verdicts.
+type Engine struct {
+	Name    string
+	Scanner Scanner
+}
+
+// MultiScanner scans files with several engines, combining their verdicts with
+// a consensus policy. The combined Verdict records each engine's verdict in
+// Engines.
+type MultiScanner struct {
+	// Engines are run in order, the first is the primary engine.
+	Engines []Engine
+	// Mode is EngineModeSequence or EngineModeParallel, when empty the
+	// engines are run in sequence. In sequence an any-infected scan stops at
+	// the first infected verdict, and a primary-with-fallback scan after the
+	// primary engine unless it fails.
+	Mode string
+	// Consensus is how verdicts are combined, when empty
+	// ConsensusAnyInfected is used.
+	Consensus string
+}
+
+// StartDaemon starts each engine, returning the errors of those that failed.
+func (s *MultiScanner) StartDaemon() error {
+	var errs []error
+	for _, engine := range s.Engines {
+		if err := engine.Scanner.StartDaemon(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", engine.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+type engineResult struct {
+	name    string
+	verdict Verdict
+	err     error
+}
+
+func (s *MultiScanner) ScanFile(ctx context.Context, path string) (Verdict, error) {
+	var results []engineResult
+	if s.Mode == EngineModeParallel {
+		results = s.scanParallel(ctx, path)
+	} else {
+		results = s.scanSequence(ctx, path)
+	}
+
+	engines := make([]EngineVerdict, len(results))
+	for i, result := range results {
+		engines[i] = EngineVerdict{Engine: result.name, Clean: result.verdict.Clean, Signature: result.verdict.Signature}
+		if result.err != nil {
+			slog.WarnContext(ctx, "scanning engine failed", slog.String("engine", result.name), slog.Any("error", result.err))
+			engines[i] = EngineVerdict{Engine: result.name, Error: result.err.Error()}
+		}
+	}
+
+	verdict, err := s.combine(results)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	verdict.Engines = engines
+	return verdict, nil
+}
+
+func (s *MultiScanner) scanSequence(ctx context.Context, path string) []engineResult {
+	var results []engineResult
+	for i, engine := range s.Engines {
+		verdict, err := engine.Scanner.ScanFile(ctx, path)
+		results = append(results, engineResult{name: engine.Name, verdict: verdict, err: err})
+
+		switch s.consensus() {
+		case ConsensusAnyInfected:
+			if err == nil && !verdict.Clean {
+				return results
+			}
+		case ConsensusPrimary:
+			if i == 0 && err == nil {
+				return results
+			}
+		}
+	}
+
+	return results
+}
+
+func (s *MultiScanner) scanParallel(ctx context.Context, path string) []engineResult {
+	results := make([]engineResult, len(s.Engines))
+
+	var wg sync.WaitGroup
+	for i, engine := range s.Engines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			verdict, err := engine.Scanner.ScanFile(ctx, path)
+			results[i] = engineResult{name: engine.Name, verdict: verdict, err: err}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// combine decides the verdict from the engines' results. A file that the
+// engines that answered could not decide on returns the engines' errors.
+func (s *MultiScanner) combine(results []engineResult) (Verdict, error) {
+	var errs []error
+	var clean, infected []Verdict
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.name, result.err))
+		} else if result.verdict.Clean {
+			clean = append(clean, result.verdict)
+		} else {
+			infected = append(infected, result.verdict)
+		}
+	}
+
+	if len(clean)+len(infected) == 0 {
+		return Verdict{}, fmt.Errorf("failed to scan file: %w", errors.Join(errs...))
+	}
+
+	switch s.consensus() {
+	case ConsensusPrimary:
+		if results[0].err == nil {
+			return Verdict{Clean: results[0].verdict.Clean, Signature: results[0].verdict.Signature}, nil
+		}
+		// Every other engine has said the file is clean.
+		if len(infected) == 0 && len(errs) == 1 {
+			return Verdict{Clean: true}, nil
+		}
+
+	case ConsensusMajority:
+		total := len(s.Engines)
+		if 2*len(clean) > total {
+			return Verdict{Clean: true}, nil
+		}
+		if 2*len(infected) >= total {
+			return Verdict{Signature: infected[0].Signature}, nil
+		}
+		return Verdict{}, fmt.Errorf("failed to scan file, too few engines answered for a majority: %w", errors.Join(errs...))
+	}
+
+	if len(infected) > 0 {
+		return Verdict{Signature: infected[0].Signature}, nil
+	}
+	// A file is only clean when every engine has said so.
+	if len(errs) > 0 {
+		return Verdict{}, fmt.Errorf("failed to scan file: %w", errors.Join(errs...))
+	}
+	return Verdict{Clean: true}, nil
+}
+
+func (s *MultiScanner) consensus() string {
+	if s.Consensus == "" {
+		return ConsensusAnyInfected
+	}
+
+	return s.Consensus
+}
@@ -0,0 +1,179 @@
+package antivirus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func engineScanner(verdict Verdict, err error) *mockScanner {
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", "/tmp/file").Return(verdict, err)
+	return scanner
+}
+
+func TestMultiScannerScanFile(t *testing.T) {
+	clean := Verdict{Clean: true}
+	infected := Verdict{Signature: "Eicar"}
+	failed := errors.New("connection refused")
+
+	testcases := map[string]struct {
+		mode      string
+		consensus string
+		verdicts  []Verdict
+		errs      []error
+		expected  Verdict
+		err       string
+	}{
+		"any infected when all clean": {
+			verdicts: []Verdict{clean, clean, clean},
+			errs:     []error{nil, nil, nil},
+			expected: Verdict{Clean: true, Engines: []EngineVerdict{
+				{Engine: "clamav", Clean: true},
+				{Engine: "yara", Clean: true},
+				{Engine: "icap", Clean: true},
+			}},
+		},
+		"any infected stops at first infected": {
+			verdicts: []Verdict{clean, infected, clean},
+			errs:     []error{nil, nil, nil},
+			expected: Verdict{Signature: "Eicar", Engines: []EngineVerdict{
+				{Engine: "clamav", Clean: true},
+				{Engine: "yara", Signature: "Eicar"},
+			}},
+		},
+		"any infected when an engine fails": {
+			verdicts: []Verdict{clean, {}, clean},
+			errs:     []error{nil, failed, nil},
+			err:      "failed to scan file: yara: connection refused",
+		},
+		"any infected when an engine fails and another finds infection": {
+			verdicts: []Verdict{{}, infected, clean},
+			errs:     []error{failed, nil, nil},
+			expected: Verdict{Signature: "Eicar", Engines: []EngineVerdict{
+				{Engine: "clamav", Error: "connection refused"},
+				{Engine: "yara", Signature: "Eicar"},
+			}},
+		},
+		"majority infected": {
+			consensus: ConsensusMajority,
+			verdicts:  []Verdict{infected, clean, infected},
+			errs:      []error{nil, nil, nil},
+			expected: Verdict{Signature: "Eicar", Engines: []EngineVerdict{
+				{Engine: "clamav", Signature: "Eicar"},
+				{Engine: "yara", Clean: true},
+				{Engine: "icap", Signature: "Eicar"},
+			}},
+		},
+		"majority clean": {
+			consensus: ConsensusMajority,
+			verdicts:  []Verdict{infected, clean, clean},
+			errs:      []error{nil, nil, nil},
+			expected: Verdict{Clean: true, Engines: []EngineVerdict{
+				{Engine: "clamav", Signature: "Eicar"},
+				{Engine: "yara", Clean: true},
+				{Engine: "icap", Clean: true},
+			}},
+		},
+		"majority clean when an engine fails": {
+			consensus: ConsensusMajority,
+			verdicts:  []Verdict{{}, clean, clean},
+			errs:      []error{failed, nil, nil},
+			expected: Verdict{Clean: true, Engines: []EngineVerdict{
+				{Engine: "clamav", Error: "connection refused"},
+				{Engine: "yara", Clean: true},
+				{Engine: "icap", Clean: true},
+			}},
+		},
+		"majority when an engine fails without a majority": {
+			consensus: ConsensusMajority,
+			verdicts:  []Verdict{infected, clean, {}},
+			errs:      []error{nil, nil, failed},
+			err:       "failed to scan file, too few engines answered for a majority: icap: connection refused",
+		},
+		"primary": {
+			consensus: ConsensusPrimary,
+			verdicts:  []Verdict{clean, infected, infected},
+			errs:      []error{nil, nil, nil},
+			expected: Verdict{Clean: true, Engines: []EngineVerdict{
+				{Engine: "clamav", Clean: true},
+			}},
+		},
+		"primary falls back": {
+			consensus: ConsensusPrimary,
+			verdicts:  []Verdict{{}, clean, clean},
+			errs:      []error{failed, nil, nil},
+			expected: Verdict{Clean: true, Engines: []EngineVerdict{
+				{Engine: "clamav", Error: "connection refused"},
+				{Engine: "yara", Clean: true},
+				{Engine: "icap", Clean: true},
+			}},
+		},
+		"primary falls back to infected": {
+			consensus: ConsensusPrimary,
+			verdicts:  []Verdict{{}, clean, infected},
+			errs:      []error{failed, nil, nil},
+			expected: Verdict{Signature: "Eicar", Engines: []EngineVerdict{
+				{Engine: "clamav", Error: "connection refused"},
+				{Engine: "yara", Clean: true},
+				{Engine: "icap", Signature: "Eicar"},
+			}},
+		},
+		"primary falls back when a fallback fails": {
+			consensus: ConsensusPrimary,
+			verdicts:  []Verdict{{}, clean, {}},
+			errs:      []error{failed, nil, failed},
+			err:       "failed to scan file: clamav: connection refused\nicap: connection refused",
+		},
+		"parallel records every engine": {
+			mode:      EngineModeParallel,
+			consensus: ConsensusPrimary,
+			verdicts:  []Verdict{clean, infected, {}},
+			errs:      []error{nil, nil, failed},
+			expected: Verdict{Clean: true, Engines: []EngineVerdict{
+				{Engine: "clamav", Clean: true},
+				{Engine: "yara", Signature: "Eicar"},
+				{Engine: "icap", Error: "connection refused"},
+			}},
+		},
+		"all engines fail": {
+			consensus: ConsensusMajority,
+			verdicts:  []Verdict{{}, {}, {}},
+			errs:      []error{failed, failed, failed},
+			err:       "failed to scan file: clamav: connection refused\nyara: connection refused\nicap: connection refused",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			scanner := &MultiScanner{Mode: tc.mode, Consensus: tc.consensus}
+			for i, engine := range []string{EngineClamAV, EngineYara, EngineICAP} {
+				scanner.Engines = append(scanner.Engines, Engine{Name: engine, Scanner: engineScanner(tc.verdicts[i], tc.errs[i])})
+			}
+
+			verdict, err := scanner.ScanFile(context.Background(), "/tmp/file")
+
+			if tc.err != "" {
+				assert.Equal(t, tc.err, err.Error())
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, verdict)
+			}
+		})
+	}
+}
+
+func TestMultiScannerStartDaemon(t *testing.T) {
+	clamav := new(mockScanner)
+	clamav.On("StartDaemon").Return(nil)
+	yara := new(mockScanner)
+	yara.On("StartDaemon").Return(errors.New("rules not found"))
+
+	scanner := &MultiScanner{Engines: []Engine{{Name: EngineClamAV, Scanner: clamav}, {Name: EngineYara, Scanner: yara}}}
+
+	assert.Equal(t, "yara: rules not found", scanner.StartDaemon().Error())
+	mock.AssertExpectationsForObjects(t, clamav, yara)
+}
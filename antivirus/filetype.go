@@ -0,0 +1,194 @@
+package antivirus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultDisallowedTypeValue is written for clean objects whose contents do not
+// match the policy's AllowedTypes.
+const DefaultDisallowedTypeValue = "disallowed-type"
+
+// sniffLen is how much of a file is read to detect its type.
+const sniffLen = 512
+
+// File types detected from the first bytes of an object.
+const (
+	FileTypePDF    = "pdf"
+	FileTypePNG    = "png"
+	FileTypeJPEG   = "jpeg"
+	FileTypeGIF    = "gif"
+	FileTypeTIFF   = "tiff"
+	FileTypeBMP    = "bmp"
+	FileTypeWebP   = "webp"
+	FileTypeHEIC   = "heic"
+	FileTypeZip    = "zip"
+	FileTypeTar    = "tar"
+	FileTypeOLE    = "ole"
+	FileTypeRTF    = "rtf"
+	FileTypeGzip   = "gzip"
+	FileTypeExe    = "exe"
+	FileTypeELF    = "elf"
+	FileTypeMachO  = "macho"
+	FileTypeText   = "text"
+	FileTypeBinary = "binary"
+)
+
+type fileType struct {
+	name       string
+	extensions []string
+	match      func(header []byte) bool
+}
+
+// fileTypes are checked in order, so that text, which has no magic bytes, is
+// only chosen when nothing else matches.
+var fileTypes = []fileType{
+	{FileTypePDF, []string{".pdf"}, prefix("%PDF-")},
+	{FileTypePNG, []string{".png"}, prefix("\x89PNG\r\n\x1a\n")},
+	{FileTypeJPEG, []string{".jpg", ".jpeg"}, prefix("\xff\xd8\xff")},
+	{FileTypeGIF, []string{".gif"}, prefix("GIF87a", "GIF89a")},
+	{FileTypeTIFF, []string{".tif", ".tiff"}, prefix("II*\x00", "MM\x00*")},
+	{FileTypeBMP, []string{".bmp"}, isBMP},
+	{FileTypeWebP, []string{".webp"}, func(h []byte) bool {
+		return len(h) >= 12 && string(h[:4]) == "RIFF" && string(h[8:12]) == "WEBP"
+	}},
+	{FileTypeHEIC, []string{".heic", ".heif"}, func(h []byte) bool {
+		return len(h) >= 12 && string(h[4:8]) == "ftyp" && slices.Contains([]string{"heic", "heix", "mif1", "msf1"}, string(h[8:12]))
+	}},
+	{FileTypeZip, []string{".zip", ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp"}, prefix("PK\x03\x04", "PK\x05\x06")},
+	{FileTypeOLE, []string{".doc", ".xls", ".ppt", ".msg"}, prefix("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")},
+	{FileTypeRTF, []string{".rtf"}, prefix(`{\rtf`)},
+	{FileTypeGzip, []string{".gz", ".tgz"}, prefix("\x1f\x8b")},
+	{FileTypeExe, []string{".exe", ".dll", ".sys", ".scr"}, isExe},
+	{FileTypeELF, nil, prefix("\x7fELF")},
+	{FileTypeMachO, nil, prefix("\xfe\xed\xfa\xce", "\xfe\xed\xfa\xcf", "\xce\xfa\xed\xfe", "\xcf\xfa\xed\xfe")},
+	{FileTypeTar, []string{".tar"}, func(h []byte) bool {
+		return len(h) >= 262 && string(h[257:262]) == "ustar"
+	}},
+	{FileTypeText, []string{".txt", ".csv"}, isText},
+}
+
+func prefix(magic ...string) func([]byte) bool {
+	return func(h []byte) bool {
+		for _, m := range magic {
+			if bytes.HasPrefix(h, []byte(m)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// bmpHeaderSizes are the sizes of the known DIB headers that follow the BMP
+// file header.
+var bmpHeaderSizes = []uint32{12, 40, 52, 56, 64, 108, 124}
+
+// isBMP checks the BMP file header as well as its magic, which is too short
+// to tell a bitmap from text that starts with "BM". The reserved bytes must be
+// zero and the DIB header a known size, with the pixel data after it and
+// within the file size.
+func isBMP(h []byte) bool {
+	if len(h) < 18 || string(h[:2]) != "BM" || binary.LittleEndian.Uint32(h[6:]) != 0 {
+		return false
+	}
+
+	fileSize := binary.LittleEndian.Uint32(h[2:])
+	offset := binary.LittleEndian.Uint32(h[10:])
+	headerSize := binary.LittleEndian.Uint32(h[14:])
+
+	return slices.Contains(bmpHeaderSizes, headerSize) && offset >= 14+headerSize && fileSize >= offset
+}
+
+// maxPEOffset bounds where the PE header of an executable can start, as it
+// must be within the headers the loader maps.
+const maxPEOffset = 0x10000
+
+// isExe checks that the DOS header's e_lfanew points at a PE signature, as
+// "MZ" alone is too short to tell an executable from text. When the PE header
+// starts beyond the sniffed header, a plausible offset is enough, as text
+// cannot hold the zero bytes of one.
+func isExe(h []byte) bool {
+	if len(h) < 0x40 || string(h[:2]) != "MZ" {
+		return false
+	}
+
+	offset := binary.LittleEndian.Uint32(h[0x3c:])
+	if offset < 0x40 || offset >= maxPEOffset {
+		return false
+	}
+	if int(offset)+4 > len(h) {
+		return int(offset) >= sniffLen
+	}
+
+	return string(h[offset:offset+4]) == "PE\x00\x00"
+}
+
+// isText accepts UTF-8 without control characters other than whitespace. The
+// header may end part way through a character.
+func isText(h []byte) bool {
+	for len(h) > 0 {
+		r, size := utf8.DecodeRune(h)
+		if r == utf8.RuneError && size == 1 {
+			return !utf8.FullRune(h)
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+		h = h[size:]
+	}
+
+	return true
+}
+
+// IsFileType reports whether name is one of the FileType constants.
+func IsFileType(name string) bool {
+	return name == FileTypeBinary || slices.ContainsFunc(fileTypes, func(t fileType) bool { return t.name == name })
+}
+
+// DetectFileType reads the start of r and returns the type its contents
+// match, or FileTypeBinary when none do.
+func DetectFileType(r io.ReaderAt) (string, error) {
+	header := make([]byte, sniffLen)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	for _, t := range fileTypes {
+		if t.match(header) {
+			return t.name, nil
+		}
+	}
+
+	return FileTypeBinary, nil
+}
+
+// checkFileType decides whether a file of fileType is allowed at key. The type
+// must be in allowed and, when key has an extension, the extension must be
+// one used for that type. Types without extensions of their own, such as
+// FileTypeBinary, are allowed with any extension.
+func checkFileType(key, fileType string, allowed []string) bool {
+	if !slices.Contains(allowed, fileType) {
+		return false
+	}
+
+	ext := strings.ToLower(path.Ext(key))
+	if ext == "" {
+		return true
+	}
+
+	var extensions []string
+	for _, t := range fileTypes {
+		if t.name == fileType {
+			extensions = t.extensions
+		}
+	}
+
+	return len(extensions) == 0 || slices.Contains(extensions, ext)
+}
@@ -0,0 +1,153 @@
+package antivirus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// exeHeader is the start of a PE executable, whose DOS header points at the
+// PE signature at 0x80.
+var exeHeader = "MZ\x90\x00" + strings.Repeat("\x00", 0x38) + "\x80\x00\x00\x00" + strings.Repeat("\x00", 0x40) + "PE\x00\x00"
+
+// bmpHeader is the start of a BMP file with a 40 byte DIB header.
+const bmpHeader = "BM\x46\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00"
+
+func TestDetectFileType(t *testing.T) {
+	testcases := map[string]struct {
+		content  string
+		expected string
+	}{
+		"pdf":  {content: "%PDF-1.7\n", expected: FileTypePDF},
+		"png":  {content: "\x89PNG\r\n\x1a\n\x00\x00", expected: FileTypePNG},
+		"jpeg": {content: "\xff\xd8\xff\xe0\x00\x10JFIF", expected: FileTypeJPEG},
+		"gif":  {content: "GIF89a\x01\x00", expected: FileTypeGIF},
+		"webp": {content: "RIFF\x24\x00\x00\x00WEBPVP8 ", expected: FileTypeWebP},
+		"heic": {content: "\x00\x00\x00\x18ftypheic\x00\x00", expected: FileTypeHEIC},
+		"zip":  {content: "PK\x03\x04\x14\x00", expected: FileTypeZip},
+		"exe":  {content: exeHeader, expected: FileTypeExe},
+		"exe beyond header": {
+			content:  "MZ\x90\x00" + strings.Repeat("\x00", 0x38) + "\x00\x04\x00\x00",
+			expected: FileTypeExe,
+		},
+		"dos stub":   {content: "MZ\x90\x00" + strings.Repeat("\x00", 0x3c), expected: FileTypeBinary},
+		"text as mz": {content: "MZ,Mazowieckie,PL\n" + strings.Repeat("Warsaw,Krakow,Lodz\n", 4), expected: FileTypeText},
+		"bmp":        {content: bmpHeader, expected: FileTypeBMP},
+		"text as bm": {content: "BMW,320d,2019\nBMW,118i,2021\n", expected: FileTypeText},
+		"elf":        {content: "\x7fELF\x02\x01", expected: FileTypeELF},
+		"text":       {content: "name,date\nSmith,2024-01-01\n", expected: FileTypeText},
+		"empty":      {content: "", expected: FileTypeText},
+		"split rune": {content: "caf\xc3", expected: FileTypeText},
+		"binary":     {content: "\x00\x01\x02\x03", expected: FileTypeBinary},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			fileType, err := DetectFileType(bytes.NewReader([]byte(tc.content)))
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, fileType)
+		})
+	}
+}
+
+func TestCheckFileType(t *testing.T) {
+	allowed := []string{FileTypePDF, FileTypeJPEG}
+
+	assert.True(t, checkFileType("forms/a.pdf", FileTypePDF, allowed))
+	assert.True(t, checkFileType("forms/a.PDF", FileTypePDF, allowed))
+	assert.True(t, checkFileType("forms/a.jpeg", FileTypeJPEG, allowed))
+	assert.True(t, checkFileType("forms/a", FileTypePDF, allowed))
+	assert.False(t, checkFileType("forms/a.pdf", FileTypeJPEG, allowed))
+	assert.False(t, checkFileType("forms/a.pdf", FileTypeExe, allowed))
+	assert.False(t, checkFileType("forms/a.png", FileTypePNG, allowed))
+	assert.False(t, checkFileType("forms/a.bin", FileTypeBinary, allowed))
+	assert.True(t, checkFileType("forms/a.bin", FileTypeBinary, []string{FileTypeBinary}))
+}
+
+func TestIsFileType(t *testing.T) {
+	assert.True(t, IsFileType(FileTypePDF))
+	assert.True(t, IsFileType(FileTypeBinary))
+	assert.False(t, IsFileType("docx"))
+}
+
+func TestScanAllowedTypes(t *testing.T) {
+	testcases := map[string]struct {
+		key      string
+		content  string
+		verdict  Verdict
+		status   string
+		fileType string
+	}{
+		"allowed": {
+			key:      "forms/a.pdf",
+			content:  "%PDF-1.7\n",
+			verdict:  Verdict{Clean: true},
+			status:   "ok",
+			fileType: FileTypePDF,
+		},
+		"renamed executable": {
+			key:      "forms/a.pdf",
+			content:  exeHeader,
+			verdict:  Verdict{Clean: true},
+			status:   "disallowed-type",
+			fileType: FileTypeExe,
+		},
+		"extension mismatch": {
+			key:      "forms/a.jpg",
+			content:  "%PDF-1.7\n",
+			verdict:  Verdict{Clean: true},
+			status:   "disallowed-type",
+			fileType: FileTypePDF,
+		},
+		"infected": {
+			key:      "forms/a.pdf",
+			content:  exeHeader,
+			verdict:  Verdict{Signature: "Win.Test.EICAR_HDB-1"},
+			status:   "infected",
+			fileType: FileTypeExe,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			downloader := new(mockDownloader)
+			downloader.On("GetObject", "my-bucket", tc.key).Return(&s3.GetObjectOutput{
+				Body: io.NopCloser(bytes.NewReader([]byte(tc.content))),
+			}, nil)
+
+			scanner := new(mockScanner)
+			scanner.On("ScanFile", mock.Anything).Return(tc.verdict, nil)
+
+			mockS3 := new(mockS3Tagger)
+			mockS3.On("GetObjectTagging", "my-bucket", tc.key).Return([]*types.Tag{}, nil)
+			mockS3.On("PutObjectTagging", "my-bucket", tc.key, []*types.Tag{
+				{Key: aws.String("virus-scan-status"), Value: aws.String(tc.status)},
+			}).Return(nil)
+
+			p := New(downloader, mockS3, scanner,
+				WithTempDir(t.TempDir()),
+				WithPolicyResolver(policyFunc(func(obj Object, base Policy) Policy {
+					base.AllowedTypes = []string{FileTypePDF, FileTypePNG}
+					return base
+				})),
+			)
+
+			result, err := p.Scan(context.Background(), Object{Bucket: "my-bucket", Key: tc.key})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.status, result.Status)
+			assert.Equal(t, tc.fileType, result.FileType)
+
+			mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package antivirus
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const DefaultHashListInterval = 5 * time.Minute
+
+// Reasons record what decided a verdict.
+const (
+	ReasonEngine    = "engine"
+	ReasonAllowList = "allow-list"
+	ReasonBlockList = "block-list"
+)
+
+// ReasonKey is the tag key, or field name, the reason for a verdict is written
+// to alongside key.
+func ReasonKey(key string) string {
+	return key + "-reason"
+}
+
+// A HashLookup decides the verdict for objects by their SHA-256, without
+// scanning them. reason is ReasonAllowList or ReasonBlockList, and note is
+// whatever the list gives as the reason for the entry.
+type HashLookup interface {
+	Lookup(digest string) (reason, note string, ok bool)
+}
+
+// WithHashLists looks up the SHA-256 of each object before it is scanned.
+// Listed objects are given the list's verdict and are not scanned, and the
+// reason for every verdict is written with it.
+func WithHashLists(lists HashLookup) Option {
+	return func(p *Pipeline) {
+		p.hashLists = lists
+	}
+}
+
+// HashLists are allow and block lists of SHA-256 digests read from a bucket.
+// A hash on both lists is blocked.
+//
+// Each list is a text object with one hex encoded digest per line, optionally
+// followed by a note such as an incident reference. Blank lines and lines
+// starting with # are ignored. A list that does not exist is empty, and one
+// that cannot be read or parsed keeps its previous entries.
+type HashLists struct {
+	Downloader Downloader
+	Bucket     string
+	AllowKey   string
+	BlockKey   string
+	// Interval is the least time between refreshes, when zero
+	// DefaultHashListInterval is used.
+	Interval time.Duration
+
+	mu          sync.RWMutex
+	allow       hashList
+	block       hashList
+	lastChecked time.Time
+	now         func() time.Time
+}
+
+type hashList struct {
+	etag    string
+	entries map[string]string
+}
+
+func (l *HashLists) Lookup(digest string) (reason, note string, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if note, ok := l.block.entries[digest]; ok {
+		return ReasonBlockList, note, true
+	}
+	if note, ok := l.allow.entries[digest]; ok {
+		return ReasonAllowList, note, true
+	}
+
+	return "", "", false
+}
+
+// Refresh reads both lists, skipping any that have not changed since the last
+// refresh.
+func (l *HashLists) Refresh(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.refresh_hash_lists", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", l.Bucket),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	l.mu.Lock()
+	l.lastChecked = l.clock()
+	allow, block := l.allow, l.block
+	l.mu.Unlock()
+
+	allow, allowErr := l.fetch(ctx, l.AllowKey, allow)
+	block, blockErr := l.fetch(ctx, l.BlockKey, block)
+
+	l.mu.Lock()
+	l.allow, l.block = allow, block
+	l.mu.Unlock()
+
+	span.SetAttributes(
+		attribute.Int("antivirus.allow_list_size", len(allow.entries)),
+		attribute.Int("antivirus.block_list_size", len(block.entries)),
+	)
+
+	return errors.Join(allowErr, blockErr)
+}
+
+// RefreshIfDue calls Refresh when Interval has passed since the last refresh.
+func (l *HashLists) RefreshIfDue(ctx context.Context) error {
+	l.mu.RLock()
+	due := l.lastChecked.IsZero() || l.clock().Sub(l.lastChecked) >= cmp.Or(l.Interval, DefaultHashListInterval)
+	l.mu.RUnlock()
+
+	if !due {
+		return nil
+	}
+
+	return l.Refresh(ctx)
+}
+
+// fetch reads the list at key, returning previous when it has not changed or
+// cannot be read.
+func (l *HashLists) fetch(ctx context.Context, key string, previous hashList) (hashList, error) {
+	if key == "" {
+		return hashList{}, nil
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(key),
+	}
+	if previous.etag != "" {
+		input.IfNoneMatch = aws.String(previous.etag)
+	}
+
+	output, err := l.Downloader.GetObject(ctx, input)
+	if err != nil {
+		var responseErr *awshttp.ResponseError
+		if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotModified {
+			return previous, nil
+		}
+
+		var nske *types.NoSuchKey
+		if errors.As(err, &nske) {
+			return hashList{}, nil
+		}
+
+		return previous, fmt.Errorf("failed to download hash list %s: %w", key, err)
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	entries, err := ParseHashList(output.Body)
+	if err != nil {
+		return previous, fmt.Errorf("failed to parse hash list %s: %w", key, err)
+	}
+
+	return hashList{etag: aws.ToString(output.ETag), entries: entries}, nil
+}
+
+func (l *HashLists) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+
+	return l.now()
+}
+
+// ParseHashList reads a list in the format described by HashLists, returning
+// the note for each digest. Digests are lower cased.
+func ParseHashList(r io.Reader) (map[string]string, error) {
+	entries := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		digest := strings.Fields(line)[0]
+		note := strings.TrimSpace(strings.TrimPrefix(line, digest))
+		digest = strings.ToLower(digest)
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("line %d: %q is not a sha256", n, digest)
+		}
+
+		entries[digest] = note
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,220 @@
+package antivirus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	fileContentSHA256 = "e0ac3601005dfa1864f5392aabaf7d898b1b5bab854f1acb4491bcd806b76b0c"
+	otherSHA256       = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+)
+
+func TestParseHashList(t *testing.T) {
+	entries, err := ParseHashList(strings.NewReader(`# confirmed false positives
+E0AC3601005DFA1864F5392AABAF7D898B1B5BAB854F1ACB4491BCD806B76B0C INC-1234 invoice template
+
+` + otherSHA256 + "\t\n"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		fileContentSHA256: "INC-1234 invoice template",
+		otherSHA256:       "",
+	}, entries)
+}
+
+func TestParseHashListWhenInvalid(t *testing.T) {
+	_, err := ParseHashList(strings.NewReader(otherSHA256 + "\nd41d8cd98f00b204e9800998ecf8427e md5\n"))
+	assert.Equal(t, `line 2: "d41d8cd98f00b204e9800998ecf8427e" is not a sha256`, err.Error())
+}
+
+func TestHashListsRefresh(t *testing.T) {
+	bucket := newFakeDefinitionsBucket()
+	bucket.objects["allow.txt"] = []byte(fileContentSHA256 + " INC-1234\n" + otherSHA256 + "\n")
+	bucket.objects["block.txt"] = []byte(otherSHA256 + " INC-5678\n")
+
+	lists := &HashLists{Downloader: bucket, Bucket: "a-bucket", AllowKey: "allow.txt", BlockKey: "block.txt"}
+
+	assert.Nil(t, lists.Refresh(context.Background()))
+
+	reason, note, ok := lists.Lookup(fileContentSHA256)
+	assert.True(t, ok)
+	assert.Equal(t, ReasonAllowList, reason)
+	assert.Equal(t, "INC-1234", note)
+
+	reason, note, ok = lists.Lookup(otherSHA256)
+	assert.True(t, ok)
+	assert.Equal(t, ReasonBlockList, reason)
+	assert.Equal(t, "INC-5678", note)
+
+	_, _, ok = lists.Lookup("0000000000000000000000000000000000000000000000000000000000000000")
+	assert.False(t, ok)
+
+	assert.Nil(t, lists.Refresh(context.Background()))
+	assert.Equal(t, 2, bucket.gets["allow.txt"])
+
+	_, _, ok = lists.Lookup(otherSHA256)
+	assert.True(t, ok, "unchanged lists are kept")
+
+	delete(bucket.objects, "block.txt")
+	assert.Nil(t, lists.Refresh(context.Background()))
+
+	reason, _, _ = lists.Lookup(otherSHA256)
+	assert.Equal(t, ReasonAllowList, reason)
+}
+
+func TestHashListsRefreshKeepsListWhenInvalid(t *testing.T) {
+	bucket := newFakeDefinitionsBucket()
+	bucket.objects["block.txt"] = []byte(otherSHA256 + "\n")
+
+	lists := &HashLists{Downloader: bucket, Bucket: "a-bucket", BlockKey: "block.txt"}
+	assert.Nil(t, lists.Refresh(context.Background()))
+
+	bucket.objects["block.txt"] = []byte("not a hash\n")
+	err := lists.Refresh(context.Background())
+	assert.Equal(t, `failed to parse hash list block.txt: line 1: "not" is not a sha256`, err.Error())
+
+	_, _, ok := lists.Lookup(otherSHA256)
+	assert.True(t, ok)
+
+	bucket.err = errors.New("what")
+	err = lists.Refresh(context.Background())
+	assert.Equal(t, "failed to download hash list block.txt: what", err.Error())
+
+	_, _, ok = lists.Lookup(otherSHA256)
+	assert.True(t, ok)
+}
+
+func TestHashListsRefreshIfDue(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	bucket := newFakeDefinitionsBucket()
+
+	lists := &HashLists{
+		Downloader: bucket,
+		Bucket:     "a-bucket",
+		BlockKey:   "block.txt",
+		Interval:   time.Minute,
+		now:        func() time.Time { return now },
+	}
+
+	assert.Nil(t, lists.RefreshIfDue(context.Background()))
+	assert.Equal(t, 1, bucket.gets["block.txt"])
+
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, lists.RefreshIfDue(context.Background()))
+	assert.Equal(t, 1, bucket.gets["block.txt"])
+
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, lists.RefreshIfDue(context.Background()))
+	assert.Equal(t, 2, bucket.gets["block.txt"])
+}
+
+type staticHashLookup map[string][2]string
+
+func (l staticHashLookup) Lookup(digest string) (reason, note string, ok bool) {
+	entry, ok := l[digest]
+	return entry[0], entry[1], ok
+}
+
+func TestScanWhenHashAllowed(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("virus-scan-status"), Value: aws.String("ok")},
+		{Key: aws.String("virus-scan-status-reason"), Value: aws.String("allow-list")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTempDir(t.TempDir()),
+		WithHashLists(staticHashLookup{fileContentSHA256: {ReasonAllowList, "INC-1234"}}),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", result.Status)
+	assert.Equal(t, Verdict{Clean: true, Reason: ReasonAllowList}, result.Verdict)
+	assert.Equal(t, time.Duration(0), result.Timings.Scan)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+	scanner.AssertNotCalled(t, "ScanFile", mock.Anything)
+}
+
+func TestScanWhenHashBlocked(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{
+		{Key: aws.String("virus-scan-status-reason"), Value: aws.String("engine")},
+	}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("virus-scan-status-reason"), Value: aws.String("block-list")},
+		{Key: aws.String("virus-scan-status"), Value: aws.String("infected")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTempDir(t.TempDir()),
+		WithHashLists(staticHashLookup{fileContentSHA256: {ReasonBlockList, "INC-5678"}}),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "infected", result.Status)
+	assert.Equal(t, Verdict{Signature: "INC-5678", Reason: ReasonBlockList}, result.Verdict)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+	scanner.AssertNotCalled(t, "ScanFile", mock.Anything)
+}
+
+func TestScanWhenHashNotListed(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{Clean: true}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("virus-scan-status"), Value: aws.String("ok")},
+		{Key: aws.String("virus-scan-status-reason"), Value: aws.String("engine")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTempDir(t.TempDir()),
+		WithHashLists(staticHashLookup{otherSHA256: {ReasonBlockList, ""}}),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{Clean: true, Reason: ReasonEngine}, result.Verdict)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
@@ -0,0 +1,212 @@
+package antivirus
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultICAPTimeout limits each request to an ICAP server when
+	// ICAPScanner.Timeout is zero.
+	DefaultICAPTimeout = 2 * time.Minute
+
+	defaultICAPPort = "1344"
+	icapChunkSize   = 64 << 10
+)
+
+// ICAPScanner scans files by sending them to a remote antivirus server as an
+// ICAP RESPMOD request. The server answering 204 No Content means the file is
+// clean. Servers also answer 200 OK with the file unchanged when it is clean,
+// so 200 OK is only clean when it returns the 200 OK response that was sent.
+// It is infected when it names a threat in the X-Infection-Found or
+// X-Virus-ID header, or replaces the response, such as with a block page or
+// no response at all.
+type ICAPScanner struct {
+	// URL is the ICAP service, such as icap://icap.internal:1344/avscan.
+	URL string
+	// Timeout limits each request, when zero DefaultICAPTimeout is used.
+	Timeout time.Duration
+}
+
+// StartDaemon checks the URL, there is nothing to start for a remote server.
+func (s *ICAPScanner) StartDaemon() error {
+	_, err := s.address()
+	return err
+}
+
+func (s *ICAPScanner) address() (string, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Scheme != "icap" || u.Hostname() == "" {
+		return "", fmt.Errorf("ICAP URL must be of the form icap://host:port/service, got %q", s.URL)
+	}
+
+	return net.JoinHostPort(u.Hostname(), cmp.Or(u.Port(), defaultICAPPort)), nil
+}
+
+func (s *ICAPScanner) ScanFile(ctx context.Context, path string) (Verdict, error) {
+	address, err := s.address()
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	f, err := os.Open(path) //nolint:gosec // path is generated by the pipeline
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck // no need to check error when closing file
+
+	info, err := f.Stat()
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(s.Timeout, DefaultICAPTimeout))
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("%w: %w", ErrEngineUnavailable, err)
+	}
+	defer conn.Close() //nolint:errcheck // no need to check error when closing connection
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if err := s.writeRequest(conn, f, info.Size()); err != nil {
+		return Verdict{}, fmt.Errorf("failed to send file to ICAP server: %w", err)
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	status, err := reader.ReadLine()
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to read ICAP response: %w", err)
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Verdict{}, fmt.Errorf("failed to read ICAP response: %w", err)
+	}
+
+	switch code := icapStatusCode(status); code {
+	case 204:
+		return Verdict{Clean: true}, nil
+	case 200:
+		if threat := icapThreat(header); threat != "" {
+			return Verdict{Signature: threat}, nil
+		}
+
+		modified, err := icapResponseModified(reader, header, info.Size())
+		if err != nil {
+			return Verdict{}, fmt.Errorf("failed to read ICAP response: %w", err)
+		}
+
+		return Verdict{Clean: !modified}, nil
+	default:
+		return Verdict{}, fmt.Errorf("unexpected ICAP response: %q", status)
+	}
+}
+
+// writeRequest sends the file as the body of an HTTP response, in chunks, as
+// RESPMOD expects.
+func (s *ICAPScanner) writeRequest(w io.Writer, f io.Reader, size int64) error {
+	u, _ := url.Parse(s.URL)
+
+	httpHeader := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.FormatInt(size, 10) + "\r\n\r\n"
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "RESPMOD %s ICAP/1.0\r\n", s.URL)
+	fmt.Fprintf(bw, "Host: %s\r\n", u.Host)
+	fmt.Fprintf(bw, "Allow: 204\r\n")
+	fmt.Fprintf(bw, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(httpHeader))
+	bw.WriteString(httpHeader) //nolint:errcheck // checked by Flush
+
+	buf := make([]byte, icapChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])      //nolint:errcheck // checked by Flush
+			bw.WriteString("\r\n") //nolint:errcheck // checked by Flush
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	bw.WriteString("0\r\n\r\n") //nolint:errcheck // checked by Flush
+	return bw.Flush()
+}
+
+// icapStatusCode reads the code from a status line such as
+// "ICAP/1.0 204 No Content", returning 0 when it is not one.
+func icapStatusCode(status string) int {
+	proto, rest, _ := strings.Cut(status, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return 0
+	}
+
+	code, _, _ := strings.Cut(rest, " ")
+	n, _ := strconv.Atoi(code)
+	return n
+}
+
+// icapResponseModified reports whether the HTTP response encapsulated in a 200
+// OK answer differs from the 200 OK that was sent. As the request allows 204,
+// an answer without a response header, such as one with only a null-body, has
+// replaced the file, as has one whose status or Content-Length changed.
+func icapResponseModified(reader *textproto.Reader, header textproto.MIMEHeader, size int64) (bool, error) {
+	if !strings.Contains(header.Get("Encapsulated"), "res-hdr=") {
+		return true, nil
+	}
+
+	status, err := reader.ReadLine()
+	if err != nil {
+		return false, err
+	}
+
+	proto, rest, _ := strings.Cut(status, " ")
+	if !strings.HasPrefix(proto, "HTTP/") {
+		return false, fmt.Errorf("unexpected encapsulated response: %q", status)
+	}
+
+	code, _, _ := strings.Cut(rest, " ")
+	if code != "200" {
+		return true, nil
+	}
+
+	httpHeader, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return false, err
+	}
+
+	length := httpHeader.Get("Content-Length")
+	return length != "" && length != strconv.FormatInt(size, 10), nil
+}
+
+// icapThreat reads the threat name from the headers servers use to report
+// one, such as "X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test;".
+func icapThreat(header textproto.MIMEHeader) string {
+	for field := range strings.SplitSeq(header.Get("X-Infection-Found"), ";") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok && name == "Threat" {
+			return value
+		}
+	}
+
+	return header.Get("X-Virus-ID")
+}
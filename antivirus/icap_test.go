@@ -0,0 +1,123 @@
+package antivirus
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestICAPStatusCode(t *testing.T) {
+	assert.Equal(t, 204, icapStatusCode("ICAP/1.0 204 No Content"))
+	assert.Equal(t, 200, icapStatusCode("ICAP/1.0 200 OK"))
+	assert.Equal(t, 0, icapStatusCode("HTTP/1.1 200 OK"))
+}
+
+func TestICAPThreat(t *testing.T) {
+	assert.Equal(t, "Eicar-Test", icapThreat(textproto.MIMEHeader{"X-Infection-Found": {"Type=0; Resolution=2; Threat=Eicar-Test;"}}))
+	assert.Equal(t, "Eicar", icapThreat(textproto.MIMEHeader{"X-Virus-Id": {"Eicar"}}))
+}
+
+// fakeICAP answers each request with reply, sending the body it received on
+// bodies.
+func fakeICAP(t *testing.T, reply string) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	bodies := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			reader := textproto.NewReader(bufio.NewReader(conn))
+			_, _ = reader.ReadLine()
+			_, _ = reader.ReadMIMEHeader()
+			_, _ = reader.ReadLine()
+			_, _ = reader.ReadMIMEHeader()
+
+			var body strings.Builder
+			_, _ = io.Copy(&body, httputil.NewChunkedReader(reader.R))
+			bodies <- body.String()
+
+			_, _ = conn.Write([]byte(reply))
+			_ = conn.Close()
+		}
+	}()
+
+	return "icap://" + listener.Addr().String() + "/avscan", bodies
+}
+
+func TestICAPScanner(t *testing.T) {
+	file := tempFile(t, []byte("file content"))
+
+	url, bodies := fakeICAP(t, "ICAP/1.0 204 No Content\r\nISTag: \"1\"\r\n\r\n")
+	scanner := &ICAPScanner{URL: url}
+	assert.Nil(t, scanner.StartDaemon())
+
+	verdict, err := scanner.ScanFile(context.Background(), file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{Clean: true}, verdict)
+	assert.Equal(t, "file content", <-bodies)
+
+	url, _ = fakeICAP(t, "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test;\r\nEncapsulated: null-body=0\r\n\r\n")
+	scanner = &ICAPScanner{URL: url}
+
+	verdict, err = scanner.ScanFile(context.Background(), file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{Signature: "Eicar-Test"}, verdict)
+
+	url, _ = fakeICAP(t, "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=38\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nc\r\nfile content\r\n0\r\n\r\n")
+	scanner = &ICAPScanner{URL: url}
+
+	verdict, err = scanner.ScanFile(context.Background(), file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{Clean: true}, verdict)
+
+	url, _ = fakeICAP(t, "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=45\r\n\r\nHTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\n\r\n7\r\nblocked\r\n0\r\n\r\n")
+	scanner = &ICAPScanner{URL: url}
+
+	verdict, err = scanner.ScanFile(context.Background(), file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{}, verdict)
+
+	url, _ = fakeICAP(t, "ICAP/1.0 200 OK\r\nEncapsulated: null-body=0\r\n\r\n")
+	scanner = &ICAPScanner{URL: url}
+
+	verdict, err = scanner.ScanFile(context.Background(), file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{}, verdict)
+
+	url, _ = fakeICAP(t, "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=37\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\n7\r\nblocked\r\n0\r\n\r\n")
+	scanner = &ICAPScanner{URL: url}
+
+	verdict, err = scanner.ScanFile(context.Background(), file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{}, verdict)
+
+	url, _ = fakeICAP(t, "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=10\r\n\r\nnot http\r\n\r\n")
+	scanner = &ICAPScanner{URL: url}
+
+	_, err = scanner.ScanFile(context.Background(), file.Name())
+	assert.Equal(t, `failed to read ICAP response: unexpected encapsulated response: "not http"`, err.Error())
+
+	url, _ = fakeICAP(t, "ICAP/1.0 500 Server Error\r\n\r\n")
+	scanner = &ICAPScanner{URL: url}
+
+	_, err = scanner.ScanFile(context.Background(), file.Name())
+	assert.Equal(t, `unexpected ICAP response: "ICAP/1.0 500 Server Error"`, err.Error())
+
+	scanner = &ICAPScanner{URL: "http://icap.internal/avscan"}
+	assert.Equal(t, `ICAP URL must be of the form icap://host:port/service, got "http://icap.internal/avscan"`, scanner.StartDaemon().Error())
+}
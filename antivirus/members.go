@@ -0,0 +1,142 @@
+package antivirus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// InfectedMember is a file inside an archive that the scanner flagged.
+type InfectedMember struct {
+	// Path is the member's name within the archive, with the names of any
+	// archives it is nested in before it, separated by "/".
+	Path      string `json:"path"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// WithScanMembers sets whether the default policy scans the members of
+// infected archives.
+func WithScanMembers(enabled bool) Option {
+	return func(p *Pipeline) {
+		p.scanMembers = enabled
+	}
+}
+
+// ScanArchiveMembers extracts each file in the zip, tar or gzip archive in f
+// to tempDir and scans it with scanner, returning those that are infected.
+// Nested archives are extracted in turn. name is the name of the archive,
+// which is used for the contents of a gzip file that does not record its own.
+//
+// Extraction stops at the first limit exceeded, returning the members found
+// so far with the ArchiveViolation as the error.
+func ScanArchiveMembers(ctx context.Context, f *os.File, name string, limits ArchiveLimits, tempDir string, scanner Scanner) ([]InfectedMember, error) {
+	inspector, err := walkArchive(ctx, f, name, limits, tempDir, "", scanner)
+
+	return inspector.infected, err
+}
+
+// walkArchive checks the archive in f against limits, decrypting encrypted
+// zip members with password when it is set. When scanner is set each member
+// that is not an archive is scanned, and those that are infected are recorded
+// in the returned inspector.
+func walkArchive(ctx context.Context, f *os.File, name string, limits ArchiveLimits, tempDir, password string, scanner Scanner) (*archiveInspector, error) {
+	inspector := &archiveInspector{
+		limits:   limits,
+		tempDir:  tempDir,
+		name:     name,
+		password: password,
+	}
+
+	if scanner != nil {
+		inspector.visit = func(path string, r io.Reader) error {
+			verdict, err := scanMember(ctx, r, limits, tempDir, scanner)
+			if err != nil {
+				return fmt.Errorf("failed to scan archive member %s: %w", path, err)
+			}
+
+			if !verdict.Clean {
+				inspector.infected = append(inspector.infected, InfectedMember{Path: path, Signature: verdict.Signature})
+			}
+
+			return nil
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return inspector, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	return inspector, inspector.inspect(f, info.Size(), 1, "")
+}
+
+func scanMember(ctx context.Context, r io.Reader, limits ArchiveLimits, tempDir string, scanner Scanner) (Verdict, error) {
+	f, err := os.CreateTemp(tempDir, "member")
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck,gosec // file created above
+	defer f.Close()           //nolint:errcheck // no need to check error when closing file
+
+	if limits.MaxSize > 0 {
+		r = io.LimitReader(r, limits.MaxSize+1)
+	}
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return Verdict{}, readError(err)
+	}
+	if limits.MaxSize > 0 && n > limits.MaxSize {
+		return Verdict{}, &ArchiveViolation{Limit: ArchiveLimitSize, Value: n, Max: limits.MaxSize}
+	}
+
+	return scanner.ScanFile(ctx, f.Name())
+}
+
+// scanArchiveMembers finds the infected members of an archive that failed its
+// scan.
+func (p *Pipeline) scanArchiveMembers(ctx context.Context, obj Object, f *os.File) (infected []InfectedMember, err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.scan_archive_members", objectAttributes(obj))
+	defer func() {
+		span.SetAttributes(attribute.Int("antivirus.infected_members", len(infected)))
+		tracing.End(span, err)
+	}()
+
+	infected, err = ScanArchiveMembers(ctx, f, path.Base(obj.Key), p.memberLimits(), p.tempDir, p.scanner)
+
+	var violation *ArchiveViolation
+	if errors.As(err, &violation) {
+		slog.WarnContext(ctx, "stopped scanning archive members", slog.Any("error", violation))
+		return infected, nil
+	}
+
+	return infected, err
+}
+
+// memberLimits are the limits archives are extracted within, which are the
+// pipeline's ArchiveLimits or DefaultArchiveLimits when it has none.
+func (p *Pipeline) memberLimits() ArchiveLimits {
+	if p.archiveLimits == (ArchiveLimits{}) {
+		return DefaultArchiveLimits
+	}
+
+	return p.archiveLimits
+}
+
+// ignoreArchiveErrors drops an ArchiveViolation, for callers that have
+// already checked the archive against its limits.
+func ignoreArchiveErrors(err error) error {
+	var violation *ArchiveViolation
+	if errors.As(err, &violation) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,131 @@
+package antivirus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// contentScanner flags files containing "EICAR".
+type contentScanner struct{}
+
+func (contentScanner) StartDaemon() error { return nil }
+
+func (contentScanner) ScanFile(ctx context.Context, path string) (Verdict, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // path is from the test
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	if bytes.Contains(data, []byte("EICAR")) {
+		return Verdict{Signature: "Eicar-Signature"}, nil
+	}
+
+	return Verdict{Clean: true}, nil
+}
+
+func TestScanArchiveMembers(t *testing.T) {
+	clean := []byte("evidence document")
+	infected := []byte("EICAR test file")
+
+	testcases := map[string]struct {
+		name     string
+		content  []byte
+		expected []InfectedMember
+	}{
+		"not an archive": {
+			name:    "a.pdf",
+			content: infected,
+		},
+		"zip": {
+			name: "evidence.zip",
+			content: zipBytes(t,
+				archiveMember{"case/a.pdf", clean},
+				archiveMember{"case/b.pdf", infected},
+				archiveMember{"case/c.pdf", infected},
+			),
+			expected: []InfectedMember{
+				{Path: "case/b.pdf", Signature: "Eicar-Signature"},
+				{Path: "case/c.pdf", Signature: "Eicar-Signature"},
+			},
+		},
+		"nested": {
+			name: "evidence.zip",
+			content: zipBytes(t,
+				archiveMember{"a.pdf", clean},
+				archiveMember{"inner.tar", tarBytes(t, archiveMember{"b.pdf", infected})},
+			),
+			expected: []InfectedMember{{Path: "inner.tar/b.pdf", Signature: "Eicar-Signature"}},
+		},
+		"tgz": {
+			name:     "evidence.tar.gz",
+			content:  gzipBytes(t, tarBytes(t, archiveMember{"a.pdf", clean}, archiveMember{"b.pdf", infected})),
+			expected: []InfectedMember{{Path: "b.pdf", Signature: "Eicar-Signature"}},
+		},
+		"gzip": {
+			name:     "report.csv.gz",
+			content:  gzipBytes(t, infected),
+			expected: []InfectedMember{{Path: "report.csv", Signature: "Eicar-Signature"}},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			members, err := ScanArchiveMembers(context.Background(), tempFile(t, tc.content), tc.name, DefaultArchiveLimits, t.TempDir(), contentScanner{})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, members)
+		})
+	}
+}
+
+func TestScanArchiveMembersWhenLimitExceeded(t *testing.T) {
+	content := zipBytes(t,
+		archiveMember{"a.pdf", []byte("EICAR")},
+		archiveMember{"b.pdf", []byte("EICAR")},
+	)
+
+	members, err := ScanArchiveMembers(context.Background(), tempFile(t, content), "evidence.zip", ArchiveLimits{MaxEntries: 1}, t.TempDir(), contentScanner{})
+
+	assert.Equal(t, []InfectedMember{{Path: "a.pdf", Signature: "Eicar-Signature"}}, members)
+	assert.Equal(t, &ArchiveViolation{Limit: ArchiveLimitEntries, Value: 2, Max: 1}, err)
+}
+
+func TestScanWithScanMembers(t *testing.T) {
+	content := zipBytes(t,
+		archiveMember{"a.pdf", []byte("evidence document")},
+		archiveMember{"b.pdf", []byte("EICAR test file")},
+	)
+
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "evidence.zip").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(content)),
+	}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "evidence.zip").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "evidence.zip", []*types.Tag{
+		{Key: aws.String("virus-scan-status"), Value: aws.String("infected")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, contentScanner{},
+		WithTempDir(t.TempDir()),
+		WithScanMembers(true),
+	)
+
+	result, err := p.Scan(context.Background(), Object{Bucket: "my-bucket", Key: "evidence.zip"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "infected", result.Status)
+	assert.Equal(t, []InfectedMember{{Path: "b.pdf", Signature: "Eicar-Signature"}}, result.InfectedMembers)
+
+	mock.AssertExpectationsForObjects(t, downloader, mockS3)
+}
@@ -0,0 +1,579 @@
+package antivirus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ministryofjustice/opg-s3-antivirus/logging"
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	DefaultTagKey        = "virus-scan-status"
+	DefaultPassValue     = "ok"
+	DefaultFailValue     = "infected"
+	DefaultOversizeValue = "too-large"
+	DefaultTempDir       = "/tmp"
+
+	DefaultStaleDefinitionsValue = "stale-definitions"
+)
+
+type Option func(*Pipeline)
+
+// WithTagKey sets the tag key the verdict is written to.
+func WithTagKey(key string) Option {
+	return func(p *Pipeline) {
+		p.tagKey = key
+	}
+}
+
+// WithTagValues sets the tag values written for clean and infected objects.
+func WithTagValues(values TagValues) Option {
+	return func(p *Pipeline) {
+		p.tagValues = values
+	}
+}
+
+// WithMaxSize sets the default largest object, in bytes, that will be
+// scanned.
+func WithMaxSize(size int64) Option {
+	return func(p *Pipeline) {
+		p.maxSize = size
+	}
+}
+
+// WithRecorder adds an audit record of each result. It can be given more than
+// once, in which case recorders are called in order. The result has already
+// been written to the object, so a recorder that fails is logged and counted in
+// the result's RecordFailures, which later recorders and the caller see, and
+// the scan carries on.
+func WithRecorder(recorder Recorder) Option {
+	return func(p *Pipeline) {
+		p.recorders = append(p.recorders, pipelineRecorder{Recorder: recorder})
+	}
+}
+
+// WithRequiredRecorder adds a recorder like WithRecorder, but when it fails
+// the scan fails too, so that the event is retried and the result recorded.
+func WithRequiredRecorder(recorder Recorder) Option {
+	return func(p *Pipeline) {
+		p.recorders = append(p.recorders, pipelineRecorder{Recorder: recorder, required: true})
+	}
+}
+
+type pipelineRecorder struct {
+	Recorder
+	required bool
+}
+
+// WithDefinitionsVersion sets a function describing the signature databases
+// in use, which is called for each scan so that it can follow reloads.
+func WithDefinitionsVersion(version func() string) Option {
+	return func(p *Pipeline) {
+		p.definitionsVersion = version
+	}
+}
+
+// WithDefinitionsCheck runs check before each object is downloaded. When it
+// returns an error the pipeline follows policy: DefinitionsFailClosed returns
+// the error without writing a result, DefinitionsTagStale writes the
+// StaleDefinitions status and DefinitionsFailOpen scans anyway.
+func WithDefinitionsCheck(check func() error, policy DefinitionsPolicy) Option {
+	return func(p *Pipeline) {
+		p.definitionsCheck = check
+		p.definitionsPolicy = policy
+	}
+}
+
+// WithTempDir sets the directory objects are downloaded to before scanning.
+func WithTempDir(dir string) Option {
+	return func(p *Pipeline) {
+		p.tempDir = dir
+	}
+}
+
+// Pipeline downloads an object, scans it and tags it with the verdict.
+type Pipeline struct {
+	tagKey       string
+	tagValues    TagValues
+	maxSize      int64
+	tempDir      string
+	scanner      Scanner
+	tagger       Tagger
+	downloader   Downloader
+	mover        Mover
+	resolver     PolicyResolver
+	writers      map[string]ResultWriter
+	resultWriter string
+	recorders    []pipelineRecorder
+	hashLists    HashLookup
+
+	archiveLimits ArchiveLimits
+	scanMembers   bool
+
+	passwords           PasswordResolver
+	passwordMetadataKey string
+
+	checkActiveContent bool
+
+	definitionsVersion func() string
+	definitionsCheck   func() error
+	definitionsPolicy  DefinitionsPolicy
+}
+
+// New creates a Pipeline. Without options objects are tagged using the
+// virus-scan-status key with the values ok and infected.
+func New(downloader Downloader, tagger Tagger, scanner Scanner, opts ...Option) *Pipeline {
+	p := &Pipeline{
+		tagKey: DefaultTagKey,
+		tagValues: TagValues{
+			Pass: DefaultPassValue,
+			Fail: DefaultFailValue,
+		},
+		tempDir:    DefaultTempDir,
+		scanner:    scanner,
+		tagger:     tagger,
+		downloader: downloader,
+		writers: map[string]ResultWriter{
+			ResultWriterTags: &TagWriter{Tagger: tagger},
+		},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+// Policy returns the policy that will be applied to obj.
+func (p *Pipeline) Policy(obj Object) Policy {
+	policy := Policy{
+		TagKey:       p.tagKey,
+		TagValues:    p.tagValues,
+		MaxSize:      p.maxSize,
+		ResultWriter: p.resultWriter,
+		ScanMembers:  p.scanMembers,
+
+		CheckActiveContent: p.checkActiveContent,
+	}
+
+	if p.resolver != nil {
+		policy = p.resolver.Resolve(obj, policy)
+	}
+
+	policy.TagValues = policy.TagValues.WithDefaults()
+	if policy.ResultWriter == "" {
+		policy.ResultWriter = ResultWriterTags
+	}
+
+	return policy
+}
+
+var errTooLarge = errors.New("object is larger than the maximum size")
+
+// downloadFile writes the object to f, returning its SHA-256, size and user
+// metadata. The ETag of what was downloaded is set on obj, so that the result
+// can be written against the content that was scanned.
+func (p *Pipeline) downloadFile(ctx context.Context, f *os.File, obj *Object, maxSize int64) (digest string, size int64, metadata map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.download", objectAttributes(*obj))
+	defer func() {
+		if errors.Is(err, errTooLarge) {
+			span.SetAttributes(attribute.Bool("antivirus.too_large", true))
+			span.End()
+			return
+		}
+		tracing.End(span, err)
+	}()
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	}
+	if obj.VersionID != "" {
+		input.VersionId = aws.String(obj.VersionID)
+	}
+
+	output, err := p.downloader.GetObject(ctx, input)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	if output.ETag != nil {
+		obj.ETag = *output.ETag
+	}
+
+	if maxSize > 0 && aws.ToInt64(output.ContentLength) > maxSize {
+		return "", 0, nil, errTooLarge
+	}
+
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(f, hash), output.Body)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("failed to download file: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int64("antivirus.bytes_scanned", size))
+
+	return hex.EncodeToString(hash.Sum(nil)), size, output.Metadata, nil
+}
+
+// Tag sets the default tag key of the object to status, keeping any other tags
+// that are already on it.
+func (p *Pipeline) Tag(ctx context.Context, obj Object, status string) error {
+	return p.writers[ResultWriterTags].WriteResult(ctx, p.tagKey, Result{Object: obj, Status: status})
+}
+
+func (p *Pipeline) writeResult(ctx context.Context, policy Policy, result Result) (err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.write_result", objectAttributes(result.Object))
+	span.SetAttributes(
+		attribute.String("antivirus.result_writer", policy.ResultWriter),
+		attribute.String("antivirus.verdict", result.Status),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	writer, ok := p.writers[policy.ResultWriter]
+	if !ok {
+		return fmt.Errorf("no result writer named %q", policy.ResultWriter)
+	}
+
+	return writer.WriteResult(ctx, policy.TagKey, result)
+}
+
+func (p *Pipeline) scanFile(ctx context.Context, obj Object, path string) (verdict Verdict, err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.scan_file", objectAttributes(obj))
+	defer func() { tracing.End(span, err) }()
+
+	verdict, err = p.scanner.ScanFile(ctx, path)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	span.SetAttributes(
+		attribute.Bool("antivirus.clean", verdict.Clean),
+		attribute.String("antivirus.signature", verdict.Signature),
+	)
+
+	return verdict, nil
+}
+
+// Scan downloads the object to a temporary file, scans it and tags the object
+// with the verdict, following the policy for the object. The temporary file is
+// always removed. Everything logged about the scan carries the object's bucket,
+// key and version.
+func (p *Pipeline) Scan(ctx context.Context, obj Object) (result Result, err error) {
+	start := time.Now()
+
+	ctx, span := tracer.Start(ctx, "antivirus.Scan", objectAttributes(obj))
+	defer func() {
+		span.SetAttributes(
+			attribute.String("antivirus.verdict", result.Status),
+			attribute.Bool("antivirus.skipped", result.Skipped),
+		)
+		tracing.End(span, err)
+	}()
+
+	ctx = logging.With(ctx,
+		slog.String("bucket", obj.Bucket),
+		slog.String("key", obj.Key),
+		slog.String("versionId", obj.VersionID),
+	)
+
+	result, err = p.scan(ctx, obj)
+	if err != nil {
+		slog.ErrorContext(ctx, "scan failed", slog.Any("error", err))
+		return result, err
+	}
+	if result.Skipped {
+		return result, nil
+	}
+
+	result.Duration = time.Since(start)
+
+	slog.InfoContext(ctx, "scan finished",
+		slog.String("verdict", result.Status),
+		slog.String("signature", result.Verdict.Signature),
+		slog.String("reason", result.Verdict.Reason),
+		slog.String("fileType", result.FileType),
+		slog.String("sha256", result.SHA256),
+		slog.String("definitionsVersion", result.DefinitionsVersion),
+		slog.Int64("durationMs", result.Duration.Milliseconds()),
+	)
+
+	for _, recorder := range p.recorders {
+		if err := recorder.Record(ctx, result); err != nil {
+			if recorder.required {
+				return Result{}, err
+			}
+
+			slog.ErrorContext(ctx, "recording result failed", slog.Any("error", err))
+			result.RecordFailures++
+		}
+	}
+
+	return result, nil
+}
+
+func (p *Pipeline) scan(ctx context.Context, obj Object) (Result, error) {
+	policy := p.Policy(obj)
+	if policy.Skip {
+		slog.InfoContext(ctx, "skipping object by rule")
+		return Result{Object: obj, Skipped: true}, nil
+	}
+
+	if filter, ok := p.writers[policy.ResultWriter].(ResultFilter); ok {
+		written, err := filter.WrittenByWriter(ctx, policy.TagKey, obj)
+		if err != nil {
+			return Result{}, err
+		}
+
+		if written {
+			slog.InfoContext(ctx, "skipping object written by result writer", slog.String("resultWriter", policy.ResultWriter))
+			return Result{Object: obj, Skipped: true}, nil
+		}
+	}
+
+	if policy.MaxSize > 0 && obj.Size > policy.MaxSize {
+		return p.tagOversize(ctx, obj, policy)
+	}
+
+	if p.definitionsCheck != nil {
+		if err := p.definitionsCheck(); err != nil {
+			switch p.definitionsPolicy {
+			case DefinitionsFailOpen:
+				slog.WarnContext(ctx, "scanning with unfit definitions", slog.Any("error", err))
+			case DefinitionsTagStale:
+				slog.WarnContext(ctx, "not scanning with unfit definitions", slog.Any("error", err), slog.String("verdict", policy.TagValues.StaleDefinitions))
+				return p.writeStatus(ctx, obj, policy, policy.TagValues.StaleDefinitions)
+			default:
+				return Result{}, err
+			}
+		}
+	}
+
+	slog.DebugContext(ctx, "downloading object")
+	downloadStart := time.Now()
+
+	f, err := os.CreateTemp(p.tempDir, "file")
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	defer func() {
+		err := os.Remove(f.Name()) //nolint:gosec // file created above
+		if err != nil {
+			slog.WarnContext(ctx, "error whilst removing file", slog.Any("error", err))
+		}
+	}()
+
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			slog.WarnContext(ctx, "error whilst closing file", slog.Any("error", err))
+		}
+	}()
+
+	digest, size, metadata, err := p.downloadFile(ctx, f, &obj, policy.MaxSize)
+	if err != nil {
+		if errors.Is(err, errTooLarge) {
+			return p.tagOversize(ctx, obj, policy)
+		}
+		return Result{}, err
+	}
+
+	timings := Timings{Download: time.Since(downloadStart)}
+	slog.DebugContext(ctx, "object downloaded", slog.Int64("downloadMs", timings.Download.Milliseconds()))
+
+	var fileType string
+	if len(policy.AllowedTypes) > 0 {
+		fileType, err = DetectFileType(f)
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to detect file type: %w", err)
+		}
+	}
+
+	verdict, listed := p.lookupHash(ctx, digest)
+
+	var inspection archiveInspection
+	if !listed {
+		inspection, err = p.inspectArchive(ctx, obj, f)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	violation := inspection.violation
+
+	if violation != nil {
+		slog.InfoContext(ctx, "archive limit exceeded",
+			slog.String("limit", violation.Limit),
+			slog.Int64("value", violation.Value),
+			slog.Int64("max", violation.Max),
+		)
+		verdict = Verdict{Reason: violation.Limit}
+	} else if !listed {
+		scanStart := time.Now()
+
+		verdict, err = p.scanFile(ctx, obj, f.Name())
+		if err != nil {
+			return Result{}, err
+		}
+
+		timings.Scan = time.Since(scanStart)
+		slog.DebugContext(ctx, "file scanned", slog.Int64("scanMs", timings.Scan.Milliseconds()))
+
+		if p.hashLists != nil {
+			verdict.Reason = ReasonEngine
+		}
+	}
+
+	var infected []InfectedMember
+	var unscanned bool
+	if verdict.Clean && inspection.encrypted && violation == nil {
+		infected, unscanned, err = p.scanEncrypted(ctx, obj, f, metadata)
+		if err != nil {
+			return Result{}, err
+		}
+
+		if len(infected) > 0 {
+			verdict = Verdict{Signature: infected[0].Signature, Reason: verdict.Reason}
+		}
+	}
+
+	if !verdict.Clean && !listed && violation == nil && infected == nil && policy.ScanMembers {
+		infected, err = p.scanArchiveMembers(ctx, obj, f)
+		if err != nil {
+			slog.WarnContext(ctx, "error whilst scanning archive members", slog.Any("error", err))
+		}
+
+		for _, member := range infected {
+			slog.InfoContext(ctx, "archive member infected", slog.String("member", member.Path), slog.String("signature", member.Signature))
+		}
+	}
+
+	var activeContent []string
+	status := policy.TagValues.Fail
+	if violation != nil {
+		status = policy.TagValues.SuspiciousArchive
+	} else if unscanned {
+		status = policy.TagValues.Encrypted
+	} else if verdict.Clean {
+		status = policy.TagValues.Pass
+
+		if fileType != "" && !checkFileType(obj.Key, fileType, policy.AllowedTypes) {
+			slog.InfoContext(ctx, "file type not allowed", slog.String("fileType", fileType), slog.Any("allowedTypes", policy.AllowedTypes))
+			status = policy.TagValues.DisallowedType
+		} else if policy.CheckActiveContent && !listed {
+			activeContent, err = p.detectActiveContent(ctx, obj, f)
+			if err != nil {
+				return Result{}, err
+			}
+
+			if len(activeContent) > 0 {
+				slog.InfoContext(ctx, "active content found", slog.Any("activeContent", activeContent))
+				status = policy.TagValues.ActiveContent
+				verdict.Reason = strings.Join(activeContent, " ")
+			}
+		}
+	}
+
+	result := Result{
+		Object:             obj,
+		Verdict:            verdict,
+		Status:             status,
+		FileType:           fileType,
+		ArchiveViolation:   violation,
+		InfectedMembers:    infected,
+		ActiveContent:      activeContent,
+		SHA256:             digest,
+		DefinitionsVersion: p.currentDefinitionsVersion(),
+		BytesScanned:       size,
+	}
+
+	writeStart := time.Now()
+	if err := p.writeResult(ctx, policy, result); err != nil {
+		return Result{}, err
+	}
+
+	timings.Write = time.Since(writeStart)
+	result.Timings = timings
+	slog.DebugContext(ctx, "result written",
+		slog.String("resultWriter", policy.ResultWriter),
+		slog.Int64("writeMs", timings.Write.Milliseconds()),
+	)
+
+	if !verdict.Clean && violation == nil && policy.Quarantine != nil {
+		moved, err := p.quarantine(ctx, obj, *policy.Quarantine)
+		if err != nil {
+			return Result{}, err
+		}
+
+		slog.InfoContext(ctx, "object quarantined",
+			slog.String("quarantineBucket", moved.Bucket),
+			slog.String("quarantineKey", moved.Key),
+		)
+		result.Quarantined = &moved
+	}
+
+	return result, nil
+}
+
+// lookupHash gives the verdict for a digest on the hash lists.
+func (p *Pipeline) lookupHash(ctx context.Context, digest string) (Verdict, bool) {
+	if p.hashLists == nil {
+		return Verdict{}, false
+	}
+
+	reason, note, ok := p.hashLists.Lookup(digest)
+	if !ok {
+		return Verdict{}, false
+	}
+
+	slog.InfoContext(ctx, "hash listed", slog.String("reason", reason), slog.String("note", note))
+
+	if reason == ReasonBlockList {
+		return Verdict{Clean: false, Signature: note, Reason: reason}, true
+	}
+
+	return Verdict{Clean: true, Reason: reason}, true
+}
+
+func (p *Pipeline) currentDefinitionsVersion() string {
+	if p.definitionsVersion == nil {
+		return ""
+	}
+
+	return p.definitionsVersion()
+}
+
+func (p *Pipeline) tagOversize(ctx context.Context, obj Object, policy Policy) (Result, error) {
+	slog.InfoContext(ctx, "object larger than maximum size",
+		slog.Int64("size", obj.Size),
+		slog.Int64("maxSize", policy.MaxSize),
+		slog.String("verdict", policy.TagValues.Oversize),
+	)
+
+	return p.writeStatus(ctx, obj, policy, policy.TagValues.Oversize)
+}
+
+// writeStatus writes a status for an object that was not scanned.
+func (p *Pipeline) writeStatus(ctx context.Context, obj Object, policy Policy, status string) (Result, error) {
+	result := Result{Object: obj, Status: status}
+
+	if err := p.writeResult(ctx, policy, result); err != nil {
+		return Result{}, err
+	}
+
+	return result, nil
+}
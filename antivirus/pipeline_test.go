@@ -0,0 +1,588 @@
+package antivirus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type mockDownloader struct {
+	mock.Mock
+}
+
+func (m *mockDownloader) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	args := m.Called(*input.Bucket, *input.Key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+type mockScanner struct {
+	mock.Mock
+}
+
+func (m *mockScanner) StartDaemon() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *mockScanner) ScanFile(ctx context.Context, path string) (Verdict, error) {
+	args := m.Called(path)
+	return args.Get(0).(Verdict), args.Error(1)
+}
+
+type mockS3Tagger struct {
+	mock.Mock
+}
+
+func (m *mockS3Tagger) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	args := m.Called(*params.Bucket, *params.Key)
+
+	ptrTags := args.Get(0).([]*types.Tag)
+	valTags := make([]types.Tag, len(ptrTags))
+	for i, ptr := range ptrTags {
+		if ptr != nil {
+			valTags[i] = *ptr
+		}
+	}
+
+	return &s3.GetObjectTaggingOutput{
+		TagSet: valTags,
+	}, args.Error(1)
+}
+
+func (m *mockS3Tagger) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	ptrTags := make([]*types.Tag, len(params.Tagging.TagSet))
+	for i, v := range params.Tagging.TagSet {
+		ptrTags[i] = &v
+	}
+
+	args := m.Called(*params.Bucket, *params.Key, ptrTags)
+
+	return &s3.PutObjectTaggingOutput{}, args.Error(0)
+}
+
+type mockRecorder struct {
+	mock.Mock
+}
+
+func (m *mockRecorder) Record(ctx context.Context, result Result) error {
+	args := m.Called(result.Status)
+	return args.Error(0)
+}
+
+type recorderFunc func(ctx context.Context, result Result) error
+
+func (f recorderFunc) Record(ctx context.Context, result Result) error {
+	return f(ctx, result)
+}
+
+func testObject() Object {
+	return Object{Bucket: "my-bucket", Key: "file-key"}
+}
+
+func TestScan(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.
+		On("GetObject", "my-bucket", "file-key").
+		Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+		}, nil)
+
+	scanner := new(mockScanner)
+	scanner.
+		On("ScanFile", mock.Anything).
+		Return(Verdict{Signature: "Eicar-Signature"}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("VIRUS_SCAN"), Value: aws.String("failed")},
+	}).Return(nil)
+
+	recorder := new(mockRecorder)
+	recorder.On("Record", "failed").Return(nil)
+
+	secondRecorder := new(mockRecorder)
+	secondRecorder.On("Record", "failed").Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTagKey("VIRUS_SCAN"),
+		WithTagValues(TagValues{Fail: "failed"}),
+		WithTempDir(t.TempDir()),
+		WithRecorder(recorder),
+		WithRecorder(secondRecorder),
+		WithDefinitionsVersion(func() string { return "daily:1,main:2" }),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Greater(t, result.Duration, time.Duration(0))
+	assert.Greater(t, result.Timings.Write, time.Duration(0))
+	result.Duration = 0
+	result.Timings = Timings{}
+	assert.Equal(t, Result{
+		Object:             testObject(),
+		Verdict:            Verdict{Signature: "Eicar-Signature"},
+		Status:             "failed",
+		SHA256:             "e0ac3601005dfa1864f5392aabaf7d898b1b5bab854f1acb4491bcd806b76b0c",
+		DefinitionsVersion: "daily:1,main:2",
+		BytesScanned:       12,
+	}, result)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3, recorder, secondRecorder)
+}
+
+func TestScanWhenRecorderFails(t *testing.T) {
+	testcases := map[string]struct {
+		option func(Recorder) Option
+		err    string
+	}{
+		"optional": {option: WithRecorder},
+		"required": {option: WithRequiredRecorder, err: "table not found"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			downloader := new(mockDownloader)
+			downloader.
+				On("GetObject", "my-bucket", "file-key").
+				Return(&s3.GetObjectOutput{
+					Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+				}, nil)
+
+			scanner := new(mockScanner)
+			scanner.
+				On("ScanFile", mock.Anything).
+				Return(Verdict{Clean: true}, nil)
+
+			mockS3 := new(mockS3Tagger)
+			mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+			mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+				{Key: aws.String("VIRUS_SCAN"), Value: aws.String("ok")},
+			}).Return(nil)
+
+			recorder := new(mockRecorder)
+			recorder.On("Record", "ok").Return(errors.New("table not found"))
+
+			var recorded Result
+			secondRecorder := recorderFunc(func(ctx context.Context, result Result) error {
+				recorded = result
+				return nil
+			})
+
+			p := New(downloader, mockS3, scanner,
+				WithTagKey("VIRUS_SCAN"),
+				WithTagValues(TagValues{Pass: "ok"}),
+				WithTempDir(t.TempDir()),
+				tc.option(recorder),
+				WithRecorder(secondRecorder),
+			)
+
+			result, err := p.Scan(context.Background(), testObject())
+
+			if tc.err != "" {
+				assert.Equal(t, tc.err, err.Error())
+				assert.Equal(t, Result{}, recorded)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, "ok", result.Status)
+				assert.Equal(t, 1, result.RecordFailures)
+				assert.Equal(t, 1, recorded.RecordFailures)
+			}
+
+			mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3, recorder)
+		})
+	}
+}
+
+func TestScanPass(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{Clean: true}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("virus-scan-status"), Value: aws.String("ok")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()))
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", result.Status)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
+
+func TestScanRecordsSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{Clean: true}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", mock.Anything).Return(nil)
+
+	p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()))
+
+	_, err := p.Scan(context.Background(), testObject())
+	assert.Nil(t, err)
+
+	spans := recorder.Ended()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name()
+	}
+	assert.Equal(t, []string{"antivirus.download", "antivirus.inspect_archive", "antivirus.scan_file", "antivirus.write_result", "antivirus.Scan"}, names)
+
+	root := spans[4]
+	for _, span := range spans[:4] {
+		assert.Equal(t, root.SpanContext().SpanID(), span.Parent().SpanID())
+		assert.Contains(t, span.Attributes(), attribute.String("aws.s3.key", "file-key"))
+	}
+	assert.Contains(t, root.Attributes(), attribute.String("antivirus.verdict", "ok"))
+	assert.Contains(t, spans[0].Attributes(), attribute.Int64("antivirus.bytes_scanned", 12))
+}
+
+func TestScanHandlesDuplicateTags(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{
+		{Key: aws.String("VIRUS_SCAN"), Value: aws.String("okay")},
+		{Key: aws.String("upload-source"), Value: aws.String("online")},
+	}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("VIRUS_SCAN"), Value: aws.String("fail")},
+		{Key: aws.String("upload-source"), Value: aws.String("online")},
+	}).Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTagKey("VIRUS_SCAN"),
+		WithTagValues(TagValues{Fail: "fail"}),
+		WithTempDir(t.TempDir()),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, "fail", result.Status)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
+
+func TestScanReportsFailedDownload(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(nil, errors.New("file does not exist"))
+
+	scanner := new(mockScanner)
+	mockS3 := new(mockS3Tagger)
+
+	p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()))
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Equal(t, "failed to download file: file does not exist", err.Error())
+	assert.Equal(t, Result{}, result)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
+
+func TestScanReportsFailedScan(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{}, errors.New("clamav returned exit code 82"))
+
+	mockS3 := new(mockS3Tagger)
+
+	p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()))
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Equal(t, "clamav returned exit code 82", err.Error())
+	assert.Equal(t, Result{}, result)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
+
+func TestScanReportsFailedGetTags(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, errors.New("file does not exist"))
+
+	p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()))
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Equal(t, "failed to get tags: file does not exist", err.Error())
+	assert.Equal(t, Result{}, result)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
+
+func TestScanReportsFailedPutTags(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("VIRUS_SCAN"), Value: aws.String("fail")},
+	}).Return(errors.New("invalid tag"))
+
+	p := New(downloader, mockS3, scanner,
+		WithTagKey("VIRUS_SCAN"),
+		WithTagValues(TagValues{Fail: "fail"}),
+		WithTempDir(t.TempDir()),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Equal(t, "failed to write tags: invalid tag", err.Error())
+	assert.Equal(t, Result{}, result)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
+
+type mockMover struct {
+	mock.Mock
+}
+
+func (m *mockMover) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	args := m.Called(*params.Bucket, *params.Key, *params.CopySource)
+	return &s3.CopyObjectOutput{}, args.Error(0)
+}
+
+func (m *mockMover) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(*params.Bucket, *params.Key)
+	return &s3.DeleteObjectOutput{}, args.Error(0)
+}
+
+type policyFunc func(obj Object, base Policy) Policy
+
+func (f policyFunc) Resolve(obj Object, base Policy) Policy {
+	return f(obj, base)
+}
+
+func TestScanSkippedByPolicy(t *testing.T) {
+	downloader := new(mockDownloader)
+	scanner := new(mockScanner)
+	mockS3 := new(mockS3Tagger)
+
+	p := New(downloader, mockS3, scanner, WithPolicyResolver(policyFunc(func(obj Object, base Policy) Policy {
+		base.Skip = true
+		return base
+	})))
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Object: testObject(), Skipped: true}, result)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
+
+func TestScanOversize(t *testing.T) {
+	testcases := map[string]struct {
+		size   int64
+		output *s3.GetObjectOutput
+	}{
+		"from event": {
+			size: 11,
+		},
+		"from download": {
+			output: &s3.GetObjectOutput{
+				ContentLength: aws.Int64(11),
+				Body:          io.NopCloser(bytes.NewReader([]byte("file content"))),
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			downloader := new(mockDownloader)
+			if tc.output != nil {
+				downloader.On("GetObject", "my-bucket", "file-key").Return(tc.output, nil)
+			}
+
+			scanner := new(mockScanner)
+
+			mockS3 := new(mockS3Tagger)
+			mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+			mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+				{Key: aws.String("virus-scan-status"), Value: aws.String("too-large")},
+			}).Return(nil)
+
+			p := New(downloader, mockS3, scanner, WithMaxSize(10), WithTempDir(t.TempDir()))
+
+			obj := testObject()
+			obj.Size = tc.size
+
+			result, err := p.Scan(context.Background(), obj)
+
+			assert.Nil(t, err)
+			result.Duration = 0
+			assert.Equal(t, Result{Object: obj, Status: "too-large"}, result)
+
+			mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+		})
+	}
+}
+
+func TestScanDefinitionsCheck(t *testing.T) {
+	failingCheck := func() error { return ErrDefinitionsMissing }
+
+	t.Run("fail closed", func(t *testing.T) {
+		downloader := new(mockDownloader)
+		scanner := new(mockScanner)
+		mockS3 := new(mockS3Tagger)
+
+		p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()), WithDefinitionsCheck(failingCheck, DefinitionsFailClosed))
+
+		result, err := p.Scan(context.Background(), testObject())
+
+		assert.Equal(t, ErrDefinitionsMissing, err)
+		assert.Equal(t, Result{}, result)
+
+		mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+	})
+
+	t.Run("tag stale", func(t *testing.T) {
+		downloader := new(mockDownloader)
+		scanner := new(mockScanner)
+
+		mockS3 := new(mockS3Tagger)
+		mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+		mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+			{Key: aws.String("virus-scan-status"), Value: aws.String("stale-definitions")},
+		}).Return(nil)
+
+		p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()), WithDefinitionsCheck(failingCheck, DefinitionsTagStale))
+
+		result, err := p.Scan(context.Background(), testObject())
+
+		assert.Nil(t, err)
+		result.Duration = 0
+		assert.Equal(t, Result{Object: testObject(), Status: "stale-definitions"}, result)
+
+		mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		downloader := new(mockDownloader)
+		downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+		}, nil)
+
+		scanner := new(mockScanner)
+		scanner.On("ScanFile", mock.Anything).Return(Verdict{Clean: true}, nil)
+
+		mockS3 := new(mockS3Tagger)
+		mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+		mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+			{Key: aws.String("virus-scan-status"), Value: aws.String("ok")},
+		}).Return(nil)
+
+		p := New(downloader, mockS3, scanner, WithTempDir(t.TempDir()), WithDefinitionsCheck(failingCheck, DefinitionsFailOpen))
+
+		result, err := p.Scan(context.Background(), testObject())
+
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", result.Status)
+
+		mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+	})
+}
+
+func TestScanQuarantine(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{}, nil)
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", []*types.Tag{
+		{Key: aws.String("virus-scan-status"), Value: aws.String("infected")},
+	}).Return(nil)
+
+	mover := new(mockMover)
+	mover.On("CopyObject", "quarantine", "held/file-key", "my-bucket/file-key?versionId=v1").Return(nil)
+	mover.On("DeleteObject", "my-bucket", "file-key").Return(nil)
+
+	p := New(downloader, mockS3, scanner,
+		WithTempDir(t.TempDir()),
+		WithMover(mover),
+		WithPolicyResolver(policyFunc(func(obj Object, base Policy) Policy {
+			base.Quarantine = &Location{Bucket: "quarantine", Prefix: "held/"}
+			return base
+		})),
+	)
+
+	obj := testObject()
+	obj.VersionID = "v1"
+
+	result, err := p.Scan(context.Background(), obj)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &Object{Bucket: "quarantine", Key: "held/file-key"}, result.Quarantined)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3, mover)
+}
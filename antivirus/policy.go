@@ -0,0 +1,189 @@
+package antivirus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+)
+
+// Policy controls how a single object is handled by the pipeline.
+type Policy struct {
+	// Skip leaves the object untouched.
+	Skip      bool
+	TagKey    string
+	TagValues TagValues
+	// MaxSize is the largest object, in bytes, that will be downloaded. Larger
+	// objects are tagged with TagValues.Oversize. Zero means no limit.
+	MaxSize int64
+	// Quarantine, when set, moves infected objects to another location once
+	// they have been tagged.
+	Quarantine *Location
+	// ResultWriter names the writer used to record the status, when empty
+	// ResultWriterTags is used.
+	ResultWriter string
+	// AllowedTypes, when set, lists the file types clean objects may be. The
+	// type is detected from the object's contents and must also agree with
+	// the key's extension, other objects are tagged with
+	// TagValues.DisallowedType.
+	AllowedTypes []string
+	// ScanMembers, when set, extracts an infected zip, tar or gzip file and
+	// scans each file inside it to find which are infected.
+	ScanMembers bool
+	// CheckActiveContent, when set, tags clean PDF and Office documents that
+	// have JavaScript, automatic actions or macros with
+	// TagValues.ActiveContent.
+	CheckActiveContent bool
+}
+
+// Location is a bucket and key prefix.
+type Location struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+}
+
+// A PolicyResolver chooses the policy for an object, starting from the
+// pipeline's default policy.
+type PolicyResolver interface {
+	Resolve(obj Object, base Policy) Policy
+}
+
+type Mover interface {
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// WithPolicyResolver looks up the policy for each object before it is
+// downloaded.
+func WithPolicyResolver(resolver PolicyResolver) Option {
+	return func(p *Pipeline) {
+		p.resolver = resolver
+	}
+}
+
+// WithMover enables policies that quarantine objects.
+func WithMover(mover Mover) Option {
+	return func(p *Pipeline) {
+		p.mover = mover
+	}
+}
+
+func (p *Pipeline) quarantine(ctx context.Context, obj Object, dest Location) (moved Object, err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.quarantine", objectAttributes(obj))
+	defer func() { tracing.End(span, err) }()
+
+	if p.mover == nil {
+		return Object{}, errors.New("failed to quarantine object: pipeline has no mover")
+	}
+
+	moved = Object{Bucket: dest.Bucket, Key: dest.Prefix + obj.Key}
+
+	if _, err := p.mover.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(moved.Bucket),
+		Key:               aws.String(moved.Key),
+		CopySource:        aws.String(copySource(obj)),
+		TaggingDirective:  types.TaggingDirectiveCopy,
+		MetadataDirective: types.MetadataDirectiveCopy,
+	}); err != nil {
+		return Object{}, fmt.Errorf("failed to quarantine object: %w", err)
+	}
+
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	}
+	if obj.VersionID != "" {
+		input.VersionId = aws.String(obj.VersionID)
+	}
+
+	if _, err := p.mover.DeleteObject(ctx, input); err != nil {
+		return Object{}, fmt.Errorf("failed to remove quarantined object: %w", err)
+	}
+
+	return moved, nil
+}
+
+// copySource formats obj as the CopySource of a CopyObjectInput.
+func copySource(obj Object) string {
+	segments := strings.Split(obj.Key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	source := obj.Bucket + "/" + strings.Join(segments, "/")
+	if obj.VersionID != "" {
+		source += "?versionId=" + url.QueryEscape(obj.VersionID)
+	}
+
+	return source
+}
+
+// validTagChars are the characters S3 allows in tag keys and values.
+var validTagChars = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// ValidateTagKey checks key against the S3 rules for tag keys. The errors read
+// as a continuation of the setting name.
+func ValidateTagKey(key string) []error {
+	if key == "" {
+		return []error{errors.New("is required")}
+	}
+
+	var errs []error
+	if utf8.RuneCountInString(key) > 128 {
+		errs = append(errs, errors.New("must be at most 128 characters"))
+	}
+	if strings.HasPrefix(strings.ToLower(key), "aws:") {
+		errs = append(errs, errors.New("must not start with aws:"))
+	}
+	if !validTagChars.MatchString(key) {
+		errs = append(errs, fmt.Errorf("contains characters not allowed in S3 tags: %q", key))
+	}
+
+	return errs
+}
+
+// ValidateTagValue checks value against the S3 rules for tag values. The
+// errors read as a continuation of the setting name.
+func ValidateTagValue(value string) []error {
+	if value == "" {
+		return []error{errors.New("is required")}
+	}
+
+	var errs []error
+	if utf8.RuneCountInString(value) > 256 {
+		errs = append(errs, errors.New("must be at most 256 characters"))
+	}
+	if !validTagChars.MatchString(value) {
+		errs = append(errs, fmt.Errorf("contains characters not allowed in S3 tags: %q", value))
+	}
+
+	return errs
+}
+
+// Validate checks each value that is set against the S3 rules for tag values,
+// and that Pass and Fail differ. Each error starts with name called with the
+// JSON name of the value, such as "staleDefinitions".
+func (v TagValues) Validate(name func(field string) string) []error {
+	var errs []error
+	for _, field := range v.fields() {
+		if *field.value != "" {
+			for _, err := range ValidateTagValue(*field.value) {
+				errs = append(errs, fmt.Errorf("%s %w", name(field.name), err))
+			}
+		}
+	}
+
+	if v.Pass != "" && v.Pass == v.Fail {
+		errs = append(errs, fmt.Errorf("%s and %s must be different", name("pass"), name("fail")))
+	}
+
+	return errs
+}
@@ -0,0 +1,15 @@
+package antivirus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagValuesOverlay(t *testing.T) {
+	base := TagValues{Pass: "ok", Fail: "infected", Oversize: "too-large"}
+
+	assert.Equal(t, TagValues{Pass: "clean", Fail: "infected", Oversize: "too-large", ActiveContent: "active"},
+		base.Overlay(TagValues{Pass: "clean", ActiveContent: "active"}))
+	assert.Equal(t, base, base.Overlay(TagValues{}))
+}
@@ -0,0 +1,462 @@
+package antivirus
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/cvd"
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const DefaultReloadInterval = time.Hour
+
+// LegacyDefinitionsVersion is the Version of the definitions loaded from a
+// bucket that an earlier release of the update function published to, which
+// has the files at its root rather than a current set.
+const LegacyDefinitionsVersion = "legacy"
+
+var (
+	legacyPointer          = cvd.Pointer{Version: LegacyDefinitionsVersion}
+	legacyDefinitionsFiles = []string{"bytecode.cvd", "daily.cvd", "freshclam.dat", "main.cvd"}
+)
+
+// DefinitionsReloader keeps the definitions in Dir in step with the bucket
+// they are published to, so that a warm container does not keep scanning with
+// the signatures it loaded at cold start.
+//
+// The pointer to the current set is fetched with a conditional GET, so an
+// unchanged set costs a single request. When it has moved, the new set is built
+// in a directory next to Dir: files that differ from the copies on disk are
+// downloaded, and the others are linked from the current set. Dir is a symlink
+// to the directory holding the set, and once every file has arrived and
+// matches the set's manifest it is swapped to the new directory with a single
+// rename. So clamd, reloading or checking the databases itself, only ever sees
+// a complete set. The files to load are whatever the manifest lists, so files
+// it does not list, such as a daily.cvd that freshclam has since replaced with
+// daily.cld, are dropped. Nothing else should be kept in Dir, such as the clamd
+// socket, as it does not survive the swap.
+//
+// A bucket without a pointer was published to by a release of the update
+// function from before definitions sets, so the files at its root are loaded
+// instead, once, until a set is published. They are only loaded when no set
+// has been, so a pointer that goes missing later leaves the current set in
+// place.
+type DefinitionsReloader struct {
+	Downloader Downloader
+	Bucket     string
+	// Dir is the DatabaseDirectory clamd loads from.
+	Dir string
+	// Interval is the least time between checks of the bucket, when zero
+	// DefaultReloadInterval is used.
+	Interval time.Duration
+	// Reload is called once changed files are in place, such as
+	// ClamAvScanner.ReloadDatabase.
+	Reload func(ctx context.Context) error
+
+	mu          sync.Mutex
+	pointerETag string
+	version     string
+	lastChecked time.Time
+	// reloadPending is set while files changed by ReloadIfDue have not been
+	// loaded by Reload.
+	reloadPending bool
+	now           func() time.Time
+	// rename swaps in the new set, it is replaced in tests.
+	rename func(oldpath, newpath string) error
+}
+
+// Version is the version of the definitions set last loaded into Dir.
+func (r *DefinitionsReloader) Version() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.version
+}
+
+// Sync downloads any files that have changed since the last call and reports
+// whether there were any. It does not call Reload, so can be used at cold
+// start before clamd is running.
+func (r *DefinitionsReloader) Sync(ctx context.Context) (changed bool, err error) {
+	ctx, span := tracer.Start(ctx, "antivirus.sync_definitions", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", r.Bucket),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Bool("antivirus.definitions_changed", changed))
+		tracing.End(span, err)
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastChecked = r.clock()
+
+	pointer, etag, modified, err := r.fetchPointer(ctx)
+	if err != nil || !modified {
+		return false, err
+	}
+	span.SetAttributes(attribute.String("antivirus.definitions_set", pointer.Version))
+
+	next, err := os.MkdirTemp(filepath.Dir(r.Dir), r.setPrefix())
+	if err != nil {
+		return false, fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			os.RemoveAll(next) //nolint:errcheck,gosec // staging dir is temporary
+		}
+	}()
+
+	if pointer == legacyPointer {
+		slog.WarnContext(ctx, "definitions bucket has no current.json, loading the files published at its root by an earlier release", slog.String("bucket", r.Bucket))
+		changed, err = r.stageLegacy(ctx, next)
+	} else {
+		changed, err = r.stage(ctx, pointer, next)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if changed {
+		if err := r.swap(ctx, next); err != nil {
+			return false, err
+		}
+		swapped = true
+	}
+
+	r.pointerETag = etag
+	r.version = pointer.Version
+
+	return changed, nil
+}
+
+// stage builds the set pointer names in next, reporting whether it differs
+// from the set in Dir.
+func (r *DefinitionsReloader) stage(ctx context.Context, pointer cvd.Pointer, next string) (changed bool, err error) {
+	manifest, err := r.fetchManifest(ctx, pointer)
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range manifest.Names() {
+		current, path := filepath.Join(r.Dir, key), filepath.Join(next, key)
+		if manifest.Verify(key, current) == nil {
+			if err := linkOrCopy(current, path); err != nil {
+				return false, fmt.Errorf("failed to stage definitions file %s: %w", key, err)
+			}
+			continue
+		}
+
+		if err := r.fetch(ctx, manifest.Key(pointer.Prefix, key), path); err != nil {
+			return false, fmt.Errorf("failed to download definitions file %s: %w", key, err)
+		}
+
+		if err := manifest.Verify(key, path); err != nil {
+			return false, fmt.Errorf("rejected definitions %s: %w", pointer.Version, err)
+		}
+
+		changed = true
+	}
+
+	return changed || r.hasUnlisted(manifest), nil
+}
+
+// stageLegacy downloads the files that releases before definitions sets
+// published at the root of the bucket into next. They came without a
+// manifest, so are loaded as they are, as those releases did, and clamd checks
+// the signatures of the databases itself.
+func (r *DefinitionsReloader) stageLegacy(ctx context.Context, next string) (changed bool, err error) {
+	for _, key := range legacyDefinitionsFiles {
+		err := r.fetch(ctx, key, filepath.Join(next, key))
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to download definitions file %s: %w", key, err)
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return false, fmt.Errorf("failed to download definitions: %s has neither %s nor definitions at its root", r.Bucket, cvd.PointerName)
+	}
+
+	return true, nil
+}
+
+// setPrefix names the directories holding definitions sets, which are kept
+// next to Dir so that a rename can swap them.
+func (r *DefinitionsReloader) setPrefix() string {
+	return "." + filepath.Base(r.Dir) + "-"
+}
+
+// hasUnlisted reports whether Dir holds definitions files that are not in
+// manifest.
+func (r *DefinitionsReloader) hasUnlisted(manifest cvd.Manifest) bool {
+	names, _ := cvd.ListDefinitions(r.Dir)
+	for _, name := range names {
+		if _, ok := manifest.Files[name]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// swap points Dir at next by renaming a symlink over it, then removes the set
+// it pointed at before.
+func (r *DefinitionsReloader) swap(ctx context.Context, next string) error {
+	rename := r.rename
+	if rename == nil {
+		rename = os.Rename
+	}
+
+	var previous string
+	var movedAside bool
+	info, err := os.Lstat(r.Dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to swap in definitions: %w", err)
+	case info.Mode()&os.ModeSymlink != 0:
+		if previous, err = filepath.EvalSymlinks(r.Dir); err != nil {
+			return fmt.Errorf("failed to swap in definitions: %w", err)
+		}
+	default:
+		// A directory, as left by an earlier release, cannot be replaced by
+		// a rename, so is moved aside first. This only happens once.
+		previous = next + "-previous"
+		if err := rename(r.Dir, previous); err != nil {
+			return fmt.Errorf("failed to swap in definitions: %w", err)
+		}
+		movedAside = true
+	}
+
+	link := next + "-link"
+	if err := os.Symlink(filepath.Base(next), link); err != nil {
+		return fmt.Errorf("failed to swap in definitions: %w", err)
+	}
+
+	if err := rename(link, r.Dir); err != nil {
+		_ = os.Remove(link)
+		if movedAside {
+			_ = rename(previous, r.Dir)
+		}
+		return fmt.Errorf("failed to swap in definitions: %w", err)
+	}
+
+	if previous != "" && filepath.Dir(previous) == filepath.Dir(r.Dir) && strings.HasPrefix(filepath.Base(previous), r.setPrefix()) {
+		if err := os.RemoveAll(previous); err != nil {
+			slog.WarnContext(ctx, "error whilst removing old definitions", slog.Any("error", err))
+		}
+	}
+
+	return nil
+}
+
+// linkOrCopy hard links src to dst, copying it when it cannot be linked.
+func linkOrCopy(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src) //nolint:gosec // src is in the definitions dir
+	if err != nil {
+		return err
+	}
+	defer in.Close() //nolint:errcheck // no need to check error when closing file
+
+	out, err := os.Create(dst) //nolint:gosec // dst is in the staging dir
+	if err != nil {
+		return err
+	}
+	defer out.Close() //nolint:errcheck // no need to check error when closing file
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// fetchPointer resolves the current definitions set, unless the pointer has
+// not moved since the last successful sync, in which case modified is false.
+func (r *DefinitionsReloader) fetchPointer(ctx context.Context) (pointer cvd.Pointer, etag string, modified bool, err error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.Bucket),
+		Key:    aws.String(cvd.PointerName),
+	}
+	if r.pointerETag != "" {
+		input.IfNoneMatch = aws.String(r.pointerETag)
+	}
+
+	output, err := r.Downloader.GetObject(ctx, input)
+	if err != nil {
+		var responseErr *awshttp.ResponseError
+		if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotModified {
+			return cvd.Pointer{}, "", false, nil
+		}
+
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			switch r.version {
+			case "":
+				return legacyPointer, "", true, nil
+			case LegacyDefinitionsVersion:
+				// The legacy files are only loaded once, as the releases
+				// that published them did, until a set is published.
+				return cvd.Pointer{}, "", false, nil
+			default:
+				// A published set is never swapped for the unverified files
+				// at the root, which are older than it.
+				return cvd.Pointer{}, "", false, fmt.Errorf("failed to download definitions pointer: %s has no %s, keeping definitions %s", r.Bucket, cvd.PointerName, r.version)
+			}
+		}
+
+		return cvd.Pointer{}, "", false, fmt.Errorf("failed to download definitions pointer: %w", err)
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	b, err := io.ReadAll(output.Body)
+	if err != nil {
+		return cvd.Pointer{}, "", false, fmt.Errorf("failed to download definitions pointer: %w", err)
+	}
+
+	pointer, err = cvd.ParsePointer(b)
+	if err != nil {
+		return cvd.Pointer{}, "", false, err
+	}
+
+	return pointer, aws.ToString(output.ETag), true, nil
+}
+
+func (r *DefinitionsReloader) fetchManifest(ctx context.Context, pointer cvd.Pointer) (cvd.Manifest, error) {
+	output, err := r.Downloader.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.Bucket),
+		Key:    aws.String(pointer.Prefix + cvd.ManifestName),
+	})
+	if err != nil {
+		return cvd.Manifest{}, fmt.Errorf("failed to download definitions manifest: %w", err)
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	b, err := io.ReadAll(output.Body)
+	if err != nil {
+		return cvd.Manifest{}, fmt.Errorf("failed to download definitions manifest: %w", err)
+	}
+
+	return cvd.ParseManifest(b)
+}
+
+// fetch downloads key to path.
+func (r *DefinitionsReloader) fetch(ctx context.Context, key, path string) error {
+	output, err := r.Downloader.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	file, err := os.Create(path) //nolint:gosec // path is in the staging dir
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck // no need to check error when closing file
+
+	if _, err := io.Copy(file, output.Body); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// ReloadIfDue syncs the definitions when Interval has passed since the last
+// check, then calls Reload if any files changed. A failed Reload is tried
+// again on each later call until it succeeds, as the changed files are already
+// in place and the pointer will not move again. It reports whether the
+// definitions were reloaded.
+func (r *DefinitionsReloader) ReloadIfDue(ctx context.Context) (bool, error) {
+	if r.due() {
+		changed, err := r.Sync(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if changed {
+			r.setReloadPending(true)
+		}
+	}
+
+	if !r.isReloadPending() {
+		slog.DebugContext(ctx, "virus definitions unchanged")
+		return false, nil
+	}
+
+	if err := r.reload(ctx); err != nil {
+		return false, err
+	}
+	r.setReloadPending(false)
+
+	return true, nil
+}
+
+func (r *DefinitionsReloader) setReloadPending(pending bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reloadPending = pending
+}
+
+func (r *DefinitionsReloader) isReloadPending() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reloadPending
+}
+
+func (r *DefinitionsReloader) reload(ctx context.Context) error {
+	if r.Reload == nil {
+		return nil
+	}
+
+	if err := r.Reload(ctx); err != nil {
+		return fmt.Errorf("failed to reload definitions: %w", err)
+	}
+
+	return nil
+}
+
+func (r *DefinitionsReloader) due() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lastChecked.IsZero() || r.clock().Sub(r.lastChecked) >= cmp.Or(r.Interval, DefaultReloadInterval)
+}
+
+func (r *DefinitionsReloader) clock() time.Time {
+	if r.now == nil {
+		return time.Now()
+	}
+
+	return r.now()
+}
@@ -0,0 +1,443 @@
+package antivirus
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/ministryofjustice/opg-s3-antivirus/cvd"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDefinitionsBucket answers GETs the way S3 does, with a 304 when
+// If-None-Match matches the ETag of the object.
+type fakeDefinitionsBucket struct {
+	objects map[string][]byte
+	gets    map[string]int
+	err     error
+}
+
+func newFakeDefinitionsBucket() *fakeDefinitionsBucket {
+	return &fakeDefinitionsBucket{objects: map[string][]byte{}, gets: map[string]int{}}
+}
+
+// publish uploads files as a definitions set with a manifest, then points at
+// it.
+func (b *fakeDefinitionsBucket) publish(version string, files map[string]string) {
+	pointer := cvd.NewPointer(version)
+	manifest := cvd.Manifest{Files: map[string]cvd.ManifestFile{}}
+
+	for name, body := range files {
+		sum := sha256.Sum256([]byte(body))
+		manifest.Files[name] = cvd.ManifestFile{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(body))}
+		b.objects[pointer.Prefix+name] = []byte(body)
+	}
+
+	b.objects[pointer.Prefix+cvd.ManifestName], _ = json.Marshal(manifest)
+	b.objects[cvd.PointerName], _ = json.Marshal(pointer)
+}
+
+func (b *fakeDefinitionsBucket) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	b.gets[*input.Key]++
+
+	body, ok := b.objects[*input.Key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+
+	sum := md5.Sum(body) //nolint:gosec // md5 is what S3 uses for ETags
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	if aws.ToString(input.IfNoneMatch) == etag {
+		return nil, &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotModified}},
+			Err:      errors.New("not modified"),
+		}}
+	}
+
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(body)),
+		ETag: aws.String(etag),
+	}, nil
+}
+
+func readDefinitionsFile(t *testing.T, dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name)) //nolint:gosec // dir is a test temp dir
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestDefinitionsReloaderSync(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1", "daily.cvd": "daily v1"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	changed, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "v1", r.Version())
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, "daily v1", readDefinitionsFile(t, dir, "daily.cvd"))
+
+	changed, err = r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, bucket.gets["versions/v1/manifest.json"])
+
+	bucket.publish("v2", map[string]string{"main.cvd": "main v1", "daily.cvd": "daily v2"})
+
+	changed, err = r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "v2", r.Version())
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, "daily v2", readDefinitionsFile(t, dir, "daily.cvd"))
+	assert.Equal(t, 0, bucket.gets["versions/v2/main.cvd"])
+	assert.Equal(t, 1, bucket.gets["versions/v2/daily.cvd"])
+
+	sets, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), ".clamav-*"))
+	assert.Len(t, sets, 1)
+}
+
+func TestDefinitionsReloaderSyncFromLegacyBucket(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.objects["main.cvd"] = []byte("main legacy")
+	bucket.objects["daily.cvd"] = []byte("daily legacy")
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	changed, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, LegacyDefinitionsVersion, r.Version())
+	assert.Equal(t, "main legacy", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, "daily legacy", readDefinitionsFile(t, dir, "daily.cvd"))
+
+	changed, err = r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, bucket.gets["main.cvd"])
+
+	bucket.publish("v1", map[string]string{"main.cvd": "main legacy", "daily.cvd": "daily v1"})
+
+	changed, err = r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "v1", r.Version())
+	assert.Equal(t, "daily v1", readDefinitionsFile(t, dir, "daily.cvd"))
+	assert.Equal(t, 0, bucket.gets["versions/v1/main.cvd"])
+}
+
+func TestDefinitionsReloaderSyncWhenPointerRemoved(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.objects["main.cvd"] = []byte("main legacy")
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	changed, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	delete(bucket.objects, "current.json")
+
+	changed, err = r.Sync(context.Background())
+	assert.Equal(t, "failed to download definitions pointer: a-bucket has no current.json, keeping definitions v1", err.Error())
+	assert.False(t, changed)
+	assert.Equal(t, "v1", r.Version())
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, 0, bucket.gets["main.cvd"])
+}
+
+func TestDefinitionsReloaderSyncFromEmptyBucket(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+
+	r := &DefinitionsReloader{Downloader: newFakeDefinitionsBucket(), Bucket: "a-bucket", Dir: dir}
+
+	changed, err := r.Sync(context.Background())
+	assert.Equal(t, "failed to download definitions: a-bucket has neither current.json nor definitions at its root", err.Error())
+	assert.False(t, changed)
+	assert.Equal(t, "", r.Version())
+	assert.NoDirExists(t, dir)
+}
+
+func TestDefinitionsReloaderSyncReplacesDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	if err := os.Mkdir(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.cvd"), []byte("main v0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	changed, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+
+	info, _ := os.Lstat(dir)
+	assert.Equal(t, os.ModeSymlink, info.Mode()&os.ModeSymlink)
+
+	sets, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), ".clamav-*"))
+	assert.Len(t, sets, 1)
+}
+
+func TestDefinitionsReloaderSyncWhenSwapFails(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1", "daily.cvd": "daily v1"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	_, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+
+	bucket.publish("v2", map[string]string{"main.cvd": "main v2", "daily.cvd": "daily v2"})
+	r.rename = func(oldpath, newpath string) error {
+		return errors.New("what")
+	}
+
+	changed, err := r.Sync(context.Background())
+	assert.False(t, changed)
+	assert.Equal(t, "failed to swap in definitions: what", err.Error())
+	assert.Equal(t, "v1", r.Version())
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, "daily v1", readDefinitionsFile(t, dir, "daily.cvd"))
+
+	sets, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), ".clamav-*"))
+	assert.Len(t, sets, 1)
+
+	r.rename = nil
+
+	changed, err = r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "main v2", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, "daily v2", readDefinitionsFile(t, dir, "daily.cvd"))
+}
+
+func TestDefinitionsReloaderSyncFollowsManifestKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1", "daily.cvd": "daily v1"})
+	bucket.publish("v2", map[string]string{"daily.cvd": "daily v2"})
+
+	manifest, _ := cvd.ParseManifest(bucket.objects["versions/v1/manifest.json"])
+	v2, _ := cvd.ParseManifest(bucket.objects["versions/v2/manifest.json"])
+	main := manifest.Files["main.cvd"]
+	main.Key = "versions/v1/main.cvd"
+	v2.Files["main.cvd"] = main
+	bucket.objects["versions/v2/manifest.json"], _ = json.Marshal(v2)
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	changed, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, "daily v2", readDefinitionsFile(t, dir, "daily.cvd"))
+}
+
+func TestDefinitionsReloaderSyncRemovesUnlistedFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1", "daily.cvd": "daily v1"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	_, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+
+	bucket.publish("v2", map[string]string{"main.cvd": "main v1", "daily.cld": "daily v2"})
+
+	changed, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "daily v2", readDefinitionsFile(t, dir, "daily.cld"))
+
+	_, err = os.Stat(filepath.Join(dir, "daily.cvd"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDefinitionsReloaderSyncRollsBack(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1"})
+	v1 := bucket.objects[cvd.PointerName]
+	bucket.publish("v2", map[string]string{"main.cvd": "main v2"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	_, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "main v2", readDefinitionsFile(t, dir, "main.cvd"))
+
+	bucket.objects[cvd.PointerName] = v1
+
+	changed, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "v1", r.Version())
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+}
+
+func TestDefinitionsReloaderSyncWhenError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	_, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+
+	bucket.publish("v2", map[string]string{"main.cvd": "main v2"})
+	bucket.err = errors.New("what")
+
+	changed, err := r.Sync(context.Background())
+	assert.False(t, changed)
+	assert.Equal(t, "failed to download definitions pointer: what", err.Error())
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+}
+
+func TestDefinitionsReloaderSyncWhenSetIncomplete(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1", "daily.cvd": "daily v1"})
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	_, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+
+	bucket.publish("v2", map[string]string{"main.cvd": "main v2", "daily.cvd": "daily v2"})
+	delete(bucket.objects, "versions/v2/daily.cvd")
+
+	changed, err := r.Sync(context.Background())
+	assert.False(t, changed)
+	assert.Equal(t, "failed to download definitions file daily.cvd: NoSuchKey: ", err.Error())
+	assert.Equal(t, "v1", r.Version())
+	assert.Equal(t, "main v1", readDefinitionsFile(t, dir, "main.cvd"))
+	assert.Equal(t, "daily v1", readDefinitionsFile(t, dir, "daily.cvd"))
+}
+
+func TestDefinitionsReloaderSyncRejectsTamperedFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "clamav")
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1"})
+	bucket.objects["versions/v1/main.cvd"] = []byte("main v!")
+
+	r := &DefinitionsReloader{Downloader: bucket, Bucket: "a-bucket", Dir: dir}
+
+	changed, err := r.Sync(context.Background())
+	assert.False(t, changed)
+	assert.ErrorIs(t, err, cvd.ErrManifestMismatch)
+	assert.Contains(t, err.Error(), "rejected definitions v1: definitions do not match manifest: main.cvd has sha256 ")
+
+	_, err = os.Stat(filepath.Join(dir, "main.cvd"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDefinitionsReloaderReloadIfDue(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1"})
+
+	reloads := 0
+	r := &DefinitionsReloader{
+		Downloader: bucket,
+		Bucket:     "a-bucket",
+		Dir:        filepath.Join(t.TempDir(), "clamav"),
+		Interval:   10 * time.Minute,
+		Reload: func(ctx context.Context) error {
+			reloads++
+			return nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	_, err := r.Sync(context.Background())
+	assert.Nil(t, err)
+
+	bucket.publish("v2", map[string]string{"main.cvd": "main v2"})
+
+	now = now.Add(5 * time.Minute)
+	reloaded, err := r.ReloadIfDue(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, 1, bucket.gets[cvd.PointerName])
+
+	now = now.Add(5 * time.Minute)
+	reloaded, err = r.ReloadIfDue(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, 1, reloads)
+
+	now = now.Add(10 * time.Minute)
+	reloaded, err = r.ReloadIfDue(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, 1, reloads)
+}
+
+func TestDefinitionsReloaderReloadIfDueWhenReloadFails(t *testing.T) {
+	bucket := newFakeDefinitionsBucket()
+	bucket.publish("v1", map[string]string{"main.cvd": "main v1"})
+
+	reloadErr := errors.New("what")
+	r := &DefinitionsReloader{
+		Downloader: bucket,
+		Bucket:     "a-bucket",
+		Dir:        filepath.Join(t.TempDir(), "clamav"),
+		Interval:   10 * time.Minute,
+		Reload: func(ctx context.Context) error {
+			return reloadErr
+		},
+	}
+
+	reloaded, err := r.ReloadIfDue(context.Background())
+	assert.False(t, reloaded)
+	assert.Equal(t, "failed to reload definitions: what", err.Error())
+
+	reloadErr = nil
+
+	reloaded, err = r.ReloadIfDue(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, 1, bucket.gets[cvd.PointerName])
+
+	reloaded, err = r.ReloadIfDue(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+}
@@ -0,0 +1,322 @@
+package antivirus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Names of the built in result writers, used by Policy.ResultWriter.
+const (
+	ResultWriterTags     = "tags"
+	ResultWriterSidecar  = "sidecar"
+	ResultWriterMetadata = "metadata"
+)
+
+// A ResultWriter records the outcome of a scan against the object. key is the
+// policy's tag key, which writers that do not use tags use as their field
+// name.
+type ResultWriter interface {
+	WriteResult(ctx context.Context, key string, result Result) error
+}
+
+// A ResultFilter is a ResultWriter that creates objects, or new versions of
+// objects, which would otherwise trigger another scan. The pipeline skips
+// objects for which WrittenByWriter returns true.
+type ResultFilter interface {
+	WrittenByWriter(ctx context.Context, key string, obj Object) (bool, error)
+}
+
+// WithResultWriter registers a ResultWriter that policies can choose by name.
+// The "tags" writer is always registered.
+func WithResultWriter(name string, writer ResultWriter) Option {
+	return func(p *Pipeline) {
+		p.writers[name] = writer
+	}
+}
+
+// WithDefaultResultWriter chooses the writer used by policies that do not
+// name one.
+func WithDefaultResultWriter(name string) Option {
+	return func(p *Pipeline) {
+		p.resultWriter = name
+	}
+}
+
+// maxObjectTags is the most tags S3 allows on an object.
+const maxObjectTags = 10
+
+// TagWriter records the status as an object tag, keeping any other tags that
+// are already on the object. The reason is added as a second tag when the
+// object has room for it.
+type TagWriter struct {
+	Tagger Tagger
+}
+
+func (w *TagWriter) WriteResult(ctx context.Context, key string, result Result) error {
+	obj := result.Object
+
+	input := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	}
+	if obj.VersionID != "" {
+		input.VersionId = aws.String(obj.VersionID)
+	}
+
+	tagging, err := w.Tagger.GetObjectTagging(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	tagging.TagSet = setTag(tagging.TagSet, key, result.Status)
+	if result.Verdict.Reason != "" {
+		if hasTag(tagging.TagSet, ReasonKey(key)) || len(tagging.TagSet) < maxObjectTags {
+			tagging.TagSet = setTag(tagging.TagSet, ReasonKey(key), result.Verdict.Reason)
+		} else {
+			slog.WarnContext(ctx, "not tagging reason, object has too many tags", slog.String("reason", result.Verdict.Reason))
+		}
+	}
+
+	putInput := &s3.PutObjectTaggingInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+		Tagging: &types.Tagging{
+			TagSet: tagging.TagSet,
+		},
+	}
+	if obj.VersionID != "" {
+		putInput.VersionId = aws.String(obj.VersionID)
+	}
+
+	if _, err = w.Tagger.PutObjectTagging(ctx, putInput); err != nil {
+		return fmt.Errorf("failed to write tags: %w", err)
+	}
+
+	return nil
+}
+
+// hasTag reports whether tags has key.
+func hasTag(tags []types.Tag, key string) bool {
+	for _, tag := range tags {
+		if *tag.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setTag sets key to value in tags, adding it when it is not already there.
+func setTag(tags []types.Tag, key, value string) []types.Tag {
+	is_tag_set := false
+	for index, tag := range tags {
+		if *tag.Key == key {
+			tags[index].Value = aws.String(value)
+			is_tag_set = true
+		}
+	}
+
+	if !is_tag_set {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+
+	return tags
+}
+
+type Uploader interface {
+	PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// Sidecar is the JSON document written by SidecarWriter.
+type Sidecar struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	VersionID string    `json:"versionId,omitempty"`
+	ETag      string    `json:"eTag,omitempty"`
+	Field     string    `json:"field"`
+	Status    string    `json:"status"`
+	Clean     bool      `json:"clean"`
+	Signature string    `json:"signature,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	ScannedAt time.Time `json:"scannedAt"`
+
+	InfectedMembers []InfectedMember `json:"infectedMembers,omitempty"`
+	ActiveContent   []string         `json:"activeContent,omitempty"`
+	Engines         []EngineVerdict  `json:"engines,omitempty"`
+}
+
+// SidecarWriter records the result as a JSON object in the same bucket, at
+// Prefix followed by the object key and ".json". Objects under Prefix are not
+// scanned.
+type SidecarWriter struct {
+	Uploader Uploader
+	Prefix   string
+	Now      func() time.Time
+}
+
+func (w *SidecarWriter) SidecarKey(key string) string {
+	return w.Prefix + key + ".json"
+}
+
+func (w *SidecarWriter) WriteResult(ctx context.Context, key string, result Result) error {
+	now := time.Now
+	if w.Now != nil {
+		now = w.Now
+	}
+
+	obj := result.Object
+	data, err := json.Marshal(Sidecar{
+		Bucket:    obj.Bucket,
+		Key:       obj.Key,
+		VersionID: obj.VersionID,
+		ETag:      obj.ETag,
+		Field:     key,
+		Status:    result.Status,
+		Clean:     result.Verdict.Clean,
+		Signature: result.Verdict.Signature,
+		Reason:    result.Verdict.Reason,
+		ScannedAt: now().UTC(),
+
+		InfectedMembers: result.InfectedMembers,
+		ActiveContent:   result.ActiveContent,
+		Engines:         result.Verdict.Engines,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write sidecar: %w", err)
+	}
+
+	if _, err := w.Uploader.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(obj.Bucket),
+		Key:                  aws.String(w.SidecarKey(obj.Key)),
+		Body:                 bytes.NewReader(data),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: types.ServerSideEncryptionAes256,
+	}); err != nil {
+		return fmt.Errorf("failed to write sidecar: %w", err)
+	}
+
+	return nil
+}
+
+func (w *SidecarWriter) WrittenByWriter(ctx context.Context, key string, obj Object) (bool, error) {
+	return strings.HasPrefix(obj.Key, w.Prefix), nil
+}
+
+type Copier interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+}
+
+// MetadataWriter records the status as user metadata by copying the object
+// onto itself. This creates a new version of the object, which is scanned like
+// any other. As uploaders can set metadata themselves, the copy is not trusted
+// to skip the scan. Instead no copy is made when the metadata already holds the
+// result, so scanning the copy ends the loop.
+//
+// The copy is only made while the object still has the ETag of the content
+// that was scanned. An object superseded by a newer upload is left for the
+// scan of that upload.
+type MetadataWriter struct {
+	Copier Copier
+}
+
+func (w *MetadataWriter) head(ctx context.Context, obj Object) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	}
+	if obj.VersionID != "" {
+		input.VersionId = aws.String(obj.VersionID)
+	}
+
+	return w.Copier.HeadObject(ctx, input)
+}
+
+func (w *MetadataWriter) WriteResult(ctx context.Context, key string, result Result) error {
+	obj := result.Object
+
+	head, err := w.head(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	if metadataHolds(head.Metadata, key, result) {
+		return nil
+	}
+
+	metadata := make(map[string]string, len(head.Metadata)+2)
+	for k, v := range head.Metadata {
+		metadata[k] = v
+	}
+	metadata[strings.ToLower(key)] = result.Status
+	if result.Verdict.Reason != "" {
+		metadata[strings.ToLower(ReasonKey(key))] = result.Verdict.Reason
+	} else {
+		delete(metadata, strings.ToLower(ReasonKey(key)))
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:             aws.String(obj.Bucket),
+		Key:                aws.String(obj.Key),
+		CopySource:         aws.String(copySource(obj)),
+		Metadata:           metadata,
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		TaggingDirective:   types.TaggingDirectiveCopy,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentType:        head.ContentType,
+		Expires:            head.Expires,
+		StorageClass:       head.StorageClass,
+	}
+
+	if head.ServerSideEncryption == types.ServerSideEncryptionAwsKms {
+		input.ServerSideEncryption = head.ServerSideEncryption
+		input.SSEKMSKeyId = head.SSEKMSKeyId
+		input.BucketKeyEnabled = head.BucketKeyEnabled
+	} else {
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	}
+
+	if obj.ETag != "" {
+		input.CopySourceIfMatch = aws.String(obj.ETag)
+	}
+
+	if _, err := w.Copier.CopyObject(ctx, input); err != nil {
+		var responseErr *awshttp.ResponseError
+		if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusPreconditionFailed {
+			slog.InfoContext(ctx, "object superseded since it was scanned, not writing metadata")
+			return nil
+		}
+
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return nil
+}
+
+// metadataHolds reports whether metadata already records result.
+func metadataHolds(metadata map[string]string, key string, result Result) bool {
+	status, ok := metadata[strings.ToLower(key)]
+	if !ok || status != result.Status {
+		return false
+	}
+
+	return metadata[strings.ToLower(ReasonKey(key))] == result.Verdict.Reason
+}
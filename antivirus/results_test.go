@@ -0,0 +1,247 @@
+package antivirus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockUploader struct {
+	mock.Mock
+}
+
+func (m *mockUploader) PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, _ := io.ReadAll(input.Body)
+	args := m.Called(*input.Bucket, *input.Key, string(body))
+	return &s3.PutObjectOutput{}, args.Error(0)
+}
+
+type mockCopier struct {
+	mock.Mock
+}
+
+func (m *mockCopier) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	args := m.Called(*params.Bucket, *params.Key)
+	return args.Get(0).(*s3.HeadObjectOutput), args.Error(1)
+}
+
+func (m *mockCopier) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	args := m.Called(params)
+	return &s3.CopyObjectOutput{}, args.Error(0)
+}
+
+func TestTagWriterReasonWhenTagsFull(t *testing.T) {
+	tags := func(n int, extra ...*types.Tag) []*types.Tag {
+		var tags []*types.Tag
+		for i := range n {
+			tags = append(tags, &types.Tag{Key: aws.String(fmt.Sprintf("tag-%d", i)), Value: aws.String("a-value")})
+		}
+		return append(tags, extra...)
+	}
+
+	status := &types.Tag{Key: aws.String("virus-scan-status"), Value: aws.String("ok")}
+	reason := &types.Tag{Key: aws.String("virus-scan-status-reason"), Value: aws.String("allow-list")}
+
+	testcases := map[string]struct {
+		existing []*types.Tag
+		written  []*types.Tag
+	}{
+		"room for reason": {
+			existing: tags(8),
+			written:  tags(8, status, reason),
+		},
+		"no room for reason": {
+			existing: tags(9),
+			written:  tags(9, status),
+		},
+		"no room after status": {
+			existing: tags(9, &types.Tag{Key: aws.String("virus-scan-status"), Value: aws.String("pending")}),
+			written:  tags(9, status),
+		},
+		"reason already tagged": {
+			existing: tags(8, &types.Tag{Key: aws.String("virus-scan-status"), Value: aws.String("pending")}, &types.Tag{Key: aws.String("virus-scan-status-reason"), Value: aws.String("engine")}),
+			written:  tags(8, status, reason),
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			mockS3 := new(mockS3Tagger)
+			mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return(tc.existing, nil)
+			mockS3.On("PutObjectTagging", "my-bucket", "file-key", tc.written).Return(nil)
+
+			writer := &TagWriter{Tagger: mockS3}
+			err := writer.WriteResult(context.Background(), "virus-scan-status", Result{
+				Object:  testObject(),
+				Status:  "ok",
+				Verdict: Verdict{Clean: true, Reason: ReasonAllowList},
+			})
+			assert.Nil(t, err)
+
+			mock.AssertExpectationsForObjects(t, mockS3)
+		})
+	}
+}
+
+func TestSidecarWriter(t *testing.T) {
+	uploader := &mockUploader{}
+	uploader.On("PutObject", "my-bucket", "scan-results/file-key.json",
+		`{"bucket":"my-bucket","key":"file-key","versionId":"v1","field":"virus-scan-status","status":"infected","clean":false,"signature":"Eicar-Signature","reason":"engine","scannedAt":"2024-01-02T03:04:05Z","infectedMembers":[{"path":"evidence/a.pdf","signature":"Eicar-Signature"}]}`).
+		Return(nil)
+
+	w := &SidecarWriter{
+		Uploader: uploader,
+		Prefix:   "scan-results/",
+		Now:      func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+
+	err := w.WriteResult(context.Background(), "virus-scan-status", Result{
+		Object:  Object{Bucket: "my-bucket", Key: "file-key", VersionID: "v1"},
+		Verdict: Verdict{Signature: "Eicar-Signature", Reason: ReasonEngine},
+		Status:  "infected",
+
+		InfectedMembers: []InfectedMember{{Path: "evidence/a.pdf", Signature: "Eicar-Signature"}},
+	})
+	assert.Nil(t, err)
+
+	written, _ := w.WrittenByWriter(context.Background(), "virus-scan-status", Object{Key: "scan-results/file-key.json"})
+	assert.True(t, written)
+
+	written, _ = w.WrittenByWriter(context.Background(), "virus-scan-status", Object{Key: "file-key"})
+	assert.False(t, written)
+
+	mock.AssertExpectationsForObjects(t, uploader)
+}
+
+func TestMetadataWriter(t *testing.T) {
+	copier := &mockCopier{}
+	copier.On("HeadObject", "my-bucket", "a file").Return(&s3.HeadObjectOutput{
+		ContentType: aws.String("application/pdf"),
+		Metadata:    map[string]string{"uploaded-by": "someone"},
+	}, nil)
+	copier.On("CopyObject", &s3.CopyObjectInput{
+		Bucket:               aws.String("my-bucket"),
+		Key:                  aws.String("a file"),
+		CopySource:           aws.String("my-bucket/a%20file?versionId=v1"),
+		ContentType:          aws.String("application/pdf"),
+		Metadata:             map[string]string{"uploaded-by": "someone", "virus-scan-status": "ok", "virus-scan-status-reason": "allow-list"},
+		MetadataDirective:    types.MetadataDirectiveReplace,
+		TaggingDirective:     types.TaggingDirectiveCopy,
+		ServerSideEncryption: types.ServerSideEncryptionAes256,
+	}).Return(nil)
+
+	w := &MetadataWriter{Copier: copier}
+
+	err := w.WriteResult(context.Background(), "Virus-Scan-Status", Result{
+		Object:  Object{Bucket: "my-bucket", Key: "a file", VersionID: "v1"},
+		Verdict: Verdict{Clean: true, Reason: ReasonAllowList},
+		Status:  "ok",
+	})
+	assert.Nil(t, err)
+
+	mock.AssertExpectationsForObjects(t, copier)
+}
+
+func TestMetadataWriterWhenSuperseded(t *testing.T) {
+	copier := &mockCopier{}
+	copier.On("HeadObject", "my-bucket", "file-key").Return(&s3.HeadObjectOutput{}, nil)
+	copier.On("CopyObject", mock.MatchedBy(func(input *s3.CopyObjectInput) bool {
+		return aws.ToString(input.CopySourceIfMatch) == `"scanned"`
+	})).Return(&awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusPreconditionFailed}},
+		Err:      errors.New("precondition failed"),
+	}})
+
+	w := &MetadataWriter{Copier: copier}
+
+	err := w.WriteResult(context.Background(), "virus-scan-status", Result{
+		Object: Object{Bucket: "my-bucket", Key: "file-key", ETag: `"scanned"`},
+		Status: "ok",
+	})
+	assert.Nil(t, err)
+
+	mock.AssertExpectationsForObjects(t, copier)
+}
+
+func TestMetadataWriterWhenResultAlreadyWritten(t *testing.T) {
+	copier := &mockCopier{}
+	copier.On("HeadObject", "my-bucket", "a file").Return(&s3.HeadObjectOutput{
+		Metadata: map[string]string{"virus-scan-status": "ok", "virus-scan-status-reason": "allow-list"},
+	}, nil)
+
+	w := &MetadataWriter{Copier: copier}
+
+	err := w.WriteResult(context.Background(), "Virus-Scan-Status", Result{
+		Object:  Object{Bucket: "my-bucket", Key: "a file", VersionID: "v2"},
+		Verdict: Verdict{Clean: true, Reason: ReasonAllowList},
+		Status:  "ok",
+	})
+	assert.Nil(t, err)
+
+	mock.AssertExpectationsForObjects(t, copier)
+}
+
+func TestScanIgnoresMetadataSetByUploader(t *testing.T) {
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader("file content")),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(Verdict{Signature: "Eicar-Signature"}, nil)
+
+	copier := &mockCopier{}
+	copier.On("HeadObject", "my-bucket", "file-key").Return(&s3.HeadObjectOutput{
+		Metadata: map[string]string{"virus-scan-status": "ok"},
+	}, nil)
+	copier.On("CopyObject", mock.MatchedBy(func(input *s3.CopyObjectInput) bool {
+		return input.Metadata["virus-scan-status"] == "infected"
+	})).Return(nil)
+
+	p := New(downloader, new(mockS3Tagger), scanner,
+		WithTempDir(t.TempDir()),
+		WithResultWriter(ResultWriterMetadata, &MetadataWriter{Copier: copier}),
+		WithDefaultResultWriter(ResultWriterMetadata),
+	)
+
+	result, err := p.Scan(context.Background(), testObject())
+
+	assert.Nil(t, err)
+	assert.False(t, result.Skipped)
+	assert.Equal(t, "infected", result.Status)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, copier)
+}
+
+func TestScanSkipsObjectsWrittenByResultWriter(t *testing.T) {
+	downloader := new(mockDownloader)
+	scanner := new(mockScanner)
+	mockS3 := new(mockS3Tagger)
+
+	p := New(downloader, mockS3, scanner,
+		WithResultWriter(ResultWriterSidecar, &SidecarWriter{Prefix: "scan-results/"}),
+		WithDefaultResultWriter(ResultWriterSidecar),
+	)
+
+	obj := Object{Bucket: "my-bucket", Key: "scan-results/file-key.json"}
+	result, err := p.Scan(context.Background(), obj)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Object: obj, Skipped: true}, result)
+
+	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
+}
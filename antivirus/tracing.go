@@ -0,0 +1,20 @@
+package antivirus
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer uses the global tracer provider, so spans are only exported when the
+// program embedding the pipeline has installed one.
+var tracer = otel.Tracer("github.com/ministryofjustice/opg-s3-antivirus/antivirus")
+
+func objectAttributes(obj Object) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("aws.s3.bucket", obj.Bucket),
+		attribute.String("aws.s3.key", obj.Key),
+		attribute.String("aws.s3.version_id", obj.VersionID),
+		attribute.Int64("aws.s3.object.size", obj.Size),
+	)
+}
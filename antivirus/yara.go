@@ -0,0 +1,79 @@
+package antivirus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// DefaultYaraCommand is the yara binary run when YaraScanner.Command is empty.
+const DefaultYaraCommand = "yara"
+
+// YaraScanner scans files by matching them against YARA rules with the yara
+// command line tool. A file matching any rule is infected, with the first rule
+// that matched as its signature.
+type YaraScanner struct {
+	// RulesFile holds the rules, in source form.
+	RulesFile string
+	// Command is the yara binary, when empty DefaultYaraCommand is found on
+	// the PATH.
+	Command string
+}
+
+func (s *YaraScanner) command() string {
+	if s.Command == "" {
+		return DefaultYaraCommand
+	}
+
+	return s.Command
+}
+
+// StartDaemon checks that yara and the rules file can be found, as yara runs
+// for each scan.
+func (s *YaraScanner) StartDaemon() error {
+	if _, err := exec.LookPath(s.command()); err != nil {
+		return fmt.Errorf("%w: %w", ErrEngineUnavailable, err)
+	}
+
+	if _, err := os.Stat(s.RulesFile); err != nil {
+		return fmt.Errorf("failed to read yara rules: %w", err)
+	}
+
+	return nil
+}
+
+func (s *YaraScanner) ScanFile(ctx context.Context, path string) (Verdict, error) {
+	cmd := exec.CommandContext(ctx, s.command(), "--no-warnings", s.RulesFile, path) //nolint:gosec // rules file is set by infra, path is generated by the pipeline
+
+	var output, errOutput bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &errOutput
+
+	if err := cmd.Run(); err != nil {
+		return Verdict{}, fmt.Errorf("failed to scan file with yara, %w: %s", err, strings.TrimSpace(errOutput.String()))
+	}
+
+	if rule := parseYaraMatch(&output); rule != "" {
+		return Verdict{Signature: rule}, nil
+	}
+
+	return Verdict{Clean: true}, nil
+}
+
+// parseYaraMatch finds the first rule in yara output lines of the form
+// "Eicar_Test_File /tmp/file123".
+func parseYaraMatch(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if rule, _, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " "); ok {
+			return rule
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,51 @@
+package antivirus
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseYaraMatch(t *testing.T) {
+	assert.Equal(t, "Eicar_Test_File", parseYaraMatch(strings.NewReader("Eicar_Test_File /tmp/file123\nOther_Rule /tmp/file123\n")))
+	assert.Equal(t, "", parseYaraMatch(strings.NewReader("")))
+}
+
+// fakeYara writes a script that prints output in place of yara.
+func fakeYara(t *testing.T, output string) string {
+	command := filepath.Join(t.TempDir(), "yara")
+	script := "#!/bin/sh\nprintf '" + output + "'\n"
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil { //nolint:gosec // test script must be executable
+		t.Fatal(err)
+	}
+
+	return command
+}
+
+func TestYaraScanner(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.yar")
+	_ = os.WriteFile(rules, []byte("rule Eicar { condition: true }\n"), 0600)
+
+	infected := &YaraScanner{RulesFile: rules, Command: fakeYara(t, "Eicar /tmp/file\\n")}
+	assert.Nil(t, infected.StartDaemon())
+
+	verdict, err := infected.ScanFile(context.Background(), "/tmp/file")
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{Signature: "Eicar"}, verdict)
+
+	clean := &YaraScanner{RulesFile: rules, Command: fakeYara(t, "")}
+
+	verdict, err = clean.ScanFile(context.Background(), "/tmp/file")
+	assert.Nil(t, err)
+	assert.Equal(t, Verdict{Clean: true}, verdict)
+
+	missing := &YaraScanner{RulesFile: rules, Command: filepath.Join(t.TempDir(), "yara")}
+	assert.ErrorIs(t, missing.StartDaemon(), ErrEngineUnavailable)
+
+	noRules := &YaraScanner{RulesFile: filepath.Join(t.TempDir(), "rules.yar"), Command: infected.Command}
+	assert.ErrorContains(t, noRules.StartDaemon(), "failed to read yara rules")
+}
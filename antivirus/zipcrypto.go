@@ -0,0 +1,278 @@
+package antivirus
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1" //nolint:gosec // WinZip AES is defined with SHA-1
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// ErrWrongPassword is returned when an encrypted zip member cannot be
+// decrypted with the password given.
+var ErrWrongPassword = errors.New("wrong password for encrypted archive")
+
+const (
+	zipFlagEncrypted = 0x1
+	zipFlagDataDesc  = 0x8
+	zipMethodAES     = 99
+	zipExtraAES      = 0x9901
+)
+
+// isEncrypted reports whether a zip member is encrypted.
+func isEncrypted(file *zip.File) bool {
+	return file.Flags&zipFlagEncrypted != 0
+}
+
+// openEncrypted decrypts and decompresses a zip member encrypted with either
+// traditional PKWARE encryption or WinZip AES. The content is checked against
+// the member's CRC or authentication code once it has all been read.
+func openEncrypted(file *zip.File, password string) (io.ReadCloser, error) {
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	method := file.Method
+	var plain io.Reader
+	checkCRC := true
+
+	if method == zipMethodAES {
+		var strength byte
+		method, strength, checkCRC, err = aesExtra(file.Extra)
+		if err != nil {
+			return nil, err
+		}
+
+		plain, err = newAESReader(raw, int64(file.CompressedSize64), strength, password) //nolint:gosec // sizes over MaxInt64 fail to read
+	} else {
+		check := byte(file.CRC32 >> 24)
+		if file.Flags&zipFlagDataDesc != 0 {
+			check = byte(file.ModifiedTime >> 8)
+		}
+
+		plain, err = newZipCryptoReader(raw, check, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content io.ReadCloser
+	switch method {
+	case zip.Store:
+		content = io.NopCloser(plain)
+	case zip.Deflate:
+		content = flate.NewReader(plain)
+	default:
+		return nil, fmt.Errorf("encrypted member %s: %w", file.Name, zip.ErrAlgorithm)
+	}
+
+	if !checkCRC {
+		return content, nil
+	}
+
+	return &crcReader{r: content, hash: crc32.NewIEEE(), want: file.CRC32}, nil
+}
+
+// aesExtra reads the WinZip AES extra field, returning the compression method
+// of the plain content, the key strength and whether the CRC is set.
+func aesExtra(extra []byte) (method uint16, strength byte, checkCRC bool, err error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+
+		if id == zipExtraAES && size >= 7 {
+			field := extra[4 : 4+size]
+			version := binary.LittleEndian.Uint16(field)
+			return binary.LittleEndian.Uint16(field[5:]), field[4], version == 1, nil
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return 0, 0, false, errors.New("encrypted member has no AES extra field")
+}
+
+// newZipCryptoReader decrypts traditional PKWARE encryption, checking the last
+// byte of the encryption header against check.
+func newZipCryptoReader(r io.Reader, check byte, password string) (io.Reader, error) {
+	keys := zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for _, b := range []byte(password) {
+		keys.update(b)
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	keys.decrypt(header)
+
+	if header[11] != check {
+		return nil, ErrWrongPassword
+	}
+
+	return &zipCryptoReader{r: r, keys: &keys}, nil
+}
+
+type zipCryptoKeys [3]uint32
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+func (k *zipCryptoKeys) decrypt(p []byte) {
+	for i := range p {
+		temp := k[2] | 2
+		p[i] ^= byte((temp * (temp ^ 1)) >> 8)
+		k.update(p[i])
+	}
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	z.keys.decrypt(p[:n])
+	return n, err
+}
+
+// newAESReader decrypts WinZip AES encryption. The authentication code at the
+// end of the data is checked when the last byte has been read.
+func newAESReader(r io.Reader, size int64, strength byte, password string) (io.Reader, error) {
+	var keyLen int
+	switch strength {
+	case 1:
+		keyLen = 16
+	case 2:
+		keyLen = 24
+	case 3:
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("encrypted member has unknown AES strength %d", strength)
+	}
+
+	saltLen := keyLen / 2
+	const verifierLen, authLen = 2, 10
+
+	dataLen := size - int64(saltLen) - verifierLen - authLen
+	if dataLen < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	header := make([]byte, saltLen+verifierLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	keys, err := pbkdf2.Key(sha1.New, password, header[:saltLen], 1000, 2*keyLen+verifierLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(keys[2*keyLen:], header[saltLen:]) {
+		return nil, ErrWrongPassword
+	}
+
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesReader{
+		r:      io.LimitReader(r, dataLen),
+		auth:   r,
+		block:  block,
+		mac:    hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+		stream: make([]byte, aes.BlockSize),
+		used:   aes.BlockSize,
+	}, nil
+}
+
+// aesReader is AES in counter mode with the little endian counter, starting
+// at 1, that WinZip uses.
+type aesReader struct {
+	r       io.Reader
+	auth    io.Reader
+	block   cipher.Block
+	mac     hash.Hash
+	counter [aes.BlockSize]byte
+	stream  []byte
+	used    int
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	a.mac.Write(p[:n]) //nolint:errcheck // hash writes do not fail
+
+	for i := range p[:n] {
+		if a.used == aes.BlockSize {
+			a.next()
+		}
+		p[i] ^= a.stream[a.used]
+		a.used++
+	}
+
+	if errors.Is(err, io.EOF) {
+		code := make([]byte, 10)
+		if _, err := io.ReadFull(a.auth, code); err != nil {
+			return n, err
+		}
+		if !hmac.Equal(a.mac.Sum(nil)[:10], code) {
+			return n, ErrWrongPassword
+		}
+	}
+
+	return n, err
+}
+
+func (a *aesReader) next() {
+	for i := range a.counter {
+		a.counter[i]++
+		if a.counter[i] != 0 {
+			break
+		}
+	}
+
+	a.block.Encrypt(a.stream, a.counter[:])
+	a.used = 0
+}
+
+// crcReader fails with ErrWrongPassword when the content read does not match
+// the CRC, as the encryption header only catches most wrong passwords.
+type crcReader struct {
+	r    io.ReadCloser
+	hash hash.Hash32
+	want uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n]) //nolint:errcheck // hash writes do not fail
+
+	if errors.Is(err, io.EOF) && c.hash.Sum32() != c.want {
+		return n, ErrWrongPassword
+	}
+
+	return n, err
+}
+
+func (c *crcReader) Close() error {
+	return c.r.Close()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Clamscan test-loads signature databases with the ClamAV engine, so that a
+// file clamd would refuse to start with is never published.
+type Clamscan struct{}
+
+func (c *Clamscan) Check(path string) error {
+	// clamscan needs something to scan once the database has loaded, an empty
+	// file next to it will do.
+	empty, err := os.CreateTemp(filepath.Dir(path), ".empty-")
+	if err != nil {
+		return err
+	}
+	_ = empty.Close()
+	defer os.Remove(empty.Name()) //nolint:errcheck // file is temporary
+
+	cmd := exec.Command("clamscan", "--database="+path, "--no-summary", "--infected", empty.Name()) //nolint:gosec // path is in a directory created by the lambda
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		// 1 means the empty file matched, which still means the database
+		// loaded.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
-	"os"
+	"bytes"
+	"fmt"
+	"log/slog"
 	"os/exec"
+	"strings"
 )
 
-type Freshclam struct{}
+type Freshclam struct {
+	ConfigFile string
+}
 
 func (c *Freshclam) Update() error {
-	cmd := exec.Command("freshclam", "--config-file=/etc/freshclam.conf")
+	cmd := exec.Command("freshclam", "--config-file="+c.ConfigFile) //nolint:gosec // config file is validated at start up
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(output.String()))
+	}
 
-	return cmd.Run()
+	slog.Debug("freshclam finished", slog.String("output", strings.TrimSpace(output.String())))
+	return nil
 }
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreshclamUpdateWhenFails(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"ERROR: Can't open /var/log/freshclam.log in append mode\" >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(bin, "freshclam"), []byte(script), 0700); err != nil { //nolint:gosec // test script must be executable
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	err := (&Freshclam{ConfigFile: "freshclam.conf"}).Update()
+	assert.Equal(t, "exit status 1: ERROR: Can't open /var/log/freshclam.log in append mode", err.Error())
+}
@@ -1,17 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/config"
+	"github.com/ministryofjustice/opg-s3-antivirus/cvd"
+	"github.com/ministryofjustice/opg-s3-antivirus/logging"
+	"github.com/ministryofjustice/opg-s3-antivirus/metrics"
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/aws/aws-lambda-go/lambda"
 )
@@ -20,64 +35,208 @@ type Updater interface {
 	Update() error
 }
 
+type SignatureChecker interface {
+	Check(path string) error
+}
+
 type Event struct{}
 
 type Response struct {
 	Message string `json:"message"`
+	// Changed lists the files published by the run.
+	Changed []ChangedFile `json:"changed,omitempty"`
+	// Rejected lists the custom signature files that failed to load, the
+	// previously published copy of each is kept.
+	Rejected []string `json:"rejected,omitempty"`
+}
+
+// ChangedFile describes a definitions file that freshclam changed. Versions
+// are only set for databases, OldVersion is 0 for a new file and Removed is
+// set for a file that is no longer in the set.
+type ChangedFile struct {
+	Name       string `json:"name"`
+	OldVersion int    `json:"oldVersion,omitempty"`
+	NewVersion int    `json:"newVersion,omitempty"`
+	Removed    bool   `json:"removed,omitempty"`
 }
 
 type StorageClient interface {
 	GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
 type Lambda struct {
-	bucket          string
-	definitionDir   string
-	definitionFiles []string
-	storageClient   StorageClient
-	freshclam       Updater
+	bucket        string
+	definitionDir string
+	storageClient StorageClient
+	freshclam     Updater
+	metrics       *metrics.Emitter
+	now           func() time.Time
+
+	signaturesBucket string
+	signaturesPrefix string
+	signatureChecker SignatureChecker
 }
 
-func (l *Lambda) downloadDefinitions(ctx context.Context) error {
+var tracer = otel.Tracer("github.com/ministryofjustice/opg-s3-antivirus/cmd/opg-s3-antivirus-update")
+
+func (l *Lambda) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("aws.s3.bucket", l.bucket),
+	))
+}
+
+// downloadDefinitions fetches the current definitions set into the
+// definitions directory, returning its manifest with the key of every file
+// filled in. Nothing is returned when no set has been published yet.
+func (l *Lambda) downloadDefinitions(ctx context.Context) (published cvd.Manifest, err error) {
+	ctx, span := l.startSpan(ctx, "download_definitions")
+	defer func() { tracing.End(span, err) }()
+
 	if err := os.Mkdir(l.definitionDir, 0750); err != nil && !os.IsExist(err) {
-		return err
+		return cvd.Manifest{}, err
 	}
 
-	for _, key := range l.definitionFiles {
+	pointer, err := l.currentPointer(ctx)
+	if err != nil {
+		var nske *types.NoSuchKey
+		if errors.As(err, &nske) {
+			return cvd.Manifest{}, nil
+		}
+		return cvd.Manifest{}, err
+	}
+
+	published, err = l.getManifest(ctx, pointer.Prefix+cvd.ManifestName)
+	if err != nil {
+		return cvd.Manifest{}, err
+	}
+
+	for name, entry := range published.Files {
+		entry.Key = published.Key(pointer.Prefix, name)
+		published.Files[name] = entry
+	}
+
+	for _, key := range published.Names() {
 		input := &s3.GetObjectInput{
 			Bucket: aws.String(l.bucket),
-			Key:    aws.String(key),
+			Key:    aws.String(published.Key(pointer.Prefix, key)),
 		}
 
 		output, err := l.storageClient.GetObject(ctx, input)
 		if err != nil {
-			var nske *types.NoSuchKey
-			if errors.As(err, &nske) {
-				return nil
-			}
-			return err
+			return cvd.Manifest{}, err
 		}
 
 		file, err := os.Create(filepath.Join(l.definitionDir, key)) //nolint:gosec // variables are fixed so inclusion is not risky
 		if err != nil {
-			return err
+			return cvd.Manifest{}, err
 		}
 
 		if _, err := io.Copy(file, output.Body); err != nil {
 			_ = file.Close()
-			return err
+			return cvd.Manifest{}, err
 		}
 
 		_ = output.Body.Close()
 		_ = file.Close()
 	}
 
-	return nil
+	return published, nil
 }
 
-func (l *Lambda) uploadDefinitions(ctx context.Context) error {
-	for _, key := range l.definitionFiles {
+func (l *Lambda) getManifest(ctx context.Context, key string) (cvd.Manifest, error) {
+	output, err := l.storageClient.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return cvd.Manifest{}, err
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	b, err := io.ReadAll(output.Body)
+	if err != nil {
+		return cvd.Manifest{}, err
+	}
+
+	return cvd.ParseManifest(b)
+}
+
+// hashDefinitions describes the definition files currently in the
+// definitions directory.
+func (l *Lambda) hashDefinitions() (cvd.Manifest, error) {
+	names, err := cvd.ListDefinitions(l.definitionDir)
+	if err != nil {
+		return cvd.Manifest{}, err
+	}
+
+	return cvd.BuildManifest(l.definitionDir, names)
+}
+
+func (l *Lambda) currentPointer(ctx context.Context) (cvd.Pointer, error) {
+	output, err := l.storageClient.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(cvd.PointerName),
+	})
+	if err != nil {
+		return cvd.Pointer{}, err
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	b, err := io.ReadAll(output.Body)
+	if err != nil {
+		return cvd.Pointer{}, err
+	}
+
+	return cvd.ParsePointer(b)
+}
+
+// uploadDefinitions publishes the definitions described by manifest as a new
+// set under a versioned prefix, then moves the pointer to it. Only the changed
+// files are uploaded, the others are copied within the bucket from the
+// published set, so that every set holds all of its files and earlier sets can
+// be removed. Removed files are left out.
+func (l *Lambda) uploadDefinitions(ctx context.Context, manifest, published cvd.Manifest, changed []ChangedFile) (err error) {
+	ctx, span := l.startSpan(ctx, "upload_definitions")
+	defer func() { tracing.End(span, err) }()
+
+	pointer := cvd.NewPointer(l.now().UTC().Format("20060102T150405Z"))
+	span.SetAttributes(attribute.String("antivirus.definitions_set", pointer.Version))
+
+	upload := map[string]bool{}
+	for _, change := range changed {
+		upload[change.Name] = !change.Removed
+	}
+
+	for _, name := range manifest.Names() {
+		if upload[name] {
+			continue
+		}
+
+		input := &s3.CopyObjectInput{
+			Bucket:               aws.String(l.bucket),
+			Key:                  aws.String(pointer.Prefix + name),
+			CopySource:           aws.String(l.bucket + "/" + published.Files[name].Key),
+			ServerSideEncryption: types.ServerSideEncryptionAes256,
+		}
+
+		if _, err := l.storageClient.CopyObject(ctx, input); err != nil {
+			return err
+		}
+
+		entry := manifest.Files[name]
+		entry.Key = pointer.Prefix + name
+		manifest.Files[name] = entry
+	}
+
+	for _, change := range changed {
+		if change.Removed {
+			continue
+		}
+		key := change.Name
+
 		file, err := os.Open(filepath.Join(l.definitionDir, key)) //nolint:gosec // variables are fixed so inclusion is not risky
 		if err != nil {
 			return err
@@ -85,7 +244,7 @@ func (l *Lambda) uploadDefinitions(ctx context.Context) error {
 
 		input := &s3.PutObjectInput{
 			Bucket:               aws.String(l.bucket),
-			Key:                  aws.String(key),
+			Key:                  aws.String(pointer.Prefix + key),
 			Body:                 file,
 			ServerSideEncryption: types.ServerSideEncryptionAes256,
 		}
@@ -96,61 +255,360 @@ func (l *Lambda) uploadDefinitions(ctx context.Context) error {
 		}
 
 		_ = file.Close()
+
+		entry := manifest.Files[key]
+		entry.Key = pointer.Prefix + key
+		manifest.Files[key] = entry
+	}
+
+	if err := l.putJSON(ctx, pointer.Prefix+cvd.ManifestName, manifest); err != nil {
+		return err
+	}
+
+	// The pointer is written last, so scanners keep loading the previous set
+	// until this one is complete.
+	if err := l.putJSON(ctx, cvd.PointerName, pointer); err != nil {
+		return err
 	}
 
+	slog.InfoContext(ctx, "published definitions", slog.String("definitionsSet", pointer.Version))
 	return nil
 }
 
+func (l *Lambda) putJSON(ctx context.Context, key string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.storageClient.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(l.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(body),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: types.ServerSideEncryptionAes256,
+	})
+
+	return err
+}
+
+// syncCustomSignatures copies the custom signature files in the signatures
+// bucket into the definitions directory, so they are published with the
+// official definitions. Each file is test-loaded first and one that fails is
+// left out, keeping the copy already in the directory. Files that are no longer
+// in the signatures bucket are removed.
+func (l *Lambda) syncCustomSignatures(ctx context.Context) (rejected []string, err error) {
+	ctx, span := tracer.Start(ctx, "sync_custom_signatures", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", l.signaturesBucket),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	keys, err := l.listCustomSignatures(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(l.definitionDir), ".signatures-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging) //nolint:errcheck // staging dir is temporary
+
+	for name, key := range keys {
+		path := filepath.Join(staging, name)
+		if err := l.downloadFile(ctx, l.signaturesBucket, key, path); err != nil {
+			return nil, err
+		}
+
+		if err := l.signatureChecker.Check(path); err != nil {
+			slog.ErrorContext(ctx, "custom signatures failed to load", slog.String("key", key), slog.Any("error", err))
+			rejected = append(rejected, name)
+			continue
+		}
+
+		if err := os.Rename(path, filepath.Join(l.definitionDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(rejected)
+
+	names, err := cvd.ListDefinitions(l.definitionDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if _, ok := keys[name]; ok || !cvd.IsCustomSignature(name) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(l.definitionDir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return rejected, nil
+}
+
+// listCustomSignatures returns the key of each custom signature file directly
+// under the signatures prefix, keyed by file name.
+func (l *Lambda) listCustomSignatures(ctx context.Context) (map[string]string, error) {
+	keys := map[string]string{}
+	if l.signaturesBucket == "" {
+		return keys, nil
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(l.storageClient, &s3.ListObjectsV2Input{
+		Bucket: aws.String(l.signaturesBucket),
+		Prefix: aws.String(l.signaturesPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			name := strings.TrimPrefix(key, l.signaturesPrefix)
+			if strings.Contains(name, "/") || !cvd.IsCustomSignature(name) {
+				continue
+			}
+
+			keys[name] = key
+		}
+	}
+
+	return keys, nil
+}
+
+func (l *Lambda) downloadFile(ctx context.Context, bucket, key, path string) error {
+	output, err := l.storageClient.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	file, err := os.Create(path) //nolint:gosec // path is in a directory created by the lambda
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, output.Body); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (l *Lambda) runFreshclam(ctx context.Context) (err error) {
+	_, span := tracer.Start(ctx, "freshclam")
+	defer func() { tracing.End(span, err) }()
+
+	return l.freshclam.Update()
+}
+
+// definitionVersions reads the version of each database in the definitions
+// directory, keyed by database name.
+func (l *Lambda) definitionVersions(ctx context.Context) map[string]int {
+	headers, err := cvd.ReadDir(l.definitionDir)
+	if err != nil {
+		slog.WarnContext(ctx, "reading definition versions failed", slog.Any("error", err))
+		return nil
+	}
+
+	versions := make(map[string]int, len(headers))
+	for name, header := range headers {
+		versions[strings.TrimSuffix(name, filepath.Ext(name))] = header.Version
+	}
+
+	return versions
+}
+
+func (l *Lambda) emitMetrics(ctx context.Context, duration time.Duration, failed, changed bool, versions map[string]int) {
+	if l.metrics == nil {
+		return
+	}
+
+	err := l.metrics.Emit(map[string]string{"Bucket": l.bucket}, metrics.MetricSet{
+		Dimensions: []string{"Bucket"},
+		Metrics: []metrics.Metric{
+			{Name: "DefinitionsChanged", Unit: metrics.Count, Value: count(changed)},
+			{Name: "FreshclamFailures", Unit: metrics.Count, Value: count(failed)},
+			{Name: "FreshclamDuration", Unit: metrics.Milliseconds, Value: float64(duration.Milliseconds())},
+		},
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "emitting metrics failed", slog.Any("error", err))
+	}
+
+	for database, version := range versions {
+		err := l.metrics.Emit(map[string]string{"Bucket": l.bucket, "Database": database}, metrics.MetricSet{
+			Dimensions: []string{"Bucket", "Database"},
+			Metrics:    []metrics.Metric{{Name: "DefinitionsVersion", Unit: metrics.None, Value: float64(version)}},
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "emitting metrics failed", slog.Any("error", err))
+		}
+	}
+}
+
+func count(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
 func (l *Lambda) HandleEvent(ctx context.Context, event Event) (Response, error) {
-	log.Print("downloading previous definitions")
-	if err := l.downloadDefinitions(ctx); err != nil {
-		log.Printf("download definitions: %v", err)
+	ctx = logging.With(ctx, slog.String("bucket", l.bucket))
+
+	slog.InfoContext(ctx, "downloading previous definitions")
+	published, err := l.downloadDefinitions(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "download definitions failed", slog.Any("error", err))
+		return Response{}, err
+	}
+
+	beforeFiles, err := l.hashDefinitions()
+	if err != nil {
+		slog.ErrorContext(ctx, "hashing definitions failed", slog.Any("error", err))
+		return Response{}, err
+	}
+
+	before := l.definitionVersions(ctx)
+
+	slog.InfoContext(ctx, "running freshclam")
+	start := time.Now()
+	if err := l.runFreshclam(ctx); err != nil {
+		duration := time.Since(start)
+		slog.ErrorContext(ctx, "freshclam update failed", slog.Any("error", err), slog.Int64("durationMs", duration.Milliseconds()))
+		l.emitMetrics(ctx, duration, true, false, before)
+		return Response{}, err
+	}
+	duration := time.Since(start)
+
+	after := l.definitionVersions(ctx)
+	changed := !maps.Equal(before, after)
+	slog.InfoContext(ctx, "freshclam finished", slog.Int64("durationMs", duration.Milliseconds()), slog.Bool("changed", changed))
+	l.emitMetrics(ctx, duration, false, changed, after)
+
+	rejected, err := l.syncCustomSignatures(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "syncing custom signatures failed", slog.Any("error", err))
 		return Response{}, err
 	}
 
-	log.Print("running freshclam")
-	if err := l.freshclam.Update(); err != nil {
-		log.Printf("freshclam update: %v", err)
+	afterFiles, err := l.hashDefinitions()
+	if err != nil {
+		slog.ErrorContext(ctx, "hashing definitions failed", slog.Any("error", err))
 		return Response{}, err
 	}
 
-	log.Print("uploading previous definitions")
-	if err := l.uploadDefinitions(ctx); err != nil {
-		log.Printf("upload definitions: %v", err)
+	changedFiles := changedDefinitions(published, beforeFiles, afterFiles)
+
+	if len(changedFiles) == 0 {
+		slog.InfoContext(ctx, "clamav definitions unchanged")
+		return Response{Message: "clamav definitions unchanged", Rejected: rejected}, nil
+	}
+
+	slog.InfoContext(ctx, "uploading definitions", slog.Any("changed", changedFiles))
+	if err := l.uploadDefinitions(ctx, afterFiles, published, changedFiles); err != nil {
+		slog.ErrorContext(ctx, "upload definitions failed", slog.Any("error", err))
 		return Response{}, err
 	}
 
-	log.Printf("clamav definitions updated")
-	return Response{Message: "clamav definitions updated"}, nil
+	slog.InfoContext(ctx, "clamav definitions updated")
+	return Response{Message: "clamav definitions updated", Changed: changedFiles, Rejected: rejected}, nil
+}
+
+// changedDefinitions lists the files in after that differ from before or from
+// the published set, and the files in either that are no longer in after.
+func changedDefinitions(published, before, after cvd.Manifest) []ChangedFile {
+	names := slices.Concat(published.Names(), before.Names(), after.Names())
+	slices.Sort(names)
+
+	var changed []ChangedFile
+	for _, name := range slices.Compact(names) {
+		if _, ok := after.Files[name]; !ok {
+			changed = append(changed, ChangedFile{
+				Name:       name,
+				OldVersion: cmp.Or(before.Files[name].Version, published.Files[name].Version),
+				Removed:    true,
+			})
+			continue
+		}
+
+		if after.Same(before, name) && after.Same(published, name) {
+			continue
+		}
+
+		changed = append(changed, ChangedFile{
+			Name:       name,
+			OldVersion: before.Files[name].Version,
+			NewVersion: after.Files[name].Version,
+		})
+	}
+
+	return changed
 }
 
 func main() {
 	ctx := context.Background()
 
-	awsRegion := os.Getenv("AWS_REGION")
-	cfg, err := config.LoadDefaultConfig(
+	level := new(slog.LevelVar)
+	slog.SetDefault(logging.New(os.Stdout, level))
+
+	cfg, err := config.LoadUpdate()
+	if err != nil {
+		logging.Fatal("error loading config", err)
+	}
+
+	logLevel, _ := logging.ParseLevel(cfg.LogLevel)
+	level.Set(logLevel)
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(
 		ctx,
-		config.WithRegion(awsRegion),
+		awsconfig.WithRegion(cfg.AWS.Region),
 	)
 	if err != nil {
-		log.Printf("error building aws config: %v", err)
+		logging.Fatal("error building aws config", err)
+	}
+
+	if cfg.AWS.S3Endpoint != "" {
+		awsCfg.BaseEndpoint = &cfg.AWS.S3Endpoint
 	}
 
-	if endpoint, ok := os.LookupEnv("AWS_S3_ENDPOINT"); ok {
-		cfg.BaseEndpoint = &endpoint
+	var provider *tracing.Provider
+	if cfg.OTLPEndpoint != "" {
+		provider, err = tracing.Start(ctx, cfg.OTLPEndpoint, "opg-s3-antivirus-update")
+		if err != nil {
+			logging.Fatal("error starting tracing", err)
+		}
 	}
+	tracing.InstrumentAWS(&awsCfg)
 
-	s3Client := s3.NewFromConfig(cfg, func(u *s3.Options) {
+	s3Client := s3.NewFromConfig(awsCfg, func(u *s3.Options) {
 		u.UsePathStyle = true
 	})
 
 	l := &Lambda{
-		bucket:          os.Getenv("ANTIVIRUS_DEFINITIONS_BUCKET"),
-		definitionDir:   "/tmp/clamav",
-		definitionFiles: []string{"bytecode.cvd", "daily.cvd", "freshclam.dat", "main.cvd"},
-		storageClient:   s3Client,
-		freshclam:       &Freshclam{},
+		bucket:        cfg.DefinitionsBucket,
+		definitionDir: cfg.DefinitionsDir,
+		storageClient: s3Client,
+		freshclam:     &Freshclam{ConfigFile: cfg.FreshclamConfig},
+		metrics:       metrics.New(os.Stdout, cfg.MetricsNamespace),
+		now:           time.Now,
+
+		signaturesBucket: cfg.CustomSignaturesBucket,
+		signaturesPrefix: cfg.CustomSignaturesPrefix,
+		signatureChecker: &Clamscan{},
 	}
 
-	lambda.StartWithOptions(l.HandleEvent, lambda.WithContext(ctx))
+	lambda.StartWithOptions(tracing.Wrap(provider, "update", l.HandleEvent), lambda.WithContext(ctx))
 }
@@ -3,12 +3,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/cvd"
+	"github.com/ministryofjustice/opg-s3-antivirus/metrics"
 	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -35,6 +43,31 @@ func (m *mockStorageClient) PutObject(ctx context.Context, input *s3.PutObjectIn
 	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
 }
 
+func (m *mockStorageClient) CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	args := m.Called(*input.Bucket, *input.Key, *input.CopySource, input.ServerSideEncryption)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.CopyObjectOutput), args.Error(1)
+}
+
+func (m *mockStorageClient) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(*input.Bucket, *input.Prefix)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.ListObjectsV2Output), args.Error(1)
+}
+
+type mockSignatureChecker struct {
+	mock.Mock
+}
+
+func (m *mockSignatureChecker) Check(path string) error {
+	args := m.Called(filepath.Base(path))
+	return args.Error(0)
+}
+
 type mockUpdater struct {
 	mock.Mock
 }
@@ -57,41 +90,140 @@ func TestHandleEvent(t *testing.T) {
 	freshclam := &mockUpdater{}
 
 	l := &Lambda{
-		bucket:          "a-bucket",
-		definitionDir:   tempdir,
-		definitionFiles: []string{"a", "b"},
-		storageClient:   storageClient,
-		freshclam:       freshclam,
+		bucket:        "a-bucket",
+		definitionDir: tempdir,
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
 	}
 
 	storageClient.
-		On("GetObject", "a-bucket", "a").
+		On("GetObject", "a-bucket", "current.json").
+		Return(pointerOutput("20240109T120000Z"), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/manifest.json").
+		Return(manifestOutput(map[string][]byte{"freshclam.dat": []byte("hello"), "daily-27119.cdiff": []byte("there")}), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/freshclam.dat").
 		Return(&s3.GetObjectOutput{
 			Body: io.NopCloser(bytes.NewReader([]byte("hello"))),
 		}, nil)
 
 	storageClient.
-		On("GetObject", "a-bucket", "b").
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/daily-27119.cdiff").
 		Return(&s3.GetObjectOutput{
 			Body: io.NopCloser(bytes.NewReader([]byte("there"))),
 		}, nil)
 
 	freshclam.
-		On("Update").Return(nil)
+		On("Update").
+		Run(func(mock.Arguments) {
+			_ = os.WriteFile(filepath.Join(tempdir, "daily-27119.cdiff"), []byte("there!"), 0600)
+		}).
+		Return(nil)
 
 	storageClient.
-		On("PutObject", "a-bucket", "a", []byte("hello"), types.ServerSideEncryptionAes256).
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/daily-27119.cdiff", []byte("there!"), types.ServerSideEncryptionAes256).
 		Return(&s3.PutObjectOutput{}, nil)
 
 	storageClient.
-		On("PutObject", "a-bucket", "b", []byte("there"), types.ServerSideEncryptionAes256).
+		On("CopyObject", "a-bucket", "versions/20240110T120000Z/freshclam.dat", "a-bucket/versions/20240109T120000Z/freshclam.dat", types.ServerSideEncryptionAes256).
+		Return(&s3.CopyObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/manifest.json", []byte(`{"files":{"daily-27119.cdiff":{"key":"versions/20240110T120000Z/daily-27119.cdiff","sha256":"2e89e2811d801b718afaa26d8cd1a6111729ab045743b75ab58fb8898c1f0b12","size":6},"freshclam.dat":{"key":"versions/20240110T120000Z/freshclam.dat","sha256":"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824","size":5}}}`), types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "current.json", []byte(`{"version":"20240110T120000Z","prefix":"versions/20240110T120000Z/"}`), types.ServerSideEncryptionAes256).
 		Return(&s3.PutObjectOutput{}, nil)
 
 	response, err := l.HandleEvent(context.Background(), Event{})
 	assert.Nil(err)
-	assert.Equal(Response{Message: "clamav definitions updated"}, response)
+	assert.Equal(Response{
+		Message: "clamav definitions updated",
+		Changed: []ChangedFile{{Name: "daily-27119.cdiff"}},
+	}, response)
 
 	mock.AssertExpectationsForObjects(t, storageClient, freshclam)
+
+	lastCall := storageClient.Calls[len(storageClient.Calls)-1]
+	assert.Equal("current.json", lastCall.Arguments.String(1))
+}
+
+func TestHandleEventUnchanged(t *testing.T) {
+	tempdir := t.TempDir()
+
+	storageClient := &mockStorageClient{}
+	freshclam := &mockUpdater{}
+
+	l := &Lambda{
+		bucket:        "a-bucket",
+		definitionDir: tempdir,
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
+	}
+
+	storageClient.
+		On("GetObject", "a-bucket", "current.json").
+		Return(pointerOutput("20240109T120000Z"), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/manifest.json").
+		Return(manifestOutput(map[string][]byte{"freshclam.dat": []byte("hello")}), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/freshclam.dat").
+		Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader([]byte("hello"))),
+		}, nil)
+
+	freshclam.
+		On("Update").Return(nil)
+
+	response, err := l.HandleEvent(context.Background(), Event{})
+	assert.Nil(t, err)
+	assert.Equal(t, Response{Message: "clamav definitions unchanged"}, response)
+
+	mock.AssertExpectationsForObjects(t, storageClient, freshclam)
+	storageClient.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandleEventWhenPublishedSetIncomplete(t *testing.T) {
+	tempdir := t.TempDir()
+
+	storageClient := &mockStorageClient{}
+	freshclam := &mockUpdater{}
+
+	l := &Lambda{
+		bucket:        "a-bucket",
+		definitionDir: tempdir,
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
+	}
+
+	storageClient.
+		On("GetObject", "a-bucket", "current.json").
+		Return(pointerOutput("20240109T120000Z"), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/manifest.json").
+		Return(manifestOutput(map[string][]byte{"daily.cvd": []byte("there"), "freshclam.dat": []byte("hello")}), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/daily.cvd").
+		Return(nil, &types.NoSuchKey{})
+
+	_, err := l.HandleEvent(context.Background(), Event{})
+	assert.Equal(t, "NoSuchKey: ", err.Error())
+
+	mock.AssertExpectationsForObjects(t, storageClient)
+	freshclam.AssertNotCalled(t, "Update")
+	storageClient.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
 }
 
 func TestHandleEventFirstRun(t *testing.T) {
@@ -103,7 +235,7 @@ func TestHandleEventFirstRun(t *testing.T) {
 	}
 	defer os.RemoveAll(tempdir) //nolint:errcheck // no need to check OS error in this test
 
-	for _, name := range []string{"a", "b"} {
+	for _, name := range []string{"freshclam.dat", "daily-27119.cdiff"} {
 		file, err := os.Create(filepath.Join(tempdir, name)) //nolint:gosec // tempdir is a constrained variable
 		if !assert.Nil(err) {
 			return
@@ -116,31 +248,347 @@ func TestHandleEventFirstRun(t *testing.T) {
 	freshclam := &mockUpdater{}
 
 	l := &Lambda{
-		bucket:          "a-bucket",
-		definitionDir:   tempdir,
-		definitionFiles: []string{"a", "b"},
-		storageClient:   storageClient,
-		freshclam:       freshclam,
+		bucket:        "a-bucket",
+		definitionDir: tempdir,
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
 	}
 
 	storageClient.
-		On("GetObject", "a-bucket", "a").
+		On("GetObject", "a-bucket", "current.json").
 		Return(nil, &types.NoSuchKey{})
 
 	freshclam.
 		On("Update").Return(nil)
 
 	storageClient.
-		On("PutObject", "a-bucket", "a", mock.Anything, types.ServerSideEncryptionAes256).
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/freshclam.dat", mock.Anything, types.ServerSideEncryptionAes256).
 		Return(&s3.PutObjectOutput{}, nil)
 
 	storageClient.
-		On("PutObject", "a-bucket", "b", mock.Anything, types.ServerSideEncryptionAes256).
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/daily-27119.cdiff", mock.Anything, types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/manifest.json", mock.Anything, types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "current.json", mock.Anything, types.ServerSideEncryptionAes256).
 		Return(&s3.PutObjectOutput{}, nil)
 
 	response, err := l.HandleEvent(context.Background(), Event{})
 	assert.Nil(err)
-	assert.Equal(Response{Message: "clamav definitions updated"}, response)
+	assert.Equal(Response{
+		Message: "clamav definitions updated",
+		Changed: []ChangedFile{{Name: "daily-27119.cdiff"}, {Name: "freshclam.dat"}},
+	}, response)
+
+	mock.AssertExpectationsForObjects(t, storageClient, freshclam)
+}
+
+func TestHandleEventWhenDatabaseReplaced(t *testing.T) {
+	tempdir := t.TempDir()
+
+	storageClient := &mockStorageClient{}
+	freshclam := &mockUpdater{}
+
+	l := &Lambda{
+		bucket:        "a-bucket",
+		definitionDir: tempdir,
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
+	}
+
+	storageClient.
+		On("GetObject", "a-bucket", "current.json").
+		Return(pointerOutput("20240109T120000Z"), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/manifest.json").
+		Return(manifestOutput(map[string][]byte{"daily.cvd": cvdHeader("27118")}), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/daily.cvd").
+		Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader(cvdHeader("27118"))),
+		}, nil)
+
+	freshclam.
+		On("Update").
+		Run(func(mock.Arguments) {
+			_ = os.Remove(filepath.Join(tempdir, "daily.cvd"))
+			_ = os.WriteFile(filepath.Join(tempdir, "daily.cld"), cvdHeader("27119"), 0600)
+			_ = os.WriteFile(filepath.Join(tempdir, "clamd.pid"), []byte("123"), 0600)
+		}).
+		Return(nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/daily.cld", cvdHeader("27119"), types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/manifest.json", mock.Anything, types.ServerSideEncryptionAes256).
+		Run(func(args mock.Arguments) {
+			manifest, err := cvd.ParseManifest(args.Get(2).([]byte))
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"daily.cld"}, manifest.Names())
+		}).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "current.json", mock.Anything, types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	response, err := l.HandleEvent(context.Background(), Event{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ChangedFile{
+		{Name: "daily.cld", NewVersion: 27119},
+		{Name: "daily.cvd", OldVersion: 27118, Removed: true},
+	}, response.Changed)
+
+	mock.AssertExpectationsForObjects(t, storageClient, freshclam)
+}
+
+func TestHandleEventSyncsCustomSignatures(t *testing.T) {
+	tempdir := t.TempDir()
+
+	storageClient := &mockStorageClient{}
+	freshclam := &mockUpdater{}
+	checker := &mockSignatureChecker{}
+
+	l := &Lambda{
+		bucket:        "a-bucket",
+		definitionDir: tempdir,
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
+
+		signaturesBucket: "signatures-bucket",
+		signaturesPrefix: "clamav/",
+		signatureChecker: checker,
+	}
+
+	storageClient.
+		On("GetObject", "a-bucket", "current.json").
+		Return(pointerOutput("20240109T120000Z"), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/manifest.json").
+		Return(manifestOutput(map[string][]byte{
+			"freshclam.dat": []byte("hello"),
+			"opg.yar":       []byte("rule v1"),
+			"retired.hdb":   []byte("old hashes"),
+		}), nil)
+
+	for name, body := range map[string]string{"freshclam.dat": "hello", "opg.yar": "rule v1", "retired.hdb": "old hashes"} {
+		storageClient.
+			On("GetObject", "a-bucket", "versions/20240109T120000Z/"+name).
+			Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader([]byte(body)))}, nil)
+	}
+
+	freshclam.
+		On("Update").Return(nil)
+
+	storageClient.
+		On("ListObjectsV2", "signatures-bucket", "clamav/").
+		Return(&s3.ListObjectsV2Output{Contents: []types.Object{
+			{Key: aws.String("clamav/opg.ndb")},
+			{Key: aws.String("clamav/opg.yar")},
+			{Key: aws.String("clamav/drafts/wip.ndb")},
+			{Key: aws.String("clamav/README.md")},
+		}}, nil)
+
+	storageClient.
+		On("GetObject", "signatures-bucket", "clamav/opg.ndb").
+		Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader([]byte("opg:0:*:deadbeef")))}, nil)
+
+	storageClient.
+		On("GetObject", "signatures-bucket", "clamav/opg.yar").
+		Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader([]byte("rule v2 {")))}, nil)
+
+	checker.
+		On("Check", "opg.ndb").Return(nil)
+
+	checker.
+		On("Check", "opg.yar").Return(errors.New("syntax error"))
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/opg.ndb", []byte("opg:0:*:deadbeef"), types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	for _, name := range []string{"freshclam.dat", "opg.yar"} {
+		storageClient.
+			On("CopyObject", "a-bucket", "versions/20240110T120000Z/"+name, "a-bucket/versions/20240109T120000Z/"+name, types.ServerSideEncryptionAes256).
+			Return(&s3.CopyObjectOutput{}, nil)
+	}
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/manifest.json", mock.Anything, types.ServerSideEncryptionAes256).
+		Run(func(args mock.Arguments) {
+			manifest, err := cvd.ParseManifest(args.Get(2).([]byte))
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"freshclam.dat", "opg.ndb", "opg.yar"}, manifest.Names())
+			assert.Equal(t, "versions/20240110T120000Z/opg.yar", manifest.Files["opg.yar"].Key)
+		}).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "current.json", mock.Anything, types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	response, err := l.HandleEvent(context.Background(), Event{})
+	assert.Nil(t, err)
+	assert.Equal(t, Response{
+		Message:  "clamav definitions updated",
+		Changed:  []ChangedFile{{Name: "opg.ndb"}, {Name: "retired.hdb", Removed: true}},
+		Rejected: []string{"opg.yar"},
+	}, response)
+
+	mock.AssertExpectationsForObjects(t, storageClient, freshclam, checker)
+}
+
+func testNow() time.Time {
+	return time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+}
+
+func pointerOutput(version string) *s3.GetObjectOutput {
+	body, _ := json.Marshal(cvd.NewPointer(version))
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}
+}
+
+func manifestOutput(files map[string][]byte) *s3.GetObjectOutput {
+	manifest := cvd.Manifest{Files: map[string]cvd.ManifestFile{}}
+	for name, body := range files {
+		sum := sha256.Sum256(body)
+		manifest.Files[name] = cvd.ManifestFile{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(body))}
+	}
+
+	body, _ := json.Marshal(manifest)
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}
+}
+
+func cvdHeader(version string) []byte {
+	header := bytes.Repeat([]byte(" "), 512)
+	copy(header, "ClamAV-VDB:09 Dec 2023 07-23 -0500:"+version+":2054360:90:md5:dsig:raynman:1702124580")
+	return header
+}
+
+func decodeMetrics(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var docs []map[string]any
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var doc map[string]any
+		if err := decoder.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		delete(doc, "_aws")
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestHandleEventEmitsMetrics(t *testing.T) {
+	tempdir := t.TempDir()
+
+	storageClient := &mockStorageClient{}
+	freshclam := &mockUpdater{}
+
+	var buf bytes.Buffer
+	l := &Lambda{
+		bucket:        "a-bucket",
+		definitionDir: tempdir,
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
+		metrics:       metrics.New(&buf, ""),
+	}
+
+	storageClient.
+		On("GetObject", "a-bucket", "current.json").
+		Return(pointerOutput("20240109T120000Z"), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/manifest.json").
+		Return(manifestOutput(map[string][]byte{"daily.cvd": cvdHeader("27118")}), nil)
+
+	storageClient.
+		On("GetObject", "a-bucket", "versions/20240109T120000Z/daily.cvd").
+		Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader(cvdHeader("27118"))),
+		}, nil)
+
+	freshclam.
+		On("Update").
+		Run(func(mock.Arguments) {
+			_ = os.WriteFile(filepath.Join(tempdir, "daily.cvd"), cvdHeader("27119"), 0600)
+		}).
+		Return(nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/daily.cvd", cvdHeader("27119"), types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "versions/20240110T120000Z/manifest.json", mock.Anything, types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	storageClient.
+		On("PutObject", "a-bucket", "current.json", mock.Anything, types.ServerSideEncryptionAes256).
+		Return(&s3.PutObjectOutput{}, nil)
+
+	response, err := l.HandleEvent(context.Background(), Event{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ChangedFile{{Name: "daily.cvd", OldVersion: 27118, NewVersion: 27119}}, response.Changed)
+
+	docs := decodeMetrics(t, &buf)
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, "a-bucket", docs[0]["Bucket"])
+		assert.Equal(t, float64(1), docs[0]["DefinitionsChanged"])
+		assert.Equal(t, float64(0), docs[0]["FreshclamFailures"])
+		assert.Contains(t, docs[0], "FreshclamDuration")
+
+		assert.Equal(t, map[string]any{
+			"Bucket":             "a-bucket",
+			"Database":           "daily",
+			"DefinitionsVersion": float64(27119),
+		}, docs[1])
+	}
+
+	mock.AssertExpectationsForObjects(t, storageClient, freshclam)
+}
+
+func TestHandleEventEmitsMetricsOnFailure(t *testing.T) {
+	storageClient := &mockStorageClient{}
+	freshclam := &mockUpdater{}
+
+	var buf bytes.Buffer
+	l := &Lambda{
+		bucket:        "a-bucket",
+		definitionDir: t.TempDir(),
+		storageClient: storageClient,
+		freshclam:     freshclam,
+		now:           testNow,
+		metrics:       metrics.New(&buf, ""),
+	}
+
+	storageClient.
+		On("GetObject", "a-bucket", "current.json").
+		Return(nil, &types.NoSuchKey{})
+
+	freshclam.
+		On("Update").Return(errors.New("exit status 1"))
+
+	_, err := l.HandleEvent(context.Background(), Event{})
+	assert.Equal(t, "exit status 1", err.Error())
+
+	docs := decodeMetrics(t, &buf)
+	if assert.Len(t, docs, 1) {
+		assert.Equal(t, float64(0), docs[0]["DefinitionsChanged"])
+		assert.Equal(t, float64(1), docs[0]["FreshclamFailures"])
+	}
 
 	mock.AssertExpectationsForObjects(t, storageClient, freshclam)
 }
@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+	"github.com/ministryofjustice/opg-s3-antivirus/config"
+	"github.com/ministryofjustice/opg-s3-antivirus/cvd"
+	"github.com/ministryofjustice/opg-s3-antivirus/ledger"
+	"github.com/ministryofjustice/opg-s3-antivirus/logging"
+	"github.com/ministryofjustice/opg-s3-antivirus/metrics"
+	"github.com/ministryofjustice/opg-s3-antivirus/rules"
+	"github.com/ministryofjustice/opg-s3-antivirus/tracing"
 
 	"github.com/aws/aws-lambda-go/lambda"
 )
@@ -23,7 +31,10 @@ type EventRecord struct {
 			Name string `json:"name"`
 		} `json:"bucket"`
 		Object struct {
-			Key string `json:"key"`
+			Key       string `json:"key"`
+			Size      int64  `json:"size"`
+			ETag      string `json:"eTag"`
+			VersionID string `json:"versionId"`
 		} `json:"object"`
 	} `json:"s3"`
 }
@@ -36,221 +47,304 @@ type MyResponse struct {
 	Message string `json:"message"`
 }
 
-type LambdaTagValues struct {
-	pass string
-	fail string
-}
-
-type Downloader interface {
-	GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+type Lambda struct {
+	pipeline *antivirus.Pipeline
+	// reloadDefinitions, when set, is called before each scan to pick up
+	// definitions published since the container started.
+	reloadDefinitions func(ctx context.Context)
+	// refreshHashLists, when set, is called before each scan to pick up
+	// changes to the allow and block lists.
+	refreshHashLists func(ctx context.Context)
 }
 
-type Tagger interface {
-	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
-	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
-}
+func (l *Lambda) HandleEvent(ctx context.Context, event ObjectCreatedEvent) (MyResponse, error) {
+	record := event.Records[0].S3
+	objectKey, err := url.QueryUnescape(record.Object.Key)
 
-type Scanner interface {
-	StartDaemon() error
-	ScanFile(path string) (bool, error)
-}
+	if err != nil {
+		return MyResponse{}, fmt.Errorf("failed to unescape object key: %w", err)
+	}
 
-type Lambda struct {
-	tagKey     string
-	tagValues  LambdaTagValues
-	scanner    Scanner
-	s3         Tagger
-	downloader Downloader
-}
+	if l.reloadDefinitions != nil {
+		l.reloadDefinitions(ctx)
+	}
+	if l.refreshHashLists != nil {
+		l.refreshHashLists(ctx)
+	}
 
-func (l *Lambda) downloadDefinitions(ctx context.Context, dir, bucket string, files []string) error {
-	if err := os.Mkdir(dir, 0750); err != nil && !os.IsExist(err) { //nolint:gosec // bucket directory set by infra
-		return err
+	result, err := l.pipeline.Scan(ctx, antivirus.Object{
+		Bucket:    record.Bucket.Name,
+		Key:       objectKey,
+		VersionID: record.Object.VersionID,
+		Size:      record.Object.Size,
+		ETag:      record.Object.ETag,
+	})
+	if err != nil {
+		return MyResponse{}, err
 	}
 
-	for _, key := range files {
-		input := &s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		}
+	if result.Skipped {
+		return MyResponse{Message: "scanning skipped by rule"}, nil
+	}
 
-		output, err := l.downloader.GetObject(ctx, input)
-		if err != nil {
-			return err
-		}
+	return MyResponse{Message: fmt.Sprintf("scanning complete, tagged with %s", result.Status)}, nil
+}
 
-		file, err := os.Create(filepath.Join(dir, key)) //nolint:gosec // variables are fixed so inclusion is not risky
-		if err != nil {
-			return err
-		}
-		defer file.Close() //nolint:errcheck // no need to check error when closing file
+func main() {
+	ctx := context.Background()
 
-		if _, err := io.Copy(file, output.Body); err != nil {
-			return err
-		}
+	level := new(slog.LevelVar)
+	slog.SetDefault(logging.New(os.Stdout, level))
 
-		_ = output.Body.Close()
+	cfg, err := config.LoadScan()
+	if err != nil {
+		logging.Fatal("error loading config", err)
 	}
 
-	return nil
-}
-
-func (l *Lambda) downloadFile(ctx context.Context, f *os.File, bucket string, key string) error {
-	output, err := l.downloader.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
+	logLevel, _ := logging.ParseLevel(cfg.LogLevel)
+	level.Set(logLevel)
 
+	awsCfg, err := awsconfig.LoadDefaultConfig(
+		ctx,
+		awsconfig.WithRegion(cfg.AWS.Region),
+	)
 	if err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
+		logging.Fatal("error building aws config", err)
 	}
 
-	if _, err := io.Copy(f, output.Body); err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
+	if cfg.AWS.S3Endpoint != "" {
+		awsCfg.BaseEndpoint = &cfg.AWS.S3Endpoint
 	}
 
-	_ = output.Body.Close()
-	return nil
-}
+	var provider *tracing.Provider
+	if cfg.OTLPEndpoint != "" {
+		provider, err = tracing.Start(ctx, cfg.OTLPEndpoint, "opg-s3-antivirus")
+		if err != nil {
+			logging.Fatal("error starting tracing", err)
+		}
+	}
+	tracing.InstrumentAWS(&awsCfg)
 
-func (l *Lambda) tagFile(ctx context.Context, bucket string, key string, status string) error {
-	tagging, err := l.s3.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+	s3Client := s3.NewFromConfig(awsCfg, func(u *s3.Options) {
+		u.UsePathStyle = true
 	})
 
-	if err != nil {
-		return fmt.Errorf("failed to get tags: %w", err)
-	}
+	if cfg.Handler == config.HandlerObjectLambda {
+		objectLambdaClient := newObjectLambdaClient(awsCfg)
 
-	is_tag_set := false
-	for index, tag := range tagging.TagSet {
-		if *tag.Key == l.tagKey {
-			tagging.TagSet[index].Value = aws.String(status)
-			is_tag_set = true
+		o := &ObjectLambda{
+			tagKey:    cfg.TagKey,
+			tagValues: cfg.TagValues,
+			s3:        objectLambdaClient,
+			writer:    objectLambdaClient,
+			http:      http.DefaultClient,
 		}
-	}
 
-	if !is_tag_set {
-		tagging.TagSet = append(tagging.TagSet, types.Tag{
-			Key:   aws.String(l.tagKey),
-			Value: aws.String(status),
+		handler := tracing.Wrap(provider, "object-lambda", func(ctx context.Context, event ObjectLambdaEvent) (any, error) {
+			return nil, o.HandleEvent(ctx, event)
 		})
-	}
-
-	_, err = l.s3.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Tagging: &types.Tagging{
-			TagSet: tagging.TagSet,
-		},
-	})
 
-	if err != nil {
-		return fmt.Errorf("failed to write tags: %w", err)
+		lambda.StartWithOptions(handler, lambda.WithContext(ctx))
+		return
 	}
 
-	return nil
-}
-
-func (l *Lambda) HandleEvent(ctx context.Context, event ObjectCreatedEvent) (MyResponse, error) {
-	bucketName := event.Records[0].S3.Bucket.Name
-	objectKey, err := url.QueryUnescape(event.Records[0].S3.Object.Key)
-
-	if err != nil {
-		return MyResponse{}, fmt.Errorf("failed to unescape object key: %w", err)
+	scanner := &antivirus.ClamAvScanner{ConfigFile: cfg.ClamdConfig}
+	engines := newEngines(cfg, scanner)
+
+	opts := []antivirus.Option{
+		antivirus.WithTagKey(cfg.TagKey),
+		antivirus.WithTagValues(cfg.TagValues),
+		antivirus.WithTempDir(cfg.TempDir),
+		antivirus.WithMaxSize(cfg.MaxSize),
+		antivirus.WithMover(s3Client),
+		antivirus.WithResultWriter(antivirus.ResultWriterSidecar, &antivirus.SidecarWriter{Uploader: s3Client, Prefix: cfg.ResultPrefix}),
+		antivirus.WithResultWriter(antivirus.ResultWriterMetadata, &antivirus.MetadataWriter{Copier: s3Client}),
+		antivirus.WithDefaultResultWriter(cfg.ResultWriter),
+		antivirus.WithArchiveLimits(antivirus.ArchiveLimits{
+			MaxRatio:   cfg.ArchiveMaxRatio,
+			MaxEntries: cfg.ArchiveMaxEntries,
+			MaxSize:    cfg.ArchiveMaxSize,
+			MaxDepth:   cfg.ArchiveMaxDepth,
+		}),
+		antivirus.WithScanMembers(cfg.ScanArchiveMembers),
+		antivirus.WithActiveContent(cfg.CheckActiveContent),
 	}
 
-	log.Printf("downloading %s from %s", objectKey, bucketName)
+	if cfg.LedgerTable != "" {
+		dynamoClient := dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+			if cfg.AWS.DynamoDBEndpoint != "" {
+				o.BaseEndpoint = &cfg.AWS.DynamoDBEndpoint
+			}
+		})
 
-	f, err := os.CreateTemp("/tmp", "file")
-	if err != nil {
-		return MyResponse{}, fmt.Errorf("failed to create file: %w", err)
+		ledgerRecorder := ledger.New(dynamoClient, cfg.LedgerTable, cfg.LedgerVerdictIndex)
+		if cfg.LedgerRequired {
+			opts = append(opts, antivirus.WithRequiredRecorder(ledgerRecorder))
+		} else {
+			opts = append(opts, antivirus.WithRecorder(ledgerRecorder))
+		}
 	}
 
-	defer func() {
-		err := os.Remove(f.Name()) //nolint:gosec // file created above
+	if cfg.PasswordsFile != "" {
+		passwords, err := antivirus.LoadPasswordFile(cfg.PasswordsFile)
 		if err != nil {
-			log.Printf("error whilst removing file: %s", err.Error()) //nolint:gosec // no injection risk from error
+			logging.Fatal("error loading archive passwords", err)
 		}
-	}()
 
-	defer func() {
-		err := f.Close()
+		opts = append(opts, antivirus.WithPasswords(passwords, cfg.PasswordMetadataKey))
+	} else if cfg.PasswordParameterEndpoint != "" {
+		opts = append(opts, antivirus.WithPasswords(&antivirus.ParameterPasswords{
+			Endpoint: cfg.PasswordParameterEndpoint,
+			Prefix:   cfg.PasswordParameterPrefix,
+			Token:    os.Getenv("AWS_SESSION_TOKEN"),
+			Client:   http.DefaultClient,
+		}, cfg.PasswordMetadataKey))
+	}
+
+	if cfg.RulesFile != "" {
+		ruleSet, err := rules.Load(cfg.RulesFile)
 		if err != nil {
-			log.Printf("error whilst closing file: %s", err.Error()) //nolint:gosec // no injection risk from error
+			logging.Fatal("error loading rules", err)
 		}
-	}()
 
-	if err := l.downloadFile(ctx, f, bucketName, objectKey); err != nil {
-		log.Print(err)
-		return MyResponse{}, err
+		opts = append(opts, antivirus.WithPolicyResolver(ruleSet))
 	}
 
-	log.Printf("file downloaded, scanning file")
+	reloader := &antivirus.DefinitionsReloader{
+		Downloader: s3Client,
+		Bucket:     cfg.DefinitionsBucket,
+		Dir:        cfg.DefinitionsDir,
+		Interval:   time.Duration(cfg.DefinitionsReloadInterval),
+		Reload:     scanner.ReloadDatabase,
+	}
 
-	status, err := l.scanner.ScanFile(f.Name())
-	if err != nil {
-		log.Print(err)
-		return MyResponse{}, err
+	slog.Info("downloading virus definitions", slog.String("bucket", cfg.DefinitionsBucket))
+	if _, err := reloader.Sync(ctx); err != nil {
+		slog.Error("downloading new definitions failed", slog.Any("error", err))
 	}
 
-	statusString := l.tagValues.fail
-	if status {
-		statusString = l.tagValues.pass
+	definitionsVersion, definitionsBuilt := readDefinitions(ctx, cfg.DefinitionsDir)
+	slog.Info("virus definitions loaded", slog.String("definitionsSet", reloader.Version()), slog.String("definitionsVersion", definitionsVersion), slog.Time("definitionsBuilt", definitionsBuilt))
+
+	definitionsPolicy := antivirus.DefinitionsPolicy(cfg.DefinitionsPolicy)
+	checkDefinitions := func() error {
+		return antivirus.CheckDefinitionsAge(definitionsBuilt, time.Duration(cfg.DefinitionsMaxAge), time.Now())
 	}
 
-	log.Printf("scan complete, status %s, tagging file", statusString)
-	if err := l.tagFile(ctx, bucketName, objectKey, statusString); err != nil {
-		log.Print(err)
-		return MyResponse{}, err
+	if err := checkDefinitions(); err != nil {
+		if definitionsPolicy == antivirus.DefinitionsFailClosed {
+			logging.Fatal("virus definitions are not usable", err)
+		}
+		slog.Warn("virus definitions are not usable", slog.Any("error", err), slog.String("definitionsPolicy", cfg.DefinitionsPolicy))
 	}
 
-	log.Printf("scanning complete, tagged with %s", statusString)
-	return MyResponse{Message: fmt.Sprintf("scanning complete, tagged with %s", statusString)}, nil
-}
+	var hashLists *antivirus.HashLists
+	if cfg.HashListBucket != "" {
+		hashLists = &antivirus.HashLists{
+			Downloader: s3Client,
+			Bucket:     cfg.HashListBucket,
+			AllowKey:   cfg.AllowListKey,
+			BlockKey:   cfg.BlockListKey,
+			Interval:   time.Duration(cfg.HashListRefreshInterval),
+		}
 
-func main() {
-	ctx := context.Background()
+		if err := hashLists.Refresh(ctx); err != nil {
+			slog.Error("loading hash lists failed", slog.Any("error", err))
+		}
 
-	awsRegion := os.Getenv("AWS_REGION")
-	cfg, err := config.LoadDefaultConfig(
-		ctx,
-		config.WithRegion(awsRegion),
+		opts = append(opts, antivirus.WithHashLists(hashLists))
+	}
+
+	opts = append(opts,
+		antivirus.WithDefinitionsVersion(func() string { return definitionsVersion }),
+		antivirus.WithDefinitionsCheck(checkDefinitions, definitionsPolicy),
+		antivirus.WithRecorder(&metrics.ScanRecorder{
+			Emitter:          metrics.New(os.Stdout, cfg.MetricsNamespace),
+			DefinitionsBuilt: func() time.Time { return definitionsBuilt },
+		}),
 	)
+
+	l := &Lambda{
+		pipeline: antivirus.New(s3Client, s3Client, engines, opts...),
+	}
+
+	if cfg.DefinitionsReloadInterval > 0 {
+		l.reloadDefinitions = func(ctx context.Context) {
+			reloaded, err := reloader.ReloadIfDue(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "reloading virus definitions failed", slog.Any("error", err))
+			}
+			if !reloaded {
+				return
+			}
+
+			definitionsVersion, definitionsBuilt = readDefinitions(ctx, cfg.DefinitionsDir)
+			slog.InfoContext(ctx, "virus definitions reloaded", slog.String("definitionsSet", reloader.Version()), slog.String("definitionsVersion", definitionsVersion), slog.Time("definitionsBuilt", definitionsBuilt))
+		}
+	}
+
+	if hashLists != nil && cfg.HashListRefreshInterval > 0 {
+		l.refreshHashLists = func(ctx context.Context) {
+			if err := hashLists.RefreshIfDue(ctx); err != nil {
+				slog.ErrorContext(ctx, "refreshing hash lists failed", slog.Any("error", err))
+			}
+		}
+	}
+
+	err = engines.StartDaemon()
 	if err != nil {
-		log.Printf("error building aws config: %v", err)
+		slog.Error("error starting daemon, it will be restarted before the next scan", slog.Any("error", err))
 	}
 
-	if endpoint, ok := os.LookupEnv("AWS_S3_ENDPOINT"); ok {
-		cfg.BaseEndpoint = &endpoint
+	lambda.StartWithOptions(tracing.Wrap(provider, "scan", l.HandleEvent), lambda.WithContext(ctx))
+}
+
+// newObjectLambdaClient creates the client for the Object Lambda handler, which
+// addresses the supporting access point by its ARN. The SDK refuses ARN buckets
+// with path-style addressing, so unlike the scan handler's client it must use
+// virtual hosted-style.
+func newObjectLambdaClient(awsCfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(awsCfg)
+}
+
+// newEngines gives the scanner for the configured engines, which is clamav on
+// its own unless others are listed.
+func newEngines(cfg config.Scan, clamav *antivirus.ClamAvScanner) antivirus.Scanner {
+	if len(cfg.Engines) == 1 && cfg.Engines[0] == antivirus.EngineClamAV {
+		return clamav
 	}
 
-	s3Client := s3.NewFromConfig(cfg, func(u *s3.Options) {
-		u.UsePathStyle = true
-	})
+	multi := &antivirus.MultiScanner{Mode: cfg.EngineMode, Consensus: cfg.EngineConsensus}
+	for _, name := range cfg.Engines {
+		var engine antivirus.Scanner
+		switch name {
+		case antivirus.EngineClamAV:
+			engine = clamav
+		case antivirus.EngineYara:
+			engine = &antivirus.YaraScanner{RulesFile: cfg.YaraRules}
+		case antivirus.EngineICAP:
+			engine = &antivirus.ICAPScanner{URL: cfg.ICAPURL}
+		}
 
-	l := &Lambda{
-		tagKey: os.Getenv("ANTIVIRUS_TAG_KEY"),
-		tagValues: LambdaTagValues{
-			pass: os.Getenv("ANTIVIRUS_TAG_VALUE_PASS"),
-			fail: os.Getenv("ANTIVIRUS_TAG_VALUE_FAIL"),
-		},
-		scanner:    &ClamAvScanner{},
-		s3:         s3Client,
-		downloader: s3Client,
+		multi.Engines = append(multi.Engines, antivirus.Engine{Name: name, Scanner: engine})
 	}
 
-	log.Print("downloading virus definitions")
-	err = l.downloadDefinitions(ctx, "/tmp/clamav", os.Getenv("ANTIVIRUS_DEFINITIONS_BUCKET"), []string{"bytecode.cvd", "daily.cvd", "freshclam.dat", "main.cvd"})
+	return multi
+}
+
+// readDefinitions describes the signature databases in dir, logging rather
+// than failing when they cannot be read so that the definitions check decides
+// what happens to scans.
+func readDefinitions(ctx context.Context, dir string) (version string, built time.Time) {
+	version, err := cvd.Summary(dir)
 	if err != nil {
-		log.Printf("downloading new definitions failed: %v", err)
+		slog.ErrorContext(ctx, "reading definitions version failed", slog.Any("error", err))
 	}
 
-	err = l.scanner.StartDaemon()
+	built, err = cvd.LatestBuildTime(dir)
 	if err != nil {
-		log.Printf("error starting damon: %v", err)
+		slog.ErrorContext(ctx, "reading definitions build time failed", slog.Any("error", err))
 	}
 
-	lambda.StartWithOptions(l.HandleEvent, lambda.WithContext(ctx))
+	return version, built
 }
@@ -5,14 +5,13 @@ import (
 	"context"
 	"errors"
 	"io"
-	"io/fs"
-	"os"
-	"path/filepath"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+	"github.com/ministryofjustice/opg-s3-antivirus/config"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -39,9 +38,9 @@ func (m *mockScanner) StartDaemon() error {
 	return args.Error(0)
 }
 
-func (m *mockScanner) ScanFile(path string) (bool, error) {
+func (m *mockScanner) ScanFile(ctx context.Context, path string) (antivirus.Verdict, error) {
 	args := m.Called(path)
-	return args.Bool(0), args.Error(1)
+	return args.Get(0).(antivirus.Verdict), args.Error(1)
 }
 
 type mockS3Tagger struct {
@@ -59,9 +58,14 @@ func (m *mockS3Tagger) GetObjectTagging(ctx context.Context, params *s3.GetObjec
 		}
 	}
 
-	return &s3.GetObjectTaggingOutput{
+	output := &s3.GetObjectTaggingOutput{
 		TagSet: valTags,
-	}, args.Error(1)
+	}
+	if len(args) > 2 {
+		output.VersionId = aws.String(args.String(2))
+	}
+
+	return output, args.Error(1)
 }
 
 func (m *mockS3Tagger) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
@@ -96,7 +100,7 @@ func TestHandleEvent(t *testing.T) {
 	scanner := new(mockScanner)
 	scanner.
 		On("ScanFile", mock.Anything).
-		Return(false, nil)
+		Return(antivirus.Verdict{}, nil)
 
 	mockS3 := new(mockS3Tagger)
 	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
@@ -105,13 +109,11 @@ func TestHandleEvent(t *testing.T) {
 	}).Return(nil)
 
 	l := &Lambda{
-		tagKey: "VIRUS_SCAN",
-		tagValues: LambdaTagValues{
-			fail: "failed",
-		},
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTagKey("VIRUS_SCAN"),
+			antivirus.WithTagValues(antivirus.TagValues{Fail: "failed"}),
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	response, err := l.HandleEvent(context.Background(), createTestEvent())
@@ -129,7 +131,7 @@ func TestHandleEventPass(t *testing.T) {
 	}, nil)
 
 	scanner := new(mockScanner)
-	scanner.On("ScanFile", mock.Anything).Return(true, nil)
+	scanner.On("ScanFile", mock.Anything).Return(antivirus.Verdict{Clean: true}, nil)
 
 	mockS3 := new(mockS3Tagger)
 	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
@@ -138,13 +140,11 @@ func TestHandleEventPass(t *testing.T) {
 	}).Return(nil)
 
 	l := &Lambda{
-		tagKey: "VIRUS_SCAN",
-		tagValues: LambdaTagValues{
-			pass: "okay",
-		},
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTagKey("VIRUS_SCAN"),
+			antivirus.WithTagValues(antivirus.TagValues{Pass: "okay"}),
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	response, err := l.HandleEvent(context.Background(), createTestEvent())
@@ -155,6 +155,43 @@ func TestHandleEventPass(t *testing.T) {
 	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
 }
 
+func TestHandleEventReloadsDefinitionsBeforeScanning(t *testing.T) {
+	var calls []string
+
+	downloader := new(mockDownloader)
+	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("file content"))),
+	}, nil)
+
+	scanner := new(mockScanner)
+	scanner.On("ScanFile", mock.Anything).Return(antivirus.Verdict{Clean: true}, nil).Run(func(mock.Arguments) {
+		calls = append(calls, "scan")
+	})
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
+	mockS3.On("PutObjectTagging", "my-bucket", "file-key", mock.Anything).Return(nil)
+
+	l := &Lambda{
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTagKey("VIRUS_SCAN"),
+			antivirus.WithTagValues(antivirus.TagValues{Pass: "okay"}),
+			antivirus.WithTempDir(t.TempDir()),
+		),
+		reloadDefinitions: func(ctx context.Context) {
+			calls = append(calls, "reload")
+		},
+		refreshHashLists: func(ctx context.Context) {
+			calls = append(calls, "refresh")
+		},
+	}
+
+	_, err := l.HandleEvent(context.Background(), createTestEvent())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"reload", "refresh", "scan"}, calls)
+}
+
 func TestHandleEventHandlesDuplicateTags(t *testing.T) {
 	downloader := new(mockDownloader)
 	downloader.On("GetObject", "my-bucket", "file-key").Return(&s3.GetObjectOutput{
@@ -162,7 +199,7 @@ func TestHandleEventHandlesDuplicateTags(t *testing.T) {
 	}, nil)
 
 	scanner := new(mockScanner)
-	scanner.On("ScanFile", mock.Anything).Return(false, nil)
+	scanner.On("ScanFile", mock.Anything).Return(antivirus.Verdict{}, nil)
 
 	mockS3 := new(mockS3Tagger)
 	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{
@@ -175,13 +212,11 @@ func TestHandleEventHandlesDuplicateTags(t *testing.T) {
 	}).Return(nil)
 
 	l := &Lambda{
-		tagKey: "VIRUS_SCAN",
-		tagValues: LambdaTagValues{
-			fail: "fail",
-		},
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTagKey("VIRUS_SCAN"),
+			antivirus.WithTagValues(antivirus.TagValues{Fail: "fail"}),
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	response, err := l.HandleEvent(context.Background(), createTestEvent())
@@ -198,9 +233,9 @@ func TestReportsFailedUnescape(t *testing.T) {
 	mockS3 := new(mockS3Tagger)
 
 	l := &Lambda{
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	event := createTestEvent()
@@ -222,9 +257,9 @@ func TestReportsFailedDownload(t *testing.T) {
 	mockS3 := new(mockS3Tagger)
 
 	l := &Lambda{
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	response, err := l.HandleEvent(context.Background(), createTestEvent())
@@ -242,14 +277,14 @@ func TestReportsFailedScan(t *testing.T) {
 	}, nil)
 
 	scanner := new(mockScanner)
-	scanner.On("ScanFile", mock.Anything).Return(false, errors.New("clamav returned exit code 82"))
+	scanner.On("ScanFile", mock.Anything).Return(antivirus.Verdict{}, errors.New("clamav returned exit code 82"))
 
 	mockS3 := new(mockS3Tagger)
 
 	l := &Lambda{
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	response, err := l.HandleEvent(context.Background(), createTestEvent())
@@ -267,15 +302,15 @@ func TestReportsFailedGetTags(t *testing.T) {
 	}, nil)
 
 	scanner := new(mockScanner)
-	scanner.On("ScanFile", mock.Anything).Return(false, nil)
+	scanner.On("ScanFile", mock.Anything).Return(antivirus.Verdict{}, nil)
 
 	mockS3 := new(mockS3Tagger)
 	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, errors.New("file does not exist"))
 
 	l := &Lambda{
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	response, err := l.HandleEvent(context.Background(), createTestEvent())
@@ -293,7 +328,7 @@ func TestReportsFailedPutTags(t *testing.T) {
 	}, nil)
 
 	scanner := new(mockScanner)
-	scanner.On("ScanFile", mock.Anything).Return(false, nil)
+	scanner.On("ScanFile", mock.Anything).Return(antivirus.Verdict{}, nil)
 
 	mockS3 := new(mockS3Tagger)
 	mockS3.On("GetObjectTagging", "my-bucket", "file-key").Return([]*types.Tag{}, nil)
@@ -302,13 +337,11 @@ func TestReportsFailedPutTags(t *testing.T) {
 	}).Return(errors.New("invalid tag"))
 
 	l := &Lambda{
-		tagKey: "VIRUS_SCAN",
-		tagValues: LambdaTagValues{
-			fail: "fail",
-		},
-		downloader: downloader,
-		scanner:    scanner,
-		s3:         mockS3,
+		pipeline: antivirus.New(downloader, mockS3, scanner,
+			antivirus.WithTagKey("VIRUS_SCAN"),
+			antivirus.WithTagValues(antivirus.TagValues{Fail: "fail"}),
+			antivirus.WithTempDir(t.TempDir()),
+		),
 	}
 
 	response, err := l.HandleEvent(context.Background(), createTestEvent())
@@ -319,74 +352,24 @@ func TestReportsFailedPutTags(t *testing.T) {
 	mock.AssertExpectationsForObjects(t, downloader, scanner, mockS3)
 }
 
-func TestDownloadDefinitions(t *testing.T) {
-	assert := assert.New(t)
-
-	tempdir, err := os.MkdirTemp("", "opg-s3-antivirus")
-	if !assert.Nil(err) {
-		return
-	}
-	defer os.RemoveAll(tempdir) //nolint:errcheck // no need to check OS error in this test
-
-	downloader := &mockDownloader{}
-
-	l := &Lambda{
-		downloader: downloader,
-	}
-
-	downloader.
-		On("GetObject", "a-bucket", "a").
-		Return(&s3.GetObjectOutput{
-			Body: io.NopCloser(bytes.NewReader([]byte("hello"))),
-		}, nil)
-
-	downloader.
-		On("GetObject", "a-bucket", "b").
-		Return(&s3.GetObjectOutput{
-			Body: io.NopCloser(bytes.NewReader([]byte("there"))),
-		}, nil)
-
-	err = l.downloadDefinitions(context.Background(), tempdir, "a-bucket", []string{"a", "b"})
-	assert.Nil(err)
-
-	fileA, _ := os.ReadFile(filepath.Join(tempdir, "a")) //nolint:gosec // tempdir is a constrained variable
-	assert.Equal([]byte("hello"), fileA)
-
-	fileB, _ := os.ReadFile(filepath.Join(tempdir, "b")) //nolint:gosec // tempdir is a constrained variable
-	assert.Equal([]byte("there"), fileB)
-
-	mock.AssertExpectationsForObjects(t, downloader)
-}
-
-func TestDownloadDefinitionsWhenError(t *testing.T) {
-	assert := assert.New(t)
-
-	tempdir, err := os.MkdirTemp("", "opg-s3-antivirus")
-	if !assert.Nil(err) {
-		return
-	}
-	defer os.RemoveAll(tempdir) //nolint:errcheck // no need to check OS error in this test
-
-	expectedErr := errors.New("what")
-
-	downloader := &mockDownloader{}
-
-	l := &Lambda{
-		downloader: downloader,
-	}
-
-	downloader.
-		On("GetObject", "a-bucket", "a").
-		Return(nil, expectedErr)
+func TestNewEngines(t *testing.T) {
+	clamav := &antivirus.ClamAvScanner{}
 
-	err = l.downloadDefinitions(context.Background(), tempdir, "a-bucket", []string{"a", "b"})
-	assert.Equal(expectedErr, err)
+	assert.Same(t, clamav, newEngines(config.Scan{Engines: []string{"clamav"}}, clamav))
 
-	_, err = os.Stat(filepath.Join(tempdir, "a"))
-	assert.True(errors.Is(err, fs.ErrNotExist))
-
-	_, err = os.Stat(filepath.Join(tempdir, "b"))
-	assert.True(errors.Is(err, fs.ErrNotExist))
-
-	mock.AssertExpectationsForObjects(t, downloader)
+	assert.Equal(t, &antivirus.MultiScanner{
+		Engines: []antivirus.Engine{
+			{Name: "icap", Scanner: &antivirus.ICAPScanner{URL: "icap://icap.internal/avscan"}},
+			{Name: "clamav", Scanner: clamav},
+			{Name: "yara", Scanner: &antivirus.YaraScanner{RulesFile: "/opt/rules.yar"}},
+		},
+		Mode:      "parallel",
+		Consensus: "primary-with-fallback",
+	}, newEngines(config.Scan{
+		Engines:         []string{"icap", "clamav", "yara"},
+		EngineMode:      "parallel",
+		EngineConsensus: "primary-with-fallback",
+		YaraRules:       "/opt/rules.yar",
+		ICAPURL:         "icap://icap.internal/avscan",
+	}, clamav))
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+	"github.com/ministryofjustice/opg-s3-antivirus/logging"
+)
+
+type GetObjectContext struct {
+	InputS3URL  string `json:"inputS3Url"`
+	OutputRoute string `json:"outputRoute"`
+	OutputToken string `json:"outputToken"`
+}
+
+type ObjectLambdaEvent struct {
+	GetObjectContext GetObjectContext `json:"getObjectContext"`
+	Configuration    struct {
+		SupportingAccessPointArn string `json:"supportingAccessPointArn"`
+	} `json:"configuration"`
+	UserRequest struct {
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	} `json:"userRequest"`
+}
+
+type ResponseWriter interface {
+	WriteGetObjectResponse(ctx context.Context, params *s3.WriteGetObjectResponseInput, optFns ...func(*s3.Options)) (*s3.WriteGetObjectResponseOutput, error)
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// ObjectLambda serves S3 Object Lambda GetObject requests, only passing the
+// object through when it has been tagged as clean by the scan lambda.
+type ObjectLambda struct {
+	tagKey    string
+	tagValues antivirus.TagValues
+	s3        antivirus.Tagger
+	writer    ResponseWriter
+	http      HTTPClient
+}
+
+// scanStatus returns the scan status tag of the object, and the version whose
+// tags were read, which is empty when the bucket is not versioned.
+func (o *ObjectLambda) scanStatus(ctx context.Context, bucket, key, versionID string) (status, taggedVersion string, tagged bool, err error) {
+	input := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	tagging, err := o.s3.GetObjectTagging(ctx, input)
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	if v := aws.ToString(tagging.VersionId); v != "null" {
+		taggedVersion = v
+	}
+
+	for _, tag := range tagging.TagSet {
+		if *tag.Key == o.tagKey {
+			return *tag.Value, taggedVersion, true, nil
+		}
+	}
+
+	return "", taggedVersion, false, nil
+}
+
+func (o *ObjectLambda) denyReason(status string, tagged bool) string {
+	switch {
+	case !tagged:
+		return "object has not been virus scanned yet"
+	case status == o.tagValues.Fail:
+		return "object failed virus scan"
+	default:
+		return fmt.Sprintf("object virus scan status is %q", status)
+	}
+}
+
+func (o *ObjectLambda) writeError(ctx context.Context, event ObjectLambdaEvent, statusCode int32, code, message string) error {
+	_, err := o.writer.WriteGetObjectResponse(ctx, &s3.WriteGetObjectResponseInput{
+		RequestRoute: aws.String(event.GetObjectContext.OutputRoute),
+		RequestToken: aws.String(event.GetObjectContext.OutputToken),
+		StatusCode:   aws.Int32(statusCode),
+		ErrorCode:    aws.String(code),
+		ErrorMessage: aws.String(message),
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+
+	return nil
+}
+
+// s3ErrorCode is the S3 error code for a failed fetch of the object.
+func s3ErrorCode(statusCode int) string {
+	switch statusCode {
+	case http.StatusNotFound:
+		return "NoSuchKey"
+	case http.StatusForbidden:
+		return "AccessDenied"
+	case http.StatusPreconditionFailed:
+		return "PreconditionFailed"
+	case http.StatusRequestedRangeNotSatisfiable:
+		return "InvalidRange"
+	case http.StatusServiceUnavailable:
+		return "ServiceUnavailable"
+	}
+
+	if statusCode >= http.StatusInternalServerError {
+		return "InternalError"
+	}
+
+	return "InvalidRequest"
+}
+
+// streamObject passes the object back to the caller. When taggedVersion is
+// set, the object is only passed back if it is still that version, as the
+// presigned input URL cannot be pinned to it.
+func (o *ObjectLambda) streamObject(ctx context.Context, event ObjectLambdaEvent, taggedVersion string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, event.GetObjectContext.InputS3URL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch object: %w", err)
+	}
+
+	for name, value := range event.UserRequest.Headers {
+		if strings.EqualFold(name, "Range") {
+			req.Header.Set("Range", value)
+		}
+	}
+
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch object: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // no need to check error when closing body
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return o.writeError(ctx, event, int32(resp.StatusCode), s3ErrorCode(resp.StatusCode), "failed to fetch object") //nolint:gosec // http status codes fit in int32
+	}
+
+	if fetched := resp.Header.Get("x-amz-version-id"); taggedVersion != "" && fetched != taggedVersion {
+		slog.InfoContext(ctx, "denying access, object changed after its scan status was read", slog.String("fetchedVersionId", fetched), slog.String("taggedVersionId", taggedVersion))
+		return o.writeError(ctx, event, http.StatusForbidden, "AccessDenied", "object changed while its virus scan status was checked")
+	}
+
+	input := &s3.WriteGetObjectResponseInput{
+		RequestRoute: aws.String(event.GetObjectContext.OutputRoute),
+		RequestToken: aws.String(event.GetObjectContext.OutputToken),
+		StatusCode:   aws.Int32(int32(resp.StatusCode)), //nolint:gosec // http status codes fit in int32
+		Body:         resp.Body,
+	}
+
+	if resp.ContentLength >= 0 {
+		input.ContentLength = aws.Int64(resp.ContentLength)
+	}
+	if v := resp.Header.Get("Content-Type"); v != "" {
+		input.ContentType = aws.String(v)
+	}
+	if v := resp.Header.Get("Content-Range"); v != "" {
+		input.ContentRange = aws.String(v)
+	}
+	if v := resp.Header.Get("ETag"); v != "" {
+		input.ETag = aws.String(v)
+	}
+
+	if _, err := o.writer.WriteGetObjectResponse(ctx, input); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+
+	return nil
+}
+
+func (o *ObjectLambda) HandleEvent(ctx context.Context, event ObjectLambdaEvent) error {
+	userURL, err := url.Parse(event.UserRequest.URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse user request url: %w", err)
+	}
+
+	bucket := event.Configuration.SupportingAccessPointArn
+	key := strings.TrimPrefix(userURL.Path, "/")
+	versionID := userURL.Query().Get("versionId")
+
+	ctx = logging.With(ctx,
+		slog.String("bucket", bucket),
+		slog.String("key", key),
+		slog.String("versionId", versionID),
+	)
+
+	status, taggedVersion, tagged, err := o.scanStatus(ctx, bucket, key, versionID)
+	if err != nil {
+		slog.ErrorContext(ctx, "checking scan status failed", slog.Any("error", err))
+		if werr := o.writeError(ctx, event, http.StatusInternalServerError, "InternalError", "unable to verify virus scan status"); werr != nil {
+			slog.ErrorContext(ctx, "writing error response failed", slog.Any("error", werr))
+		}
+		return err
+	}
+
+	if !tagged || status != o.tagValues.Pass {
+		reason := o.denyReason(status, tagged)
+		slog.InfoContext(ctx, "denying access", slog.String("verdict", status), slog.String("reason", reason))
+		return o.writeError(ctx, event, http.StatusForbidden, "AccessDenied", reason)
+	}
+
+	slog.InfoContext(ctx, "streaming object", slog.String("verdict", status))
+	if err := o.streamObject(ctx, event, taggedVersion); err != nil {
+		slog.ErrorContext(ctx, "streaming object failed", slog.Any("error", err))
+		return err
+	}
+
+	return nil
+}
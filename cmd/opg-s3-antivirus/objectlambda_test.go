@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockResponseWriter struct {
+	mock.Mock
+}
+
+func (m *mockResponseWriter) WriteGetObjectResponse(ctx context.Context, params *s3.WriteGetObjectResponseInput, optFns ...func(*s3.Options)) (*s3.WriteGetObjectResponseOutput, error) {
+	var body []byte
+	if params.Body != nil {
+		body, _ = io.ReadAll(params.Body)
+	}
+
+	args := m.Called(*params.RequestRoute, *params.RequestToken, *params.StatusCode, aws.ToString(params.ErrorCode), aws.ToString(params.ErrorMessage), body)
+	return &s3.WriteGetObjectResponseOutput{}, args.Error(0)
+}
+
+func createTestObjectLambdaEvent(inputURL string) ObjectLambdaEvent {
+	event := ObjectLambdaEvent{}
+	event.GetObjectContext = GetObjectContext{
+		InputS3URL:  inputURL,
+		OutputRoute: "a-route",
+		OutputToken: "a-token",
+	}
+	event.Configuration.SupportingAccessPointArn = "arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap"
+	event.UserRequest.URL = "https://my-ap-123456789012.s3-object-lambda.eu-west-1.amazonaws.com/file%2Dkey"
+
+	return event
+}
+
+func TestObjectLambdaHandleEventPass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("file content"))
+	}))
+	defer server.Close()
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap", "file-key").Return([]*types.Tag{
+		{Key: aws.String("VIRUS_SCAN"), Value: aws.String("okay")},
+	}, nil)
+
+	writer := new(mockResponseWriter)
+	writer.On("WriteGetObjectResponse", "a-route", "a-token", int32(200), "", "", []byte("file content")).Return(nil)
+
+	o := &ObjectLambda{
+		tagKey:    "VIRUS_SCAN",
+		tagValues: antivirus.TagValues{Pass: "okay", Fail: "infected"},
+		s3:        mockS3,
+		writer:    writer,
+		http:      server.Client(),
+	}
+
+	err := o.HandleEvent(context.Background(), createTestObjectLambdaEvent(server.URL))
+	assert.Nil(t, err)
+
+	mock.AssertExpectationsForObjects(t, mockS3, writer)
+}
+
+func TestObjectLambdaHandleEventDenied(t *testing.T) {
+	testcases := map[string]struct {
+		tags   []*types.Tag
+		reason string
+	}{
+		"infected": {
+			tags:   []*types.Tag{{Key: aws.String("VIRUS_SCAN"), Value: aws.String("infected")}},
+			reason: "object failed virus scan",
+		},
+		"pending": {
+			tags:   []*types.Tag{{Key: aws.String("VIRUS_SCAN"), Value: aws.String("pending")}},
+			reason: `object virus scan status is "pending"`,
+		},
+		"untagged": {
+			tags:   []*types.Tag{{Key: aws.String("upload-source"), Value: aws.String("online")}},
+			reason: "object has not been virus scanned yet",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			mockS3 := new(mockS3Tagger)
+			mockS3.On("GetObjectTagging", "arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap", "file-key").Return(tc.tags, nil)
+
+			writer := new(mockResponseWriter)
+			writer.On("WriteGetObjectResponse", "a-route", "a-token", int32(403), "AccessDenied", tc.reason, []byte(nil)).Return(nil)
+
+			o := &ObjectLambda{
+				tagKey:    "VIRUS_SCAN",
+				tagValues: antivirus.TagValues{Pass: "okay", Fail: "infected"},
+				s3:        mockS3,
+				writer:    writer,
+			}
+
+			err := o.HandleEvent(context.Background(), createTestObjectLambdaEvent("http://unused"))
+			assert.Nil(t, err)
+
+			mock.AssertExpectationsForObjects(t, mockS3, writer)
+		})
+	}
+}
+
+func TestObjectLambdaHandleEventPinsTaggedVersion(t *testing.T) {
+	testcases := map[string]struct {
+		fetchedVersion string
+		statusCode     int32
+		code           string
+		message        string
+		body           []byte
+	}{
+		"same version": {
+			fetchedVersion: "v1",
+			statusCode:     200,
+			body:           []byte("file content"),
+		},
+		"overwritten": {
+			fetchedVersion: "v2",
+			statusCode:     403,
+			code:           "AccessDenied",
+			message:        "object changed while its virus scan status was checked",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("x-amz-version-id", tc.fetchedVersion)
+				_, _ = w.Write([]byte("file content"))
+			}))
+			defer server.Close()
+
+			mockS3 := new(mockS3Tagger)
+			mockS3.On("GetObjectTagging", "arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap", "file-key").Return([]*types.Tag{
+				{Key: aws.String("VIRUS_SCAN"), Value: aws.String("okay")},
+			}, nil, "v1")
+
+			writer := new(mockResponseWriter)
+			writer.On("WriteGetObjectResponse", "a-route", "a-token", tc.statusCode, tc.code, tc.message, tc.body).Return(nil)
+
+			o := &ObjectLambda{
+				tagKey:    "VIRUS_SCAN",
+				tagValues: antivirus.TagValues{Pass: "okay", Fail: "infected"},
+				s3:        mockS3,
+				writer:    writer,
+				http:      server.Client(),
+			}
+
+			err := o.HandleEvent(context.Background(), createTestObjectLambdaEvent(server.URL))
+			assert.Nil(t, err)
+
+			mock.AssertExpectationsForObjects(t, mockS3, writer)
+		})
+	}
+}
+
+func TestObjectLambdaHandleEventWhenFetchFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap", "file-key").Return([]*types.Tag{
+		{Key: aws.String("VIRUS_SCAN"), Value: aws.String("okay")},
+	}, nil)
+
+	writer := new(mockResponseWriter)
+	writer.On("WriteGetObjectResponse", "a-route", "a-token", int32(404), "NoSuchKey", "failed to fetch object", []byte(nil)).Return(nil)
+
+	o := &ObjectLambda{
+		tagKey:    "VIRUS_SCAN",
+		tagValues: antivirus.TagValues{Pass: "okay", Fail: "infected"},
+		s3:        mockS3,
+		writer:    writer,
+		http:      server.Client(),
+	}
+
+	err := o.HandleEvent(context.Background(), createTestObjectLambdaEvent(server.URL))
+	assert.Nil(t, err)
+
+	mock.AssertExpectationsForObjects(t, mockS3, writer)
+}
+
+func TestObjectLambdaReportsFailedGetTags(t *testing.T) {
+	mockS3 := new(mockS3Tagger)
+	mockS3.On("GetObjectTagging", "arn:aws:s3:eu-west-1:123456789012:accesspoint/my-ap", "file-key").Return([]*types.Tag{}, errors.New("access denied"))
+
+	writer := new(mockResponseWriter)
+	writer.On("WriteGetObjectResponse", "a-route", "a-token", int32(500), "InternalError", "unable to verify virus scan status", []byte(nil)).Return(nil)
+
+	o := &ObjectLambda{
+		tagKey: "VIRUS_SCAN",
+		s3:     mockS3,
+		writer: writer,
+	}
+
+	err := o.HandleEvent(context.Background(), createTestObjectLambdaEvent("http://unused"))
+	assert.Equal(t, "failed to get tags: access denied", err.Error())
+
+	mock.AssertExpectationsForObjects(t, mockS3, writer)
+}
+
+// recordingClient answers S3 requests without sending them, recording where
+// they were sent.
+type recordingClient struct {
+	requests []string
+}
+
+func (c *recordingClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, req.Method+" "+req.URL.Host+req.URL.Path+"?"+req.URL.RawQuery)
+
+	body := ""
+	if req.URL.Query().Has("tagging") {
+		body = `<Tagging><TagSet><Tag><Key>VIRUS_SCAN</Key><Value>okay</Value></Tag></TagSet></Tagging>`
+	}
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestObjectLambdaHandleEventWithClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("file content"))
+	}))
+	defer server.Close()
+
+	httpClient := &recordingClient{}
+	client := newObjectLambdaClient(aws.Config{
+		Region: "eu-west-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "key", SecretAccessKey: "secret"}, nil
+		}),
+		HTTPClient: httpClient,
+	})
+
+	o := &ObjectLambda{
+		tagKey:    "VIRUS_SCAN",
+		tagValues: antivirus.TagValues{Pass: "okay", Fail: "infected"},
+		s3:        client,
+		writer:    client,
+		http:      server.Client(),
+	}
+
+	err := o.HandleEvent(context.Background(), createTestObjectLambdaEvent(server.URL))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"GET my-ap-123456789012.s3-accesspoint.eu-west-1.amazonaws.com/file-key?tagging=",
+		"POST a-route.s3-object-lambda.eu-west-1.amazonaws.com/WriteGetObjectResponse?",
+	}, httpClient.requests)
+}
@@ -0,0 +1,667 @@
+// Package config loads the settings for the opg-s3-antivirus lambdas from the
+// environment and an optional JSON file, and validates them at cold start so
+// that a misconfigured function fails to initialise rather than tagging
+// objects incorrectly.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+	"github.com/ministryofjustice/opg-s3-antivirus/logging"
+	"github.com/ministryofjustice/opg-s3-antivirus/metrics"
+)
+
+const (
+	HandlerScan         = "scan"
+	HandlerObjectLambda = "object-lambda"
+)
+
+// FileEnv names the variable holding the path of the optional config file.
+// Values set in the environment take precedence over values in the file.
+const FileEnv = "ANTIVIRUS_CONFIG_FILE"
+
+type LookupFunc func(key string) (string, bool)
+
+type AWS struct {
+	Region           string `json:"region"`
+	S3Endpoint       string `json:"s3Endpoint"`
+	DynamoDBEndpoint string `json:"dynamoDBEndpoint"`
+}
+
+// Duration is a time.Duration written as a string such as "36h" in the config
+// file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"36h\": %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// Scan is the configuration of the scan lambda.
+type Scan struct {
+	AWS               AWS                 `json:"aws"`
+	LogLevel          string              `json:"logLevel"`
+	MetricsNamespace  string              `json:"metricsNamespace"`
+	OTLPEndpoint      string              `json:"otlpEndpoint"`
+	Handler           string              `json:"handler"`
+	TagKey            string              `json:"tagKey"`
+	TagValues         antivirus.TagValues `json:"tagValues"`
+	DefinitionsBucket string              `json:"definitionsBucket"`
+	DefinitionsDir    string              `json:"definitionsDir"`
+	// DefinitionsPolicy decides what happens to scans when the definitions
+	// are missing or older than DefinitionsMaxAge, which is unlimited when 0.
+	DefinitionsPolicy string   `json:"definitionsPolicy"`
+	DefinitionsMaxAge Duration `json:"definitionsMaxAge"`
+	ClamdConfig       string   `json:"clamdConfig"`
+	TempDir           string   `json:"tempDir"`
+	MaxSize           int64    `json:"maxSize"`
+	RulesFile         string   `json:"rulesFile"`
+	ResultWriter      string   `json:"resultWriter"`
+	ResultPrefix      string   `json:"resultPrefix"`
+	// LedgerTable enables the DynamoDB scan ledger when set.
+	LedgerTable        string `json:"ledgerTable"`
+	LedgerVerdictIndex string `json:"ledgerVerdictIndex"`
+	// LedgerRequired fails scans that cannot be written to the ledger, so
+	// that they are retried, rather than logging and counting the failure.
+	LedgerRequired bool `json:"ledgerRequired"`
+	// DefinitionsReloadInterval is how often a warm container checks the
+	// definitions bucket for new files, reloading is off when 0.
+	DefinitionsReloadInterval Duration `json:"definitionsReloadInterval"`
+
+	// HashListBucket holds the SHA-256 allow and block lists, which are
+	// reread every HashListRefreshInterval. Hash lists are off when it is
+	// empty.
+	HashListBucket          string   `json:"hashListBucket"`
+	AllowListKey            string   `json:"allowListKey"`
+	BlockListKey            string   `json:"blockListKey"`
+	HashListRefreshInterval Duration `json:"hashListRefreshInterval"`
+
+	// ArchiveMaxRatio, ArchiveMaxEntries, ArchiveMaxSize and ArchiveMaxDepth
+	// limit what archives may expand to, each limit is off when 0.
+	ArchiveMaxRatio   int64 `json:"archiveMaxRatio"`
+	ArchiveMaxEntries int64 `json:"archiveMaxEntries"`
+	ArchiveMaxSize    int64 `json:"archiveMaxSize"`
+	ArchiveMaxDepth   int64 `json:"archiveMaxDepth"`
+	// ScanArchiveMembers scans each file inside infected archives, to report
+	// which of them are infected.
+	ScanArchiveMembers bool `json:"scanArchiveMembers"`
+	// CheckActiveContent tags clean PDF and Office documents with
+	// JavaScript, automatic actions or macros with the active content value.
+	CheckActiveContent bool `json:"checkActiveContent"`
+
+	// PasswordMetadataKey is the user metadata key naming an encrypted zip's
+	// password, which is read from PasswordsFile or, through the Parameters
+	// and Secrets extension at PasswordParameterEndpoint, from the parameter
+	// PasswordParameterPrefix followed by the name.
+	PasswordMetadataKey       string `json:"passwordMetadataKey"`
+	PasswordsFile             string `json:"passwordsFile"`
+	PasswordParameterEndpoint string `json:"passwordParameterEndpoint"`
+	PasswordParameterPrefix   string `json:"passwordParameterPrefix"`
+
+	// Engines are the scanning engines used, the first being the primary.
+	// EngineMode and EngineConsensus decide how they are run and how their
+	// verdicts are combined when there is more than one.
+	Engines         []string `json:"engines"`
+	EngineMode      string   `json:"engineMode"`
+	EngineConsensus string   `json:"engineConsensus"`
+	YaraRules       string   `json:"yaraRules"`
+	ICAPURL         string   `json:"icapURL"`
+}
+
+// Update is the configuration of the definitions update lambda.
+type Update struct {
+	AWS               AWS    `json:"aws"`
+	LogLevel          string `json:"logLevel"`
+	MetricsNamespace  string `json:"metricsNamespace"`
+	OTLPEndpoint      string `json:"otlpEndpoint"`
+	DefinitionsBucket string `json:"definitionsBucket"`
+	DefinitionsDir    string `json:"definitionsDir"`
+	FreshclamConfig   string `json:"freshclamConfig"`
+
+	// CustomSignaturesBucket and CustomSignaturesPrefix are where in-house
+	// signature databases are read from, none are published when the bucket
+	// is empty.
+	CustomSignaturesBucket string `json:"customSignaturesBucket"`
+	CustomSignaturesPrefix string `json:"customSignaturesPrefix"`
+}
+
+// LoadScan reads and validates the scan lambda configuration.
+func LoadScan() (Scan, error) {
+	return loadScan(os.LookupEnv)
+}
+
+// LoadUpdate reads and validates the update lambda configuration.
+func LoadUpdate() (Update, error) {
+	return loadUpdate(os.LookupEnv)
+}
+
+func loadScan(lookup LookupFunc) (Scan, error) {
+	c := Scan{
+		LogLevel:         logging.DefaultLevel,
+		MetricsNamespace: metrics.DefaultNamespace,
+		Handler:          HandlerScan,
+		DefinitionsDir:   "/tmp/clamav",
+		ClamdConfig:      "/opt/etc/clamd.conf",
+		TempDir:          "/tmp",
+		ResultWriter:     antivirus.ResultWriterTags,
+		ResultPrefix:     "scan-results/",
+
+		DefinitionsPolicy:         string(antivirus.DefinitionsFailClosed),
+		DefinitionsReloadInterval: Duration(antivirus.DefaultReloadInterval),
+
+		LedgerVerdictIndex: "verdict-index",
+
+		HashListRefreshInterval: Duration(antivirus.DefaultHashListInterval),
+
+		ArchiveMaxRatio:   antivirus.DefaultArchiveLimits.MaxRatio,
+		ArchiveMaxEntries: antivirus.DefaultArchiveLimits.MaxEntries,
+		ArchiveMaxSize:    antivirus.DefaultArchiveLimits.MaxSize,
+		ArchiveMaxDepth:   antivirus.DefaultArchiveLimits.MaxDepth,
+
+		PasswordMetadataKey: antivirus.DefaultPasswordMetadataKey,
+
+		Engines:         []string{antivirus.EngineClamAV},
+		EngineMode:      antivirus.EngineModeSequence,
+		EngineConsensus: antivirus.ConsensusAnyInfected,
+	}
+
+	if err := readFile(lookup, &c); err != nil {
+		return Scan{}, err
+	}
+
+	env := &envReader{lookup: lookup}
+	env.aws(&c.AWS)
+	env.logLevel(&c.LogLevel)
+	env.string("ANTIVIRUS_METRICS_NAMESPACE", &c.MetricsNamespace)
+	env.string("OTEL_EXPORTER_OTLP_ENDPOINT", &c.OTLPEndpoint)
+	env.string("ANTIVIRUS_HANDLER", &c.Handler)
+	env.string("ANTIVIRUS_TAG_KEY", &c.TagKey)
+	env.string("ANTIVIRUS_TAG_VALUE_PASS", &c.TagValues.Pass)
+	env.string("ANTIVIRUS_TAG_VALUE_FAIL", &c.TagValues.Fail)
+	env.string("ANTIVIRUS_TAG_VALUE_OVERSIZE", &c.TagValues.Oversize)
+	env.string("ANTIVIRUS_TAG_VALUE_STALE_DEFINITIONS", &c.TagValues.StaleDefinitions)
+	env.string("ANTIVIRUS_TAG_VALUE_DISALLOWED_TYPE", &c.TagValues.DisallowedType)
+	env.string("ANTIVIRUS_TAG_VALUE_SUSPICIOUS_ARCHIVE", &c.TagValues.SuspiciousArchive)
+	env.string("ANTIVIRUS_TAG_VALUE_ENCRYPTED", &c.TagValues.Encrypted)
+	env.string("ANTIVIRUS_TAG_VALUE_ACTIVE_CONTENT", &c.TagValues.ActiveContent)
+	env.string("ANTIVIRUS_DEFINITIONS_BUCKET", &c.DefinitionsBucket)
+	env.string("ANTIVIRUS_DEFINITIONS_DIR", &c.DefinitionsDir)
+	env.string("ANTIVIRUS_DEFINITIONS_POLICY", &c.DefinitionsPolicy)
+	env.duration("ANTIVIRUS_DEFINITIONS_MAX_AGE", &c.DefinitionsMaxAge)
+	env.duration("ANTIVIRUS_DEFINITIONS_RELOAD_INTERVAL", &c.DefinitionsReloadInterval)
+	env.string("ANTIVIRUS_CLAMD_CONFIG", &c.ClamdConfig)
+	env.string("ANTIVIRUS_TEMP_DIR", &c.TempDir)
+	env.int64("ANTIVIRUS_MAX_SIZE", &c.MaxSize)
+	env.string("ANTIVIRUS_RULES_FILE", &c.RulesFile)
+	env.string("ANTIVIRUS_RESULT_WRITER", &c.ResultWriter)
+	env.string("ANTIVIRUS_RESULT_PREFIX", &c.ResultPrefix)
+	env.string("ANTIVIRUS_LEDGER_TABLE", &c.LedgerTable)
+	env.string("ANTIVIRUS_LEDGER_VERDICT_INDEX", &c.LedgerVerdictIndex)
+	env.bool("ANTIVIRUS_LEDGER_REQUIRED", &c.LedgerRequired)
+	env.string("ANTIVIRUS_HASH_LIST_BUCKET", &c.HashListBucket)
+	env.string("ANTIVIRUS_ALLOW_LIST_KEY", &c.AllowListKey)
+	env.string("ANTIVIRUS_BLOCK_LIST_KEY", &c.BlockListKey)
+	env.duration("ANTIVIRUS_HASH_LIST_REFRESH_INTERVAL", &c.HashListRefreshInterval)
+	env.int64("ANTIVIRUS_ARCHIVE_MAX_RATIO", &c.ArchiveMaxRatio)
+	env.int64("ANTIVIRUS_ARCHIVE_MAX_ENTRIES", &c.ArchiveMaxEntries)
+	env.int64("ANTIVIRUS_ARCHIVE_MAX_SIZE", &c.ArchiveMaxSize)
+	env.int64("ANTIVIRUS_ARCHIVE_MAX_DEPTH", &c.ArchiveMaxDepth)
+	env.bool("ANTIVIRUS_SCAN_ARCHIVE_MEMBERS", &c.ScanArchiveMembers)
+	env.bool("ANTIVIRUS_CHECK_ACTIVE_CONTENT", &c.CheckActiveContent)
+	env.string("ANTIVIRUS_PASSWORD_METADATA_KEY", &c.PasswordMetadataKey)
+	env.string("ANTIVIRUS_PASSWORDS_FILE", &c.PasswordsFile)
+	env.string("ANTIVIRUS_PASSWORD_PARAMETER_ENDPOINT", &c.PasswordParameterEndpoint)
+	env.string("ANTIVIRUS_PASSWORD_PARAMETER_PREFIX", &c.PasswordParameterPrefix)
+	env.list("ANTIVIRUS_ENGINES", &c.Engines)
+	env.string("ANTIVIRUS_ENGINE_MODE", &c.EngineMode)
+	env.string("ANTIVIRUS_ENGINE_CONSENSUS", &c.EngineConsensus)
+	env.string("ANTIVIRUS_YARA_RULES", &c.YaraRules)
+	env.string("ANTIVIRUS_ICAP_URL", &c.ICAPURL)
+
+	if err := env.err(); err != nil {
+		return Scan{}, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return Scan{}, err
+	}
+
+	return c, nil
+}
+
+func loadUpdate(lookup LookupFunc) (Update, error) {
+	c := Update{
+		LogLevel:         logging.DefaultLevel,
+		MetricsNamespace: metrics.DefaultNamespace,
+		DefinitionsDir:   "/tmp/clamav",
+		FreshclamConfig:  "/etc/freshclam.conf",
+	}
+
+	if err := readFile(lookup, &c); err != nil {
+		return Update{}, err
+	}
+
+	env := &envReader{lookup: lookup}
+	env.aws(&c.AWS)
+	env.logLevel(&c.LogLevel)
+	env.string("ANTIVIRUS_METRICS_NAMESPACE", &c.MetricsNamespace)
+	env.string("OTEL_EXPORTER_OTLP_ENDPOINT", &c.OTLPEndpoint)
+	env.string("ANTIVIRUS_DEFINITIONS_BUCKET", &c.DefinitionsBucket)
+	env.string("ANTIVIRUS_DEFINITIONS_DIR", &c.DefinitionsDir)
+	env.string("ANTIVIRUS_FRESHCLAM_CONFIG", &c.FreshclamConfig)
+	env.string("ANTIVIRUS_CUSTOM_SIGNATURES_BUCKET", &c.CustomSignaturesBucket)
+	env.string("ANTIVIRUS_CUSTOM_SIGNATURES_PREFIX", &c.CustomSignaturesPrefix)
+
+	if err := env.err(); err != nil {
+		return Update{}, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return Update{}, err
+	}
+
+	return c, nil
+}
+
+// Validate checks that required settings are present and well formed. All
+// problems are reported together.
+func (c Scan) Validate() error {
+	var errs []error
+
+	errs = append(errs, validateLogLevel(c.LogLevel)...)
+	errs = append(errs, required("ANTIVIRUS_METRICS_NAMESPACE", c.MetricsNamespace)...)
+	errs = append(errs, validateEndpoint("OTEL_EXPORTER_OTLP_ENDPOINT", c.OTLPEndpoint)...)
+
+	switch c.Handler {
+	case HandlerScan, HandlerObjectLambda:
+	default:
+		errs = append(errs, fmt.Errorf("ANTIVIRUS_HANDLER must be %q or %q, got %q", HandlerScan, HandlerObjectLambda, c.Handler))
+	}
+
+	errs = append(errs, validateTagKey("ANTIVIRUS_TAG_KEY", c.TagKey)...)
+	errs = append(errs, required("ANTIVIRUS_TAG_VALUE_PASS", c.TagValues.Pass)...)
+	errs = append(errs, required("ANTIVIRUS_TAG_VALUE_FAIL", c.TagValues.Fail)...)
+	errs = append(errs, c.TagValues.Validate(tagValueEnv)...)
+
+	if c.Handler == HandlerObjectLambda && c.ResultWriter != antivirus.ResultWriterTags {
+		errs = append(errs, fmt.Errorf("ANTIVIRUS_RESULT_WRITER must be tags for the %q handler, which only reads tags, got %q", HandlerObjectLambda, c.ResultWriter))
+	}
+
+	if c.Handler == HandlerScan {
+		errs = append(errs, required("ANTIVIRUS_DEFINITIONS_BUCKET", c.DefinitionsBucket)...)
+		errs = append(errs, validateCreatableDir("ANTIVIRUS_DEFINITIONS_DIR", c.DefinitionsDir)...)
+
+		switch antivirus.DefinitionsPolicy(c.DefinitionsPolicy) {
+		case antivirus.DefinitionsFailOpen, antivirus.DefinitionsFailClosed, antivirus.DefinitionsTagStale:
+		default:
+			errs = append(errs, fmt.Errorf("ANTIVIRUS_DEFINITIONS_POLICY must be fail-open, fail-closed or tag-stale, got %q", c.DefinitionsPolicy))
+		}
+		if c.DefinitionsMaxAge < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_DEFINITIONS_MAX_AGE must not be negative"))
+		}
+		if c.DefinitionsReloadInterval < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_DEFINITIONS_RELOAD_INTERVAL must not be negative"))
+		}
+
+		errs = append(errs, validateFile("ANTIVIRUS_CLAMD_CONFIG", c.ClamdConfig)...)
+		errs = append(errs, validateDir("ANTIVIRUS_TEMP_DIR", c.TempDir)...)
+
+		if c.MaxSize < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_MAX_SIZE must not be negative"))
+		}
+		if c.RulesFile != "" {
+			errs = append(errs, validateFile("ANTIVIRUS_RULES_FILE", c.RulesFile)...)
+		}
+
+		switch c.ResultWriter {
+		case antivirus.ResultWriterTags, antivirus.ResultWriterSidecar, antivirus.ResultWriterMetadata:
+		default:
+			errs = append(errs, fmt.Errorf("ANTIVIRUS_RESULT_WRITER must be tags, sidecar or metadata, got %q", c.ResultWriter))
+		}
+		if c.ResultPrefix == "" || strings.HasPrefix(c.ResultPrefix, "/") {
+			errs = append(errs, fmt.Errorf("ANTIVIRUS_RESULT_PREFIX must be a non-empty key prefix, got %q", c.ResultPrefix))
+		}
+
+		if c.HashListBucket != "" && c.AllowListKey == "" && c.BlockListKey == "" {
+			errs = append(errs, errors.New("ANTIVIRUS_HASH_LIST_BUCKET needs ANTIVIRUS_ALLOW_LIST_KEY or ANTIVIRUS_BLOCK_LIST_KEY"))
+		}
+		if c.HashListBucket == "" && (c.AllowListKey != "" || c.BlockListKey != "") {
+			errs = append(errs, errors.New("ANTIVIRUS_ALLOW_LIST_KEY and ANTIVIRUS_BLOCK_LIST_KEY need ANTIVIRUS_HASH_LIST_BUCKET"))
+		}
+		if c.HashListRefreshInterval < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_HASH_LIST_REFRESH_INTERVAL must not be negative"))
+		}
+
+		if c.ArchiveMaxRatio < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_ARCHIVE_MAX_RATIO must not be negative"))
+		}
+		if c.ArchiveMaxEntries < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_ARCHIVE_MAX_ENTRIES must not be negative"))
+		}
+		if c.ArchiveMaxSize < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_ARCHIVE_MAX_SIZE must not be negative"))
+		}
+		if c.ArchiveMaxDepth < 0 {
+			errs = append(errs, errors.New("ANTIVIRUS_ARCHIVE_MAX_DEPTH must not be negative"))
+		}
+
+		if c.PasswordsFile != "" || c.PasswordParameterEndpoint != "" {
+			errs = append(errs, required("ANTIVIRUS_PASSWORD_METADATA_KEY", c.PasswordMetadataKey)...)
+		}
+		if c.PasswordsFile != "" {
+			errs = append(errs, validateFile("ANTIVIRUS_PASSWORDS_FILE", c.PasswordsFile)...)
+		}
+		errs = append(errs, validateEndpoint("ANTIVIRUS_PASSWORD_PARAMETER_ENDPOINT", c.PasswordParameterEndpoint)...)
+		if c.PasswordsFile != "" && c.PasswordParameterEndpoint != "" {
+			errs = append(errs, errors.New("ANTIVIRUS_PASSWORDS_FILE and ANTIVIRUS_PASSWORD_PARAMETER_ENDPOINT cannot both be set"))
+		}
+		if c.PasswordParameterPrefix != "" && c.PasswordParameterEndpoint == "" {
+			errs = append(errs, errors.New("ANTIVIRUS_PASSWORD_PARAMETER_PREFIX is set without ANTIVIRUS_PASSWORD_PARAMETER_ENDPOINT"))
+		}
+
+		errs = append(errs, validateEngines(c)...)
+	}
+
+	return joinErrors(errs)
+}
+
+// Validate checks that required settings are present and well formed. All
+// problems are reported together.
+func (c Update) Validate() error {
+	var errs []error
+
+	errs = append(errs, validateLogLevel(c.LogLevel)...)
+	errs = append(errs, required("ANTIVIRUS_METRICS_NAMESPACE", c.MetricsNamespace)...)
+	errs = append(errs, validateEndpoint("OTEL_EXPORTER_OTLP_ENDPOINT", c.OTLPEndpoint)...)
+	errs = append(errs, required("ANTIVIRUS_DEFINITIONS_BUCKET", c.DefinitionsBucket)...)
+	errs = append(errs, validateCreatableDir("ANTIVIRUS_DEFINITIONS_DIR", c.DefinitionsDir)...)
+	errs = append(errs, validateFile("ANTIVIRUS_FRESHCLAM_CONFIG", c.FreshclamConfig)...)
+
+	if c.CustomSignaturesPrefix != "" && c.CustomSignaturesBucket == "" {
+		errs = append(errs, errors.New("ANTIVIRUS_CUSTOM_SIGNATURES_PREFIX is set without ANTIVIRUS_CUSTOM_SIGNATURES_BUCKET"))
+	}
+	if strings.HasPrefix(c.CustomSignaturesPrefix, "/") {
+		errs = append(errs, fmt.Errorf("ANTIVIRUS_CUSTOM_SIGNATURES_PREFIX must be a key prefix, got %q", c.CustomSignaturesPrefix))
+	}
+
+	return joinErrors(errs)
+}
+
+func readFile(lookup LookupFunc, v any) error {
+	path, ok := lookup(FileEnv)
+	if !ok || path == "" {
+		return nil
+	}
+
+	file, err := os.Open(path) //nolint:gosec // path is set by infra
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer file.Close() //nolint:errcheck // no need to check error when closing file
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// envReader overrides fields with values from the environment, collecting any
+// that cannot be parsed.
+type envReader struct {
+	lookup LookupFunc
+	errs   []error
+}
+
+func (r *envReader) aws(c *AWS) {
+	r.string("AWS_REGION", &c.Region)
+	r.string("AWS_S3_ENDPOINT", &c.S3Endpoint)
+	r.string("AWS_DYNAMODB_ENDPOINT", &c.DynamoDBEndpoint)
+}
+
+// logLevel reads the level set by Lambda's advanced logging controls, which
+// ANTIVIRUS_LOG_LEVEL overrides.
+func (r *envReader) logLevel(field *string) {
+	r.string("AWS_LAMBDA_LOG_LEVEL", field)
+	r.string("ANTIVIRUS_LOG_LEVEL", field)
+}
+
+func (r *envReader) string(key string, field *string) {
+	if v, ok := r.lookup(key); ok {
+		*field = v
+	}
+}
+
+func (r *envReader) int64(key string, field *int64) {
+	if v, ok := r.lookup(key); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("%s must be a whole number, got %q", key, v))
+			return
+		}
+		*field = i
+	}
+}
+
+func (r *envReader) bool(key string, field *bool) {
+	if v, ok := r.lookup(key); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("%s must be true or false, got %q", key, v))
+			return
+		}
+		*field = b
+	}
+}
+
+// list reads a comma separated list.
+func (r *envReader) list(key string, field *[]string) {
+	if v, ok := r.lookup(key); ok {
+		*field = nil
+		for item := range strings.SplitSeq(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	}
+}
+
+func (r *envReader) duration(key string, field *Duration) {
+	if v, ok := r.lookup(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("%s must be a duration such as 36h, got %q", key, v))
+			return
+		}
+		*field = Duration(d)
+	}
+}
+
+func (r *envReader) err() error {
+	return joinErrors(r.errs)
+}
+
+func joinErrors(errs []error) error {
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return nil
+}
+
+func validateEngines(c Scan) []error {
+	var errs []error
+
+	for i, engine := range c.Engines {
+		switch engine {
+		case antivirus.EngineClamAV, antivirus.EngineYara, antivirus.EngineICAP:
+		default:
+			errs = append(errs, fmt.Errorf("ANTIVIRUS_ENGINES must only list clamav, yara or icap, got %q", engine))
+		}
+		if slices.Contains(c.Engines[:i], engine) {
+			errs = append(errs, fmt.Errorf("ANTIVIRUS_ENGINES lists %q more than once", engine))
+		}
+	}
+	if !slices.Contains(c.Engines, antivirus.EngineClamAV) {
+		errs = append(errs, errors.New("ANTIVIRUS_ENGINES must include clamav"))
+	}
+
+	switch c.EngineMode {
+	case antivirus.EngineModeSequence, antivirus.EngineModeParallel:
+	default:
+		errs = append(errs, fmt.Errorf("ANTIVIRUS_ENGINE_MODE must be sequence or parallel, got %q", c.EngineMode))
+	}
+
+	switch c.EngineConsensus {
+	case antivirus.ConsensusAnyInfected, antivirus.ConsensusMajority, antivirus.ConsensusPrimary:
+	default:
+		errs = append(errs, fmt.Errorf("ANTIVIRUS_ENGINE_CONSENSUS must be any-infected, majority or primary-with-fallback, got %q", c.EngineConsensus))
+	}
+
+	if slices.Contains(c.Engines, antivirus.EngineYara) {
+		errs = append(errs, validateFile("ANTIVIRUS_YARA_RULES", c.YaraRules)...)
+
+		// yara is run for each scan, so check it is installed before the
+		// first one fails.
+		if _, err := exec.LookPath(antivirus.DefaultYaraCommand); err != nil {
+			errs = append(errs, fmt.Errorf("ANTIVIRUS_ENGINES lists yara, which is not installed: %w", err))
+		}
+	}
+	if slices.Contains(c.Engines, antivirus.EngineICAP) {
+		if u, err := url.Parse(c.ICAPURL); err != nil || u.Scheme != "icap" || u.Hostname() == "" {
+			errs = append(errs, fmt.Errorf("ANTIVIRUS_ICAP_URL must be an icap URL, got %q", c.ICAPURL))
+		}
+	}
+
+	return errs
+}
+
+func required(name, value string) []error {
+	if value == "" {
+		return []error{fmt.Errorf("%s is required", name)}
+	}
+
+	return nil
+}
+
+func validateLogLevel(value string) []error {
+	if _, err := logging.ParseLevel(value); err != nil {
+		return []error{fmt.Errorf("ANTIVIRUS_LOG_LEVEL must be trace, debug, info, warn, error or fatal, got %q", value)}
+	}
+
+	return nil
+}
+
+// validateEndpoint accepts an empty value, as endpoints are optional.
+func validateEndpoint(name, value string) []error {
+	if value == "" {
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return []error{fmt.Errorf("%s must be an http or https URL, got %q", name, value)}
+	}
+
+	return nil
+}
+
+func validateTagKey(name, value string) []error {
+	return prefixErrors(name, antivirus.ValidateTagKey(value))
+}
+
+// tagValueEnv names the variable setting the tag value called field in JSON,
+// for example ANTIVIRUS_TAG_VALUE_STALE_DEFINITIONS for staleDefinitions.
+func tagValueEnv(field string) string {
+	var name strings.Builder
+	name.WriteString("ANTIVIRUS_TAG_VALUE_")
+	for _, r := range field {
+		if unicode.IsUpper(r) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+
+	return name.String()
+}
+
+func prefixErrors(name string, errs []error) []error {
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%s %w", name, err)
+	}
+
+	return errs
+}
+
+func validateFile(name, path string) []error {
+	if !filepath.IsAbs(path) {
+		return []error{fmt.Errorf("%s must be an absolute path, got %q", name, path)}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %w", name, err)}
+	}
+	if info.IsDir() {
+		return []error{fmt.Errorf("%s: %s is a directory", name, path)}
+	}
+
+	return nil
+}
+
+func validateDir(name, path string) []error {
+	if !filepath.IsAbs(path) {
+		return []error{fmt.Errorf("%s must be an absolute path, got %q", name, path)}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %w", name, err)}
+	}
+	if !info.IsDir() {
+		return []error{fmt.Errorf("%s: %s is not a directory", name, path)}
+	}
+
+	return nil
+}
+
+// validateCreatableDir accepts a directory that either exists or can be
+// created because its parent does.
+func validateCreatableDir(name, path string) []error {
+	if !filepath.IsAbs(path) {
+		return []error{fmt.Errorf("%s must be an absolute path, got %q", name, path)}
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return []error{fmt.Errorf("%s: %s is not a directory", name, path)}
+		}
+		return nil
+	}
+
+	return validateDir(name, filepath.Dir(path))
+}
@@ -0,0 +1,296 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+	"github.com/stretchr/testify/assert"
+)
+
+func lookupMap(env map[string]string) LookupFunc {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScan(t *testing.T) {
+	dir := t.TempDir()
+	clamdConfig := writeFile(t, dir, "clamd.conf", "")
+
+	c, err := loadScan(lookupMap(map[string]string{
+		"AWS_REGION":                   "eu-west-1",
+		"ANTIVIRUS_TAG_KEY":            "virus-scan-status",
+		"ANTIVIRUS_TAG_VALUE_PASS":     "ok",
+		"ANTIVIRUS_TAG_VALUE_FAIL":     "infected",
+		"ANTIVIRUS_DEFINITIONS_BUCKET": "virus-definitions",
+		"ANTIVIRUS_DEFINITIONS_DIR":    filepath.Join(dir, "clamav"),
+		"ANTIVIRUS_CLAMD_CONFIG":       clamdConfig,
+		"ANTIVIRUS_TEMP_DIR":           dir,
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, Scan{
+		AWS:               AWS{Region: "eu-west-1"},
+		LogLevel:          "info",
+		MetricsNamespace:  "opg-s3-antivirus",
+		Handler:           HandlerScan,
+		TagKey:            "virus-scan-status",
+		TagValues:         antivirus.TagValues{Pass: "ok", Fail: "infected"},
+		DefinitionsBucket: "virus-definitions",
+		DefinitionsDir:    filepath.Join(dir, "clamav"),
+		DefinitionsPolicy: "fail-closed",
+		ClamdConfig:       clamdConfig,
+		TempDir:           dir,
+		ResultWriter:      "tags",
+		ResultPrefix:      "scan-results/",
+
+		LedgerVerdictIndex: "verdict-index",
+
+		DefinitionsReloadInterval: Duration(time.Hour),
+
+		HashListRefreshInterval: Duration(5 * time.Minute),
+
+		ArchiveMaxRatio:   100,
+		ArchiveMaxEntries: 10000,
+		ArchiveMaxSize:    400 << 20,
+		ArchiveMaxDepth:   5,
+
+		PasswordMetadataKey: "archive-password-ref",
+
+		Engines:         []string{"clamav"},
+		EngineMode:      "sequence",
+		EngineConsensus: "any-infected",
+	}, c)
+}
+
+func TestLoadScanFromFile(t *testing.T) {
+	dir := t.TempDir()
+	clamdConfig := writeFile(t, dir, "clamd.conf", "")
+	file := writeFile(t, dir, "config.json", `{
+		"tagKey": "virus-scan-status",
+		"tagValues": {"pass": "ok", "fail": "infected"},
+		"definitionsBucket": "from-file",
+		"definitionsDir": "`+dir+`",
+		"clamdConfig": "`+clamdConfig+`",
+		"tempDir": "`+dir+`",
+		"definitionsMaxAge": "36h"
+	}`)
+
+	c, err := loadScan(lookupMap(map[string]string{
+		FileEnv:                        file,
+		"ANTIVIRUS_DEFINITIONS_BUCKET": "from-env",
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "virus-scan-status", c.TagKey)
+	assert.Equal(t, antivirus.TagValues{Pass: "ok", Fail: "infected"}, c.TagValues)
+	assert.Equal(t, "from-env", c.DefinitionsBucket)
+	assert.Equal(t, Duration(36*time.Hour), c.DefinitionsMaxAge)
+}
+
+func TestLoadScanFromFileWithUnknownField(t *testing.T) {
+	file := writeFile(t, t.TempDir(), "config.json", `{"tagName": "virus-scan-status"}`)
+
+	_, err := loadScan(lookupMap(map[string]string{FileEnv: file}))
+	assert.ErrorContains(t, err, `unknown field "tagName"`)
+}
+
+func TestLoadScanWhenInvalid(t *testing.T) {
+	_, err := loadScan(lookupMap(map[string]string{
+		"ANTIVIRUS_LOG_LEVEL":                   "loud",
+		"OTEL_EXPORTER_OTLP_ENDPOINT":           "localhost:4318",
+		"ANTIVIRUS_TAG_VALUE_PASS":              "ok!",
+		"ANTIVIRUS_TAG_VALUE_FAIL":              "ok!",
+		"ANTIVIRUS_TAG_VALUE_STALE_DEFINITIONS": "stale!",
+		"ANTIVIRUS_DEFINITIONS_DIR":             "tmp/clamav",
+		"ANTIVIRUS_CLAMD_CONFIG":                "/does/not/exist",
+		"ANTIVIRUS_TEMP_DIR":                    "/does/not/exist",
+
+		"ANTIVIRUS_DEFINITIONS_POLICY": "ignore",
+		"ANTIVIRUS_BLOCK_LIST_KEY":     "block.txt",
+		"ANTIVIRUS_ARCHIVE_MAX_DEPTH":  "-1",
+
+		"ANTIVIRUS_PASSWORDS_FILE":              "/does/not/exist",
+		"ANTIVIRUS_PASSWORD_PARAMETER_ENDPOINT": "localhost:2773",
+	}))
+
+	assert.Equal(t, `invalid configuration: ANTIVIRUS_LOG_LEVEL must be trace, debug, info, warn, error or fatal, got "loud"
+OTEL_EXPORTER_OTLP_ENDPOINT must be an http or https URL, got "localhost:4318"
+ANTIVIRUS_TAG_KEY is required
+ANTIVIRUS_TAG_VALUE_PASS contains characters not allowed in S3 tags: "ok!"
+ANTIVIRUS_TAG_VALUE_FAIL contains characters not allowed in S3 tags: "ok!"
+ANTIVIRUS_TAG_VALUE_STALE_DEFINITIONS contains characters not allowed in S3 tags: "stale!"
+ANTIVIRUS_TAG_VALUE_PASS and ANTIVIRUS_TAG_VALUE_FAIL must be different
+ANTIVIRUS_DEFINITIONS_BUCKET is required
+ANTIVIRUS_DEFINITIONS_DIR must be an absolute path, got "tmp/clamav"
+ANTIVIRUS_DEFINITIONS_POLICY must be fail-open, fail-closed or tag-stale, got "ignore"
+ANTIVIRUS_CLAMD_CONFIG: stat /does/not/exist: no such file or directory
+ANTIVIRUS_TEMP_DIR: stat /does/not/exist: no such file or directory
+ANTIVIRUS_ALLOW_LIST_KEY and ANTIVIRUS_BLOCK_LIST_KEY need ANTIVIRUS_HASH_LIST_BUCKET
+ANTIVIRUS_ARCHIVE_MAX_DEPTH must not be negative
+ANTIVIRUS_PASSWORDS_FILE: stat /does/not/exist: no such file or directory
+ANTIVIRUS_PASSWORD_PARAMETER_ENDPOINT must be an http or https URL, got "localhost:2773"
+ANTIVIRUS_PASSWORDS_FILE and ANTIVIRUS_PASSWORD_PARAMETER_ENDPOINT cannot both be set`, err.Error())
+}
+
+func TestLoadScanWithEngines(t *testing.T) {
+	dir := t.TempDir()
+	clamdConfig := writeFile(t, dir, "clamd.conf", "")
+	yaraRules := writeFile(t, dir, "rules.yar", "")
+
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "yara"), []byte("#!/bin/sh\n"), 0700); err != nil { //nolint:gosec // test script must be executable
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	c, err := loadScan(lookupMap(map[string]string{
+		"ANTIVIRUS_TAG_KEY":            "virus-scan-status",
+		"ANTIVIRUS_TAG_VALUE_PASS":     "ok",
+		"ANTIVIRUS_TAG_VALUE_FAIL":     "infected",
+		"ANTIVIRUS_DEFINITIONS_BUCKET": "virus-definitions",
+		"ANTIVIRUS_DEFINITIONS_DIR":    filepath.Join(dir, "clamav"),
+		"ANTIVIRUS_CLAMD_CONFIG":       clamdConfig,
+		"ANTIVIRUS_TEMP_DIR":           dir,
+
+		"ANTIVIRUS_ENGINES":          "clamav, yara,icap",
+		"ANTIVIRUS_ENGINE_MODE":      "parallel",
+		"ANTIVIRUS_ENGINE_CONSENSUS": "majority",
+		"ANTIVIRUS_YARA_RULES":       yaraRules,
+		"ANTIVIRUS_ICAP_URL":         "icap://icap.internal:1344/avscan",
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"clamav", "yara", "icap"}, c.Engines)
+	assert.Equal(t, "parallel", c.EngineMode)
+	assert.Equal(t, "majority", c.EngineConsensus)
+}
+
+func TestLoadScanWhenEnginesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	clamdConfig := writeFile(t, dir, "clamd.conf", "")
+	t.Setenv("PATH", t.TempDir())
+
+	_, err := loadScan(lookupMap(map[string]string{
+		"ANTIVIRUS_TAG_KEY":            "virus-scan-status",
+		"ANTIVIRUS_TAG_VALUE_PASS":     "ok",
+		"ANTIVIRUS_TAG_VALUE_FAIL":     "infected",
+		"ANTIVIRUS_DEFINITIONS_BUCKET": "virus-definitions",
+		"ANTIVIRUS_DEFINITIONS_DIR":    filepath.Join(dir, "clamav"),
+		"ANTIVIRUS_CLAMD_CONFIG":       clamdConfig,
+		"ANTIVIRUS_TEMP_DIR":           dir,
+
+		"ANTIVIRUS_ENGINES":          "yara,sophos,icap,icap",
+		"ANTIVIRUS_ENGINE_MODE":      "both",
+		"ANTIVIRUS_ENGINE_CONSENSUS": "all",
+		"ANTIVIRUS_ICAP_URL":         "http://icap.internal",
+	}))
+
+	assert.Equal(t, `invalid configuration: ANTIVIRUS_ENGINES must only list clamav, yara or icap, got "sophos"
+ANTIVIRUS_ENGINES lists "icap" more than once
+ANTIVIRUS_ENGINES must include clamav
+ANTIVIRUS_ENGINE_MODE must be sequence or parallel, got "both"
+ANTIVIRUS_ENGINE_CONSENSUS must be any-infected, majority or primary-with-fallback, got "all"
+ANTIVIRUS_YARA_RULES must be an absolute path, got ""
+ANTIVIRUS_ENGINES lists yara, which is not installed: exec: "yara": executable file not found in $PATH
+ANTIVIRUS_ICAP_URL must be an icap URL, got "http://icap.internal"`, err.Error())
+}
+
+func TestLoadScanWhenUnparseable(t *testing.T) {
+	_, err := loadScan(lookupMap(map[string]string{
+		"ANTIVIRUS_MAX_SIZE":             "10MB",
+		"ANTIVIRUS_DEFINITIONS_MAX_AGE":  "2 days",
+		"ANTIVIRUS_SCAN_ARCHIVE_MEMBERS": "yes please",
+	}))
+
+	assert.Equal(t, `invalid configuration: ANTIVIRUS_DEFINITIONS_MAX_AGE must be a duration such as 36h, got "2 days"
+ANTIVIRUS_MAX_SIZE must be a whole number, got "10MB"
+ANTIVIRUS_SCAN_ARCHIVE_MEMBERS must be true or false, got "yes please"`, err.Error())
+}
+
+func TestLoadScanObjectLambda(t *testing.T) {
+	c, err := loadScan(lookupMap(map[string]string{
+		"ANTIVIRUS_HANDLER":        HandlerObjectLambda,
+		"ANTIVIRUS_TAG_KEY":        "virus-scan-status",
+		"ANTIVIRUS_TAG_VALUE_PASS": "ok",
+		"ANTIVIRUS_TAG_VALUE_FAIL": "infected",
+		"ANTIVIRUS_CLAMD_CONFIG":   "/does/not/exist",
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, HandlerObjectLambda, c.Handler)
+
+	_, err = loadScan(lookupMap(map[string]string{
+		"ANTIVIRUS_HANDLER":        HandlerObjectLambda,
+		"ANTIVIRUS_TAG_KEY":        "virus-scan-status",
+		"ANTIVIRUS_TAG_VALUE_PASS": "ok",
+		"ANTIVIRUS_TAG_VALUE_FAIL": "infected",
+		"ANTIVIRUS_RESULT_WRITER":  "sidecar",
+	}))
+
+	assert.Equal(t, `invalid configuration: ANTIVIRUS_RESULT_WRITER must be tags for the "object-lambda" handler, which only reads tags, got "sidecar"`, err.Error())
+}
+
+func TestValidateTagKey(t *testing.T) {
+	assert.Nil(t, validateTagKey("KEY", "virus-scan-status"))
+	assert.Nil(t, validateTagKey("KEY", "scan status/result:v1 @team+"))
+	assert.Len(t, validateTagKey("KEY", "aws:scan"), 1)
+	assert.Len(t, validateTagKey("KEY", "scan*status"), 1)
+	assert.Len(t, validateTagKey("KEY", string(make([]byte, 129))), 2)
+}
+
+func TestLoadUpdate(t *testing.T) {
+	dir := t.TempDir()
+	freshclamConfig := writeFile(t, dir, "freshclam.conf", "")
+
+	c, err := loadUpdate(lookupMap(map[string]string{
+		"AWS_LAMBDA_LOG_LEVEL":         "DEBUG",
+		"OTEL_EXPORTER_OTLP_ENDPOINT":  "http://collector:4318",
+		"ANTIVIRUS_DEFINITIONS_BUCKET": "virus-definitions",
+		"ANTIVIRUS_DEFINITIONS_DIR":    filepath.Join(dir, "clamav"),
+		"ANTIVIRUS_FRESHCLAM_CONFIG":   freshclamConfig,
+
+		"ANTIVIRUS_CUSTOM_SIGNATURES_BUCKET": "security-signatures",
+		"ANTIVIRUS_CUSTOM_SIGNATURES_PREFIX": "clamav/",
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, Update{
+		LogLevel:          "DEBUG",
+		MetricsNamespace:  "opg-s3-antivirus",
+		OTLPEndpoint:      "http://collector:4318",
+		DefinitionsBucket: "virus-definitions",
+		DefinitionsDir:    filepath.Join(dir, "clamav"),
+		FreshclamConfig:   freshclamConfig,
+
+		CustomSignaturesBucket: "security-signatures",
+		CustomSignaturesPrefix: "clamav/",
+	}, c)
+}
+
+func TestLoadUpdateWhenInvalid(t *testing.T) {
+	_, err := loadUpdate(lookupMap(map[string]string{
+		"ANTIVIRUS_DEFINITIONS_DIR":  "/does/not/exist/clamav",
+		"ANTIVIRUS_FRESHCLAM_CONFIG": "/does/not/exist",
+
+		"ANTIVIRUS_CUSTOM_SIGNATURES_PREFIX": "/clamav",
+	}))
+
+	assert.Equal(t, `invalid configuration: ANTIVIRUS_DEFINITIONS_BUCKET is required
+ANTIVIRUS_DEFINITIONS_DIR: stat /does/not/exist: no such file or directory
+ANTIVIRUS_FRESHCLAM_CONFIG: stat /does/not/exist: no such file or directory
+ANTIVIRUS_CUSTOM_SIGNATURES_PREFIX is set without ANTIVIRUS_CUSTOM_SIGNATURES_BUCKET
+ANTIVIRUS_CUSTOM_SIGNATURES_PREFIX must be a key prefix, got "/clamav"`, err.Error())
+}
@@ -0,0 +1,201 @@
+// Package cvd reads the headers of ClamAV signature databases. Both .cvd and
+// .cld files start with a 512 byte header of colon separated fields:
+//
+//	ClamAV-VDB:build time:version:signatures:functionality level:md5:dsig:builder:stime
+package cvd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const headerSize = 512
+
+var ErrNotDatabase = errors.New("not a ClamAV database")
+
+type Header struct {
+	BuildTime          time.Time
+	Version            int
+	Signatures         int
+	FunctionalityLevel int
+	MD5                string
+	Builder            string
+}
+
+// ReadHeader reads the header at the start of a .cvd or .cld file.
+func ReadHeader(path string) (Header, error) {
+	file, err := os.Open(path) //nolint:gosec // path is a definitions file chosen by the caller
+	if err != nil {
+		return Header{}, err
+	}
+	defer file.Close() //nolint:errcheck // no need to check error when closing file
+
+	buf := make([]byte, headerSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return Header{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	header, err := Parse(buf[:n])
+	if err != nil {
+		return Header{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return header, nil
+}
+
+// Parse reads a header from the first bytes of a database.
+func Parse(b []byte) (Header, error) {
+	if len(b) > headerSize {
+		b = b[:headerSize]
+	}
+	b = bytes.TrimRight(b, " \x00")
+
+	fields := strings.Split(string(b), ":")
+	if len(fields) < 8 || fields[0] != "ClamAV-VDB" {
+		return Header{}, ErrNotDatabase
+	}
+
+	var (
+		h   Header
+		err error
+	)
+
+	if h.Version, err = strconv.Atoi(fields[2]); err != nil {
+		return Header{}, fmt.Errorf("invalid version %q", fields[2])
+	}
+	if h.Signatures, err = strconv.Atoi(fields[3]); err != nil {
+		return Header{}, fmt.Errorf("invalid signature count %q", fields[3])
+	}
+	if h.FunctionalityLevel, err = strconv.Atoi(fields[4]); err != nil {
+		return Header{}, fmt.Errorf("invalid functionality level %q", fields[4])
+	}
+	h.MD5 = fields[5]
+	h.Builder = fields[7]
+
+	if len(fields) > 8 {
+		if stime, err := strconv.ParseInt(strings.TrimSpace(fields[8]), 10, 64); err == nil {
+			h.BuildTime = time.Unix(stime, 0).UTC()
+		}
+	}
+	if h.BuildTime.IsZero() {
+		if t, err := time.Parse("02 Jan 2006 15-04 -0700", fields[1]); err == nil {
+			h.BuildTime = t.UTC()
+		}
+	}
+
+	return h, nil
+}
+
+// IsDatabase reports whether name has an extension that carries a header.
+func IsDatabase(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".cvd" || ext == ".cld"
+}
+
+// IsDefinitionFile reports whether name is a file published to the definitions
+// bucket: a database, an incremental update to one, the freshclam.dat state
+// file, or a custom signature database.
+func IsDefinitionFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".cvd", ".cld", ".cud", ".cdiff":
+		return true
+	}
+
+	return name == "freshclam.dat" || IsCustomSignature(name)
+}
+
+// IsCustomSignature reports whether name is a signature database that ClamAV
+// loads but does not publish, such as .ndb body signatures or YARA rules.
+func IsCustomSignature(name string) bool {
+	switch filepath.Ext(name) {
+	case ".ndb", ".hdb", ".hsb", ".ldb", ".yar", ".yara":
+		return true
+	}
+
+	return false
+}
+
+// ListDefinitions returns the names of the definition files in dir, sorted.
+func ListDefinitions(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && IsDefinitionFile(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// ReadDir reads the headers of every database in dir, keyed by file name.
+func ReadDir(dir string) (map[string]Header, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]Header{}
+	for _, entry := range entries {
+		if entry.IsDir() || !IsDatabase(entry.Name()) {
+			continue
+		}
+
+		header, err := ReadHeader(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		headers[entry.Name()] = header
+	}
+
+	return headers, nil
+}
+
+// Summary describes the versions of the databases in dir in a stable form such
+// as "bytecode:335,daily:27119,main:62".
+func Summary(dir string) (string, error) {
+	headers, err := ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, 0, len(headers))
+	for name, header := range headers {
+		parts = append(parts, fmt.Sprintf("%s:%d", strings.TrimSuffix(name, filepath.Ext(name)), header.Version))
+	}
+	slices.Sort(parts)
+
+	return strings.Join(parts, ","), nil
+}
+
+// LatestBuildTime returns when the most recently built database in dir was
+// built, which is the age of the signatures ClamAV is scanning with.
+func LatestBuildTime(dir string) (time.Time, error) {
+	headers, err := ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var latest time.Time
+	for _, header := range headers {
+		if header.BuildTime.After(latest) {
+			latest = header.BuildTime
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,110 @@
+package cvd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func header(s string) []byte {
+	b := make([]byte, headerSize)
+	copy(b, s)
+	for i := len(s); i < headerSize; i++ {
+		b[i] = ' '
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	h, err := Parse(header("ClamAV-VDB:09 Dec 2023 07-23 -0500:27119:2054360:90:a1b2c3:dsig:raynman:1702124580"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, Header{
+		BuildTime:          time.Date(2023, 12, 9, 12, 23, 0, 0, time.UTC),
+		Version:            27119,
+		Signatures:         2054360,
+		FunctionalityLevel: 90,
+		MD5:                "a1b2c3",
+		Builder:            "raynman",
+	}, h)
+}
+
+func TestParseWithoutStime(t *testing.T) {
+	h, err := Parse(header("ClamAV-VDB:09 Dec 2023 07-23 -0500:27119:2054360:90:a1b2c3:dsig:raynman"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2023, 12, 9, 12, 23, 0, 0, time.UTC), h.BuildTime)
+}
+
+func TestParseWhenInvalid(t *testing.T) {
+	_, err := Parse([]byte("DC:1234:5678"))
+	assert.Equal(t, ErrNotDatabase, err)
+
+	_, err = Parse(header("ClamAV-VDB:09 Dec 2023 07-23 -0500:x:2054360:90:a1b2c3:dsig:raynman"))
+	assert.Equal(t, `invalid version "x"`, err.Error())
+}
+
+func writeDatabases(t *testing.T) string {
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"main.cvd":      header("ClamAV-VDB:16 Sep 2021 08-32 -0400:62:6647427:90:md5:dsig:sigmgr:1631795520"),
+		"daily.cld":     header("ClamAV-VDB:09 Dec 2023 07-23 -0500:27119:2054360:90:md5:dsig:raynman:1702124580"),
+		"freshclam.dat": []byte("not a database"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSummary(t *testing.T) {
+	summary, err := Summary(writeDatabases(t))
+	assert.Nil(t, err)
+	assert.Equal(t, "daily:27119,main:62", summary)
+}
+
+func TestLatestBuildTime(t *testing.T) {
+	built, err := LatestBuildTime(writeDatabases(t))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1702124580, 0).UTC(), built.UTC())
+}
+
+func TestIsDefinitionFile(t *testing.T) {
+	for _, name := range []string{"main.cvd", "daily.cld", "bytecode.cud", "daily-27120.cdiff", "freshclam.dat", "opg.ndb"} {
+		assert.True(t, IsDefinitionFile(name), name)
+	}
+
+	for _, name := range []string{"clamd.pid", "clamd.sock", "mirrors.dat", "main"} {
+		assert.False(t, IsDefinitionFile(name), name)
+	}
+}
+
+func TestListDefinitions(t *testing.T) {
+	dir := writeDatabases(t)
+	for _, name := range []string{"daily-27120.cdiff", "clamd.pid"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "tmp.cvd"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := ListDefinitions(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"daily-27120.cdiff", "daily.cld", "freshclam.dat", "main.cvd"}, names)
+}
+
+func TestIsCustomSignature(t *testing.T) {
+	for _, name := range []string{"opg.ndb", "opg.hdb", "opg.hsb", "opg.ldb", "opg.yar", "opg.yara"} {
+		assert.True(t, IsCustomSignature(name), name)
+	}
+
+	for _, name := range []string{"main.cvd", "daily.cld", "freshclam.dat", "opg.txt"} {
+		assert.False(t, IsCustomSignature(name), name)
+	}
+}
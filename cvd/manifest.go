@@ -0,0 +1,185 @@
+package cvd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// ManifestName is the key the manifest is published under, alongside the
+// files it describes.
+const ManifestName = "manifest.json"
+
+// PointerName is the key of the Pointer to the current definitions set.
+const PointerName = "current.json"
+
+// VersionsPrefix is where each definitions set is published, under a prefix
+// of its own that is never written to again.
+const VersionsPrefix = "versions/"
+
+// Pointer names the definitions set that scanners should load. It is written
+// after every file in the set, so a reader that resolves it first always sees
+// a complete set, and writing an earlier version back rolls the set back.
+type Pointer struct {
+	Version string `json:"version"`
+	Prefix  string `json:"prefix"`
+}
+
+// NewPointer points at version under VersionsPrefix.
+func NewPointer(version string) Pointer {
+	return Pointer{Version: version, Prefix: VersionsPrefix + version + "/"}
+}
+
+// ParsePointer reads a pointer written by NewPointer.
+func ParsePointer(b []byte) (Pointer, error) {
+	var p Pointer
+	if err := json.Unmarshal(b, &p); err != nil {
+		return Pointer{}, fmt.Errorf("failed to parse pointer: %w", err)
+	}
+
+	if p.Prefix == "" {
+		return Pointer{}, errors.New("failed to parse pointer: prefix is empty")
+	}
+
+	return p, nil
+}
+
+var ErrManifestMismatch = errors.New("definitions do not match manifest")
+
+// Manifest lists the files in a published definitions set, so that a reader
+// can tell a complete, untampered set from a partial upload.
+type Manifest struct {
+	Files map[string]ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	// Key is where the file is stored in the bucket. Sets published before
+	// unchanged files were copied into each set may point into an earlier
+	// set. When empty the file is under the set's own prefix.
+	Key    string `json:"key,omitempty"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// Version and BuildTime are read from the header of databases, files
+	// such as freshclam.dat leave them empty.
+	Version   int       `json:"version,omitempty"`
+	BuildTime time.Time `json:"buildTime,omitzero"`
+}
+
+// BuildManifest describes the named files in dir.
+func BuildManifest(dir string, files []string) (Manifest, error) {
+	m := Manifest{Files: make(map[string]ManifestFile, len(files))}
+
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+
+		digest, size, err := hashFile(path)
+		if err != nil {
+			return Manifest{}, err
+		}
+
+		entry := ManifestFile{SHA256: digest, Size: size}
+		if IsDatabase(name) {
+			header, err := ReadHeader(path)
+			if err != nil {
+				return Manifest{}, err
+			}
+			entry.Version = header.Version
+			entry.BuildTime = header.BuildTime
+		}
+
+		m.Files[name] = entry
+	}
+
+	return m, nil
+}
+
+// Key returns where the file listed under name is stored, for a set published
+// under prefix.
+func (m Manifest) Key(prefix, name string) string {
+	if key := m.Files[name].Key; key != "" {
+		return key
+	}
+
+	return prefix + name
+}
+
+// Same reports whether the file listed under name has the same content in
+// both manifests.
+func (m Manifest) Same(other Manifest, name string) bool {
+	a, ok := m.Files[name]
+	if !ok {
+		return false
+	}
+	b, ok := other.Files[name]
+
+	return ok && a.SHA256 == b.SHA256 && a.Size == b.Size
+}
+
+// ParseManifest reads a manifest written by BuildManifest.
+func ParseManifest(b []byte) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	// Names become paths in the definitions directory, so anything other than
+	// a definitions file is refused rather than written somewhere else.
+	for name := range m.Files {
+		if filepath.Base(name) != name || !IsDefinitionFile(name) {
+			return Manifest{}, fmt.Errorf("failed to parse manifest: %q is not a definitions file", name)
+		}
+	}
+
+	return m, nil
+}
+
+// Names returns the names of the files in the manifest, sorted.
+func (m Manifest) Names() []string {
+	return slices.Sorted(maps.Keys(m.Files))
+}
+
+// Verify checks that the file at path is the one listed under name.
+func (m Manifest) Verify(name, path string) error {
+	entry, ok := m.Files[name]
+	if !ok {
+		return fmt.Errorf("%w: %s is not listed", ErrManifestMismatch, name)
+	}
+
+	digest, size, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+
+	if size != entry.Size {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrManifestMismatch, name, size, entry.Size)
+	}
+	if digest != entry.SHA256 {
+		return fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrManifestMismatch, name, digest, entry.SHA256)
+	}
+
+	return nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path) //nolint:gosec // path is a definitions file chosen by the caller
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close() //nolint:errcheck // no need to check error when closing file
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
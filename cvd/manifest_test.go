@@ -0,0 +1,139 @@
+package cvd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildManifest(t *testing.T) {
+	dir := writeDatabases(t)
+
+	m, err := BuildManifest(dir, []string{"daily.cld", "freshclam.dat"})
+	assert.Nil(t, err)
+
+	daily := sha256.Sum256(header("ClamAV-VDB:09 Dec 2023 07-23 -0500:27119:2054360:90:md5:dsig:raynman:1702124580"))
+	freshclam := sha256.Sum256([]byte("not a database"))
+
+	assert.Equal(t, Manifest{Files: map[string]ManifestFile{
+		"daily.cld": {
+			SHA256:    hex.EncodeToString(daily[:]),
+			Size:      512,
+			Version:   27119,
+			BuildTime: time.Unix(1702124580, 0).UTC(),
+		},
+		"freshclam.dat": {
+			SHA256: hex.EncodeToString(freshclam[:]),
+			Size:   14,
+		},
+	}}, m)
+}
+
+func TestBuildManifestWhenMissing(t *testing.T) {
+	_, err := BuildManifest(t.TempDir(), []string{"main.cvd"})
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir := writeDatabases(t)
+
+	m, err := BuildManifest(dir, []string{"main.cvd", "freshclam.dat"})
+	assert.Nil(t, err)
+
+	b, err := json.Marshal(m)
+	assert.Nil(t, err)
+
+	parsed, err := ParseManifest(b)
+	assert.Nil(t, err)
+	assert.Equal(t, m, parsed)
+}
+
+func TestParseManifestWhenNameUnsafe(t *testing.T) {
+	for _, name := range []string{"../main.cvd", "versions/main.cvd", "clamd.conf"} {
+		_, err := ParseManifest([]byte(`{"files": {"` + name + `": {}}}`))
+		assert.Equal(t, `failed to parse manifest: "`+name+`" is not a definitions file`, err.Error())
+	}
+}
+
+func TestManifestNames(t *testing.T) {
+	m := Manifest{Files: map[string]ManifestFile{"main.cvd": {}, "daily.cld": {}, "bytecode.cvd": {}}}
+
+	assert.Equal(t, []string{"bytecode.cvd", "daily.cld", "main.cvd"}, m.Names())
+}
+
+func TestManifestVerify(t *testing.T) {
+	dir := writeDatabases(t)
+
+	m, err := BuildManifest(dir, []string{"main.cvd", "freshclam.dat"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, m.Verify("main.cvd", filepath.Join(dir, "main.cvd")))
+
+	err = m.Verify("daily.cld", filepath.Join(dir, "daily.cld"))
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+	assert.Equal(t, "definitions do not match manifest: daily.cld is not listed", err.Error())
+
+	err = m.Verify("freshclam.dat", filepath.Join(dir, "main.cvd"))
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+	assert.Equal(t, "definitions do not match manifest: freshclam.dat is 512 bytes, expected 14", err.Error())
+
+	if err := os.WriteFile(filepath.Join(dir, "freshclam.dat"), []byte("not a dat4base"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = m.Verify("freshclam.dat", filepath.Join(dir, "freshclam.dat"))
+	assert.ErrorIs(t, err, ErrManifestMismatch)
+	assert.Contains(t, err.Error(), "freshclam.dat has sha256 ")
+}
+
+func TestPointerRoundTrip(t *testing.T) {
+	p := NewPointer("20240110T120000Z")
+	assert.Equal(t, Pointer{Version: "20240110T120000Z", Prefix: "versions/20240110T120000Z/"}, p)
+
+	b, err := json.Marshal(p)
+	assert.Nil(t, err)
+
+	parsed, err := ParsePointer(b)
+	assert.Nil(t, err)
+	assert.Equal(t, p, parsed)
+}
+
+func TestParsePointerWhenInvalid(t *testing.T) {
+	_, err := ParsePointer([]byte(`{"version": "1"}`))
+	assert.Equal(t, "failed to parse pointer: prefix is empty", err.Error())
+
+	_, err = ParsePointer([]byte(`[]`))
+	assert.ErrorContains(t, err, "failed to parse pointer: ")
+}
+
+func TestManifestKey(t *testing.T) {
+	m := Manifest{Files: map[string]ManifestFile{
+		"main.cvd":  {Key: "versions/v1/main.cvd"},
+		"daily.cvd": {},
+	}}
+
+	assert.Equal(t, "versions/v1/main.cvd", m.Key("versions/v2/", "main.cvd"))
+	assert.Equal(t, "versions/v2/daily.cvd", m.Key("versions/v2/", "daily.cvd"))
+}
+
+func TestManifestSame(t *testing.T) {
+	a := Manifest{Files: map[string]ManifestFile{
+		"main.cvd":  {SHA256: "abc", Size: 3},
+		"daily.cvd": {SHA256: "def", Size: 3},
+	}}
+	b := Manifest{Files: map[string]ManifestFile{
+		"main.cvd":  {Key: "versions/v1/main.cvd", SHA256: "abc", Size: 3},
+		"daily.cvd": {SHA256: "123", Size: 3},
+	}}
+
+	assert.True(t, a.Same(b, "main.cvd"))
+	assert.False(t, a.Same(b, "daily.cvd"))
+	assert.False(t, a.Same(b, "bytecode.cvd"))
+	assert.False(t, a.Same(Manifest{}, "main.cvd"))
+}
@@ -0,0 +1,287 @@
+// Package ledger keeps an audit record of every scan in a DynamoDB table, as
+// object tags can be changed by anyone with s3:PutObjectTagging.
+//
+// The table has a partition key "object" holding "bucket/key" and a sort key
+// "scannedAt" holding an RFC 3339 timestamp. A global secondary index, named
+// "verdict-index" by default, has a partition key "verdict" and the same sort
+// key.
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+)
+
+const DefaultVerdictIndex = "verdict-index"
+
+type Client interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// Entry is a single scan in the ledger.
+type Entry struct {
+	Bucket             string
+	Key                string
+	VersionID          string
+	ETag               string
+	SHA256             string
+	Verdict            string
+	Clean              bool
+	Signature          string
+	Reason             string
+	InfectedMembers    []antivirus.InfectedMember
+	Engines            []antivirus.EngineVerdict
+	DefinitionsVersion string
+	Duration           time.Duration
+	RequestID          string
+	ScannedAt          time.Time
+}
+
+type Ledger struct {
+	client       Client
+	table        string
+	verdictIndex string
+	now          func() time.Time
+}
+
+// New creates a Ledger writing to table, queried by verdict using
+// verdictIndex. When verdictIndex is empty DefaultVerdictIndex is used.
+func New(client Client, table, verdictIndex string) *Ledger {
+	if verdictIndex == "" {
+		verdictIndex = DefaultVerdictIndex
+	}
+
+	return &Ledger{
+		client:       client,
+		table:        table,
+		verdictIndex: verdictIndex,
+		now:          time.Now,
+	}
+}
+
+// Record writes result to the ledger, it implements antivirus.Recorder. The
+// request ID is taken from the Lambda context when there is one.
+func (l *Ledger) Record(ctx context.Context, result antivirus.Result) error {
+	entry := Entry{
+		Bucket:             result.Object.Bucket,
+		Key:                result.Object.Key,
+		VersionID:          result.Object.VersionID,
+		ETag:               result.Object.ETag,
+		SHA256:             result.SHA256,
+		Verdict:            result.Status,
+		Clean:              result.Verdict.Clean,
+		Signature:          result.Verdict.Signature,
+		Reason:             result.Verdict.Reason,
+		InfectedMembers:    result.InfectedMembers,
+		Engines:            result.Verdict.Engines,
+		DefinitionsVersion: result.DefinitionsVersion,
+		Duration:           result.Duration,
+		ScannedAt:          l.now().UTC(),
+	}
+
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		entry.RequestID = lc.AwsRequestID
+	}
+
+	return l.Put(ctx, entry)
+}
+
+// Put writes an entry to the ledger.
+func (l *Ledger) Put(ctx context.Context, entry Entry) error {
+	if _, err := l.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item:      marshal(entry),
+	}); err != nil {
+		return fmt.Errorf("failed to write ledger entry: %w", err)
+	}
+
+	return nil
+}
+
+// QueryByKey returns every scan of an object, oldest first.
+func (l *Ledger) QueryByKey(ctx context.Context, bucket, key string) ([]Entry, error) {
+	return l.query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(l.table),
+		KeyConditionExpression: aws.String("#object = :object"),
+		ExpressionAttributeNames: map[string]string{
+			"#object": "object",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":object": &types.AttributeValueMemberS{Value: bucket + "/" + key},
+		},
+	})
+}
+
+// QueryByVerdict returns every scan with the given verdict since a time,
+// oldest first.
+func (l *Ledger) QueryByVerdict(ctx context.Context, verdict string, since time.Time) ([]Entry, error) {
+	return l.query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(l.table),
+		IndexName:              aws.String(l.verdictIndex),
+		KeyConditionExpression: aws.String("verdict = :verdict AND scannedAt >= :since"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":verdict": &types.AttributeValueMemberS{Value: verdict},
+			":since":   &types.AttributeValueMemberS{Value: since.UTC().Format(time.RFC3339Nano)},
+		},
+	})
+}
+
+func (l *Ledger) query(ctx context.Context, input *dynamodb.QueryInput) ([]Entry, error) {
+	var entries []Entry
+
+	paginator := dynamodb.NewQueryPaginator(l.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query ledger: %w", err)
+		}
+
+		for _, item := range page.Items {
+			entries = append(entries, unmarshal(item))
+		}
+	}
+
+	return entries, nil
+}
+
+func marshal(e Entry) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"object":     &types.AttributeValueMemberS{Value: e.Bucket + "/" + e.Key},
+		"scannedAt":  &types.AttributeValueMemberS{Value: e.ScannedAt.UTC().Format(time.RFC3339Nano)},
+		"bucket":     &types.AttributeValueMemberS{Value: e.Bucket},
+		"key":        &types.AttributeValueMemberS{Value: e.Key},
+		"verdict":    &types.AttributeValueMemberS{Value: e.Verdict},
+		"clean":      &types.AttributeValueMemberBOOL{Value: e.Clean},
+		"durationMs": &types.AttributeValueMemberN{Value: strconv.FormatInt(e.Duration.Milliseconds(), 10)},
+	}
+
+	for name, value := range map[string]string{
+		"versionId":          e.VersionID,
+		"eTag":               e.ETag,
+		"sha256":             e.SHA256,
+		"signature":          e.Signature,
+		"reason":             e.Reason,
+		"definitionsVersion": e.DefinitionsVersion,
+		"requestId":          e.RequestID,
+	} {
+		if value != "" {
+			item[name] = &types.AttributeValueMemberS{Value: value}
+		}
+	}
+
+	if len(e.InfectedMembers) > 0 {
+		members := make([]types.AttributeValue, len(e.InfectedMembers))
+		for i, member := range e.InfectedMembers {
+			members[i] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+				"path":      &types.AttributeValueMemberS{Value: member.Path},
+				"signature": &types.AttributeValueMemberS{Value: member.Signature},
+			}}
+		}
+		item["infectedMembers"] = &types.AttributeValueMemberL{Value: members}
+	}
+
+	if len(e.Engines) > 0 {
+		engines := make([]types.AttributeValue, len(e.Engines))
+		for i, engine := range e.Engines {
+			value := map[string]types.AttributeValue{
+				"engine": &types.AttributeValueMemberS{Value: engine.Engine},
+				"clean":  &types.AttributeValueMemberBOOL{Value: engine.Clean},
+			}
+			if engine.Signature != "" {
+				value["signature"] = &types.AttributeValueMemberS{Value: engine.Signature}
+			}
+			if engine.Error != "" {
+				value["error"] = &types.AttributeValueMemberS{Value: engine.Error}
+			}
+			engines[i] = &types.AttributeValueMemberM{Value: value}
+		}
+		item["engines"] = &types.AttributeValueMemberL{Value: engines}
+	}
+
+	return item
+}
+
+func unmarshal(item map[string]types.AttributeValue) Entry {
+	str := func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+
+	e := Entry{
+		Bucket:             str("bucket"),
+		Key:                str("key"),
+		VersionID:          str("versionId"),
+		ETag:               str("eTag"),
+		SHA256:             str("sha256"),
+		Verdict:            str("verdict"),
+		Signature:          str("signature"),
+		Reason:             str("reason"),
+		DefinitionsVersion: str("definitionsVersion"),
+		RequestID:          str("requestId"),
+	}
+
+	if v, ok := item["clean"].(*types.AttributeValueMemberBOOL); ok {
+		e.Clean = v.Value
+	}
+	if v, ok := item["durationMs"].(*types.AttributeValueMemberN); ok {
+		if ms, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+			e.Duration = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, str("scannedAt")); err == nil {
+		e.ScannedAt = t
+	}
+	if v, ok := item["infectedMembers"].(*types.AttributeValueMemberL); ok {
+		for _, value := range v.Value {
+			m, ok := value.(*types.AttributeValueMemberM)
+			if !ok {
+				continue
+			}
+
+			var member antivirus.InfectedMember
+			if s, ok := m.Value["path"].(*types.AttributeValueMemberS); ok {
+				member.Path = s.Value
+			}
+			if s, ok := m.Value["signature"].(*types.AttributeValueMemberS); ok {
+				member.Signature = s.Value
+			}
+			e.InfectedMembers = append(e.InfectedMembers, member)
+		}
+	}
+	if v, ok := item["engines"].(*types.AttributeValueMemberL); ok {
+		for _, value := range v.Value {
+			m, ok := value.(*types.AttributeValueMemberM)
+			if !ok {
+				continue
+			}
+
+			var engine antivirus.EngineVerdict
+			if s, ok := m.Value["engine"].(*types.AttributeValueMemberS); ok {
+				engine.Engine = s.Value
+			}
+			if b, ok := m.Value["clean"].(*types.AttributeValueMemberBOOL); ok {
+				engine.Clean = b.Value
+			}
+			if s, ok := m.Value["signature"].(*types.AttributeValueMemberS); ok {
+				engine.Signature = s.Value
+			}
+			if s, ok := m.Value["error"].(*types.AttributeValueMemberS); ok {
+				engine.Error = s.Value
+			}
+			e.Engines = append(e.Engines, engine)
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,141 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockClient struct {
+	mock.Mock
+}
+
+func (m *mockClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	args := m.Called(*params.TableName, params.Item)
+	return &dynamodb.PutItemOutput{}, args.Error(0)
+}
+
+func (m *mockClient) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	args := m.Called(params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+var scannedAt = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+var testEngines = []antivirus.EngineVerdict{
+	{Engine: "clamav", Signature: "Eicar-Signature"},
+	{Engine: "icap", Error: "scanning engine unavailable"},
+}
+
+func testEntry() Entry {
+	return Entry{
+		Bucket:             "my-bucket",
+		Key:                "file-key",
+		VersionID:          "v1",
+		ETag:               "etag",
+		SHA256:             "abc123",
+		Verdict:            "infected",
+		Signature:          "Eicar-Signature",
+		Reason:             "engine",
+		InfectedMembers:    []antivirus.InfectedMember{{Path: "evidence/a.pdf", Signature: "Eicar-Signature"}},
+		Engines:            testEngines,
+		DefinitionsVersion: "daily:1,main:2",
+		Duration:           1500 * time.Millisecond,
+		RequestID:          "request-id",
+		ScannedAt:          scannedAt,
+	}
+}
+
+func TestRecord(t *testing.T) {
+	client := &mockClient{}
+	client.On("PutItem", "ledger-table", marshal(testEntry())).Return(nil)
+
+	l := New(client, "ledger-table", "")
+	l.now = func() time.Time { return scannedAt }
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-id"})
+
+	err := l.Record(ctx, antivirus.Result{
+		Object:             antivirus.Object{Bucket: "my-bucket", Key: "file-key", VersionID: "v1", ETag: "etag"},
+		Verdict:            antivirus.Verdict{Signature: "Eicar-Signature", Reason: antivirus.ReasonEngine, Engines: testEngines},
+		Status:             "infected",
+		SHA256:             "abc123",
+		DefinitionsVersion: "daily:1,main:2",
+		Duration:           1500 * time.Millisecond,
+		InfectedMembers:    []antivirus.InfectedMember{{Path: "evidence/a.pdf", Signature: "Eicar-Signature"}},
+	})
+	assert.Nil(t, err)
+
+	mock.AssertExpectationsForObjects(t, client)
+}
+
+func TestRecordWhenError(t *testing.T) {
+	client := &mockClient{}
+	client.On("PutItem", "ledger-table", mock.Anything).Return(errors.New("throttled"))
+
+	err := New(client, "ledger-table", "").Record(context.Background(), antivirus.Result{})
+	assert.Equal(t, "failed to write ledger entry: throttled", err.Error())
+}
+
+func TestQueryByKey(t *testing.T) {
+	client := &mockClient{}
+	client.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return input.ExclusiveStartKey == nil &&
+			input.IndexName == nil &&
+			input.ExpressionAttributeValues[":object"].(*types.AttributeValueMemberS).Value == "my-bucket/file-key"
+	})).Return(&dynamodb.QueryOutput{
+		Items:            []map[string]types.AttributeValue{marshal(testEntry())},
+		LastEvaluatedKey: map[string]types.AttributeValue{"object": &types.AttributeValueMemberS{Value: "next"}},
+	}, nil).Once()
+	client.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return input.ExclusiveStartKey != nil
+	})).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{marshal(testEntry())},
+	}, nil).Once()
+
+	entries, err := New(client, "ledger-table", "").QueryByKey(context.Background(), "my-bucket", "file-key")
+	assert.Nil(t, err)
+	assert.Equal(t, []Entry{testEntry(), testEntry()}, entries)
+
+	mock.AssertExpectationsForObjects(t, client)
+}
+
+func TestQueryByVerdict(t *testing.T) {
+	client := &mockClient{}
+	client.On("Query", &dynamodb.QueryInput{
+		TableName:              aws.String("ledger-table"),
+		IndexName:              aws.String("by-verdict"),
+		KeyConditionExpression: aws.String("verdict = :verdict AND scannedAt >= :since"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":verdict": &types.AttributeValueMemberS{Value: "infected"},
+			":since":   &types.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"},
+		},
+	}).Return(&dynamodb.QueryOutput{
+		Items: []map[string]types.AttributeValue{marshal(testEntry())},
+	}, nil)
+
+	entries, err := New(client, "ledger-table", "by-verdict").QueryByVerdict(context.Background(), "infected", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.Equal(t, []Entry{testEntry()}, entries)
+}
+
+func TestQueryWhenError(t *testing.T) {
+	client := &mockClient{}
+	client.On("Query", mock.Anything).Return(nil, errors.New("no such table"))
+
+	_, err := New(client, "ledger-table", "").QueryByKey(context.Background(), "my-bucket", "file-key")
+	assert.Equal(t, "failed to query ledger: no such table", err.Error())
+}
@@ -0,0 +1,88 @@
+// Package logging writes JSON log lines with log/slog, adding the Lambda
+// request ID and any fields attached to the context so that every line about
+// an object can be found with a CloudWatch Logs Insights filter.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const DefaultLevel = "info"
+
+type contextKey struct{}
+
+// With returns a context carrying attrs, which are added to every line logged
+// with it. Attributes already on ctx are kept.
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(contextKey{}).([]slog.Attr)
+
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(combined, existing...)
+	combined = append(combined, attrs...)
+
+	return context.WithValue(ctx, contextKey{}, combined)
+}
+
+// ParseLevel reads a level name as used by Lambda's AWS_LAMBDA_LOG_LEVEL, so
+// accepts trace and fatal alongside the slog names.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "trace", "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error", "fatal":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// New creates a logger writing JSON lines to w at level and above. Passing a
+// *slog.LevelVar allows the level to be set once configuration has loaded.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(&contextHandler{
+		Handler: slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}),
+	})
+}
+
+// Fatal logs msg at error level with the default logger and exits, for
+// failures during cold start.
+func Fatal(msg string, err error) {
+	slog.Error(msg, slog.Any("error", err))
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID and context attributes to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		record.AddAttrs(slog.String("requestId", lc.AwsRequestID))
+	}
+
+	if attrs, ok := ctx.Value(contextKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
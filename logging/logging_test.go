@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var line map[string]any
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-id"})
+	ctx = With(ctx, slog.String("bucket", "my-bucket"))
+	ctx = With(ctx, slog.String("key", "file-key"))
+
+	logger.DebugContext(ctx, "hidden")
+	logger.InfoContext(ctx, "scan complete", slog.String("verdict", "clean"))
+	logger.Info("no context")
+
+	lines := decodeLines(t, &buf)
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, "INFO", lines[0]["level"])
+		assert.Equal(t, "scan complete", lines[0]["msg"])
+		assert.Equal(t, "request-id", lines[0]["requestId"])
+		assert.Equal(t, "my-bucket", lines[0]["bucket"])
+		assert.Equal(t, "file-key", lines[0]["key"])
+		assert.Equal(t, "clean", lines[0]["verdict"])
+
+		assert.Equal(t, "no context", lines[1]["msg"])
+		assert.NotContains(t, lines[1], "requestId")
+	}
+}
+
+func TestNewWithAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelDebug).With(slog.String("handler", "scan"))
+
+	logger.DebugContext(With(context.Background(), slog.String("key", "file-key")), "debugging")
+
+	lines := decodeLines(t, &buf)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "scan", lines[0]["handler"])
+		assert.Equal(t, "file-key", lines[0]["key"])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, level := range map[string]slog.Level{
+		"trace": slog.LevelDebug,
+		"DEBUG": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+		"FATAL": slog.LevelError,
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseLevel(name)
+			assert.Nil(t, err)
+			assert.Equal(t, level, got)
+		})
+	}
+
+	_, err := ParseLevel("loud")
+	assert.Equal(t, "unknown log level \"loud\"", err.Error())
+}
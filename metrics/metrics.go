@@ -0,0 +1,122 @@
+// Package metrics writes CloudWatch metrics in the Embedded Metric Format. Each
+// document is a single JSON line on the function's log stream, which
+// CloudWatch turns into metrics without the function making any API calls.
+//
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const DefaultNamespace = "opg-s3-antivirus"
+
+type Unit string
+
+const (
+	Count        Unit = "Count"
+	Bytes        Unit = "Bytes"
+	Milliseconds Unit = "Milliseconds"
+	Seconds      Unit = "Seconds"
+	None         Unit = "None"
+)
+
+type Metric struct {
+	Name  string
+	Unit  Unit
+	Value float64
+}
+
+// A MetricSet is a group of metrics reported against the same dimensions.
+type MetricSet struct {
+	Dimensions []string
+	Metrics    []Metric
+}
+
+// Emitter writes EMF documents to w, usually stdout.
+type Emitter struct {
+	w         io.Writer
+	namespace string
+	now       func() time.Time
+	mu        sync.Mutex
+}
+
+// New creates an Emitter. When namespace is empty DefaultNamespace is used.
+func New(w io.Writer, namespace string) *Emitter {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	return &Emitter{w: w, namespace: namespace, now: time.Now}
+}
+
+type metadata struct {
+	Timestamp         int64       `json:"Timestamp"`
+	CloudWatchMetrics []directive `json:"CloudWatchMetrics"`
+}
+
+type directive struct {
+	Namespace  string             `json:"Namespace"`
+	Dimensions [][]string         `json:"Dimensions"`
+	Metrics    []metricDefinition `json:"Metrics"`
+}
+
+type metricDefinition struct {
+	Name string `json:"Name"`
+	Unit Unit   `json:"Unit"`
+}
+
+// Emit writes one document containing every set. The value of each dimension
+// named by a set is taken from properties, which are also written to the
+// document so they can be queried with Logs Insights.
+func (e *Emitter) Emit(properties map[string]string, sets ...MetricSet) error {
+	meta := metadata{Timestamp: e.now().UnixMilli()}
+
+	fields := map[string]any{}
+	for name, value := range properties {
+		fields[name] = value
+	}
+
+	for _, set := range sets {
+		for _, dimension := range set.Dimensions {
+			if _, ok := properties[dimension]; !ok {
+				return fmt.Errorf("no value for dimension %q", dimension)
+			}
+		}
+
+		d := directive{
+			Namespace:  e.namespace,
+			Dimensions: [][]string{set.Dimensions},
+		}
+		if set.Dimensions == nil {
+			d.Dimensions = [][]string{{}}
+		}
+
+		for _, metric := range set.Metrics {
+			d.Metrics = append(d.Metrics, metricDefinition{Name: metric.Name, Unit: metric.Unit})
+			fields[metric.Name] = metric.Value
+		}
+
+		meta.CloudWatchMetrics = append(meta.CloudWatchMetrics, d)
+	}
+
+	fields["_aws"] = meta
+
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, err := e.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEmitter(buf *bytes.Buffer) *Emitter {
+	e := New(buf, "")
+	e.now = func() time.Time { return time.UnixMilli(1700000000000) }
+	return e
+}
+
+func TestEmit(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := testEmitter(&buf).Emit(map[string]string{"Bucket": "my-bucket", "Verdict": "ok"},
+		MetricSet{
+			Dimensions: []string{"Bucket", "Verdict"},
+			Metrics:    []Metric{{Name: "Scans", Unit: Count, Value: 1}},
+		},
+		MetricSet{
+			Dimensions: []string{"Bucket"},
+			Metrics:    []Metric{{Name: "BytesScanned", Unit: Bytes, Value: 12}},
+		},
+	)
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1700000000000,
+			"CloudWatchMetrics": [
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket", "Verdict"]], "Metrics": [{"Name": "Scans", "Unit": "Count"}]},
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket"]], "Metrics": [{"Name": "BytesScanned", "Unit": "Bytes"}]}
+			]
+		},
+		"Bucket": "my-bucket",
+		"Verdict": "ok",
+		"Scans": 1,
+		"BytesScanned": 12
+	}`, buf.String())
+	assert.Equal(t, byte('\n'), buf.Bytes()[buf.Len()-1])
+}
+
+func TestEmitWithoutDimensions(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := testEmitter(&buf).Emit(nil, MetricSet{
+		Metrics: []Metric{{Name: "FreshclamFailures", Unit: Count, Value: 0}},
+	})
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1700000000000,
+			"CloudWatchMetrics": [
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [[]], "Metrics": [{"Name": "FreshclamFailures", "Unit": "Count"}]}
+			]
+		},
+		"FreshclamFailures": 0
+	}`, buf.String())
+}
+
+func TestEmitMissingDimension(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := testEmitter(&buf).Emit(map[string]string{}, MetricSet{
+		Dimensions: []string{"Bucket"},
+		Metrics:    []Metric{{Name: "Scans", Unit: Count, Value: 1}},
+	})
+
+	assert.Equal(t, `no value for dimension "Bucket"`, err.Error())
+	assert.Equal(t, 0, buf.Len())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("closed")
+}
+
+func TestEmitWriteFails(t *testing.T) {
+	err := New(failingWriter{}, "custom").Emit(nil, MetricSet{
+		Metrics: []Metric{{Name: "Scans", Unit: Count, Value: 1}},
+	})
+
+	assert.Equal(t, "failed to write metrics: closed", err.Error())
+}
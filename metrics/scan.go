@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+)
+
+// ScanRecorder emits metrics for each scan, it implements antivirus.Recorder.
+// Scans are counted per bucket and verdict, the other metrics are per bucket.
+type ScanRecorder struct {
+	Emitter *Emitter
+	// DefinitionsBuilt returns when the signature databases in use were
+	// built. DefinitionsAge is not reported when it is nil or returns the
+	// zero time.
+	DefinitionsBuilt func() time.Time
+
+	now func() time.Time
+}
+
+func (r *ScanRecorder) Record(ctx context.Context, result antivirus.Result) error {
+	properties := map[string]string{
+		"Bucket":  result.Object.Bucket,
+		"Verdict": result.Status,
+	}
+
+	perBucket := []Metric{
+		{Name: "BytesScanned", Unit: Bytes, Value: float64(result.BytesScanned)},
+		{Name: "ScanDuration", Unit: Milliseconds, Value: milliseconds(result.Duration)},
+	}
+
+	if result.Timings != (antivirus.Timings{}) {
+		perBucket = append(perBucket,
+			Metric{Name: "DownloadLatency", Unit: Milliseconds, Value: milliseconds(result.Timings.Download)},
+			Metric{Name: "ScanLatency", Unit: Milliseconds, Value: milliseconds(result.Timings.Scan)},
+			Metric{Name: "TagLatency", Unit: Milliseconds, Value: milliseconds(result.Timings.Write)},
+		)
+	}
+
+	if result.RecordFailures > 0 {
+		perBucket = append(perBucket, Metric{Name: "RecordFailures", Unit: Count, Value: float64(result.RecordFailures)})
+	}
+
+	if r.DefinitionsBuilt != nil {
+		if built := r.DefinitionsBuilt(); !built.IsZero() {
+			perBucket = append(perBucket, Metric{Name: "DefinitionsAge", Unit: Seconds, Value: r.since(built).Seconds()})
+		}
+	}
+
+	return r.Emitter.Emit(properties,
+		MetricSet{
+			Dimensions: []string{"Bucket", "Verdict"},
+			Metrics:    []Metric{{Name: "Scans", Unit: Count, Value: 1}},
+		},
+		MetricSet{
+			Dimensions: []string{"Bucket"},
+			Metrics:    perBucket,
+		},
+	)
+}
+
+func (r *ScanRecorder) since(t time.Time) time.Duration {
+	if r.now == nil {
+		return time.Since(t)
+	}
+
+	return r.now().Sub(t)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
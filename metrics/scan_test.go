@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.UnixMilli(1700000000000)
+
+	r := &ScanRecorder{
+		Emitter:          testEmitter(&buf),
+		DefinitionsBuilt: func() time.Time { return now.Add(-2 * time.Hour) },
+		now:              func() time.Time { return now },
+	}
+
+	err := r.Record(context.Background(), antivirus.Result{
+		Object:       antivirus.Object{Bucket: "my-bucket", Key: "file-key"},
+		Status:       "infected",
+		Duration:     1500 * time.Millisecond,
+		BytesScanned: 12,
+		Timings: antivirus.Timings{
+			Download: 200 * time.Millisecond,
+			Scan:     1200 * time.Millisecond,
+			Write:    100 * time.Millisecond,
+		},
+	})
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1700000000000,
+			"CloudWatchMetrics": [
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket", "Verdict"]], "Metrics": [{"Name": "Scans", "Unit": "Count"}]},
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket"]], "Metrics": [
+					{"Name": "BytesScanned", "Unit": "Bytes"},
+					{"Name": "ScanDuration", "Unit": "Milliseconds"},
+					{"Name": "DownloadLatency", "Unit": "Milliseconds"},
+					{"Name": "ScanLatency", "Unit": "Milliseconds"},
+					{"Name": "TagLatency", "Unit": "Milliseconds"},
+					{"Name": "DefinitionsAge", "Unit": "Seconds"}
+				]}
+			]
+		},
+		"Bucket": "my-bucket",
+		"Verdict": "infected",
+		"Scans": 1,
+		"BytesScanned": 12,
+		"ScanDuration": 1500,
+		"DownloadLatency": 200,
+		"ScanLatency": 1200,
+		"TagLatency": 100,
+		"DefinitionsAge": 7200
+	}`, buf.String())
+}
+
+func TestScanRecorderOversize(t *testing.T) {
+	var buf bytes.Buffer
+
+	r := &ScanRecorder{Emitter: testEmitter(&buf)}
+
+	err := r.Record(context.Background(), antivirus.Result{
+		Object:   antivirus.Object{Bucket: "my-bucket", Key: "file-key"},
+		Status:   "too-large",
+		Duration: 50 * time.Millisecond,
+	})
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1700000000000,
+			"CloudWatchMetrics": [
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket", "Verdict"]], "Metrics": [{"Name": "Scans", "Unit": "Count"}]},
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket"]], "Metrics": [
+					{"Name": "BytesScanned", "Unit": "Bytes"},
+					{"Name": "ScanDuration", "Unit": "Milliseconds"}
+				]}
+			]
+		},
+		"Bucket": "my-bucket",
+		"Verdict": "too-large",
+		"Scans": 1,
+		"BytesScanned": 0,
+		"ScanDuration": 50
+	}`, buf.String())
+}
+
+func TestScanRecorderRecordFailures(t *testing.T) {
+	var buf bytes.Buffer
+
+	r := &ScanRecorder{Emitter: testEmitter(&buf)}
+
+	err := r.Record(context.Background(), antivirus.Result{
+		Object:         antivirus.Object{Bucket: "my-bucket", Key: "file-key"},
+		Status:         "ok",
+		Duration:       50 * time.Millisecond,
+		RecordFailures: 1,
+	})
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1700000000000,
+			"CloudWatchMetrics": [
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket", "Verdict"]], "Metrics": [{"Name": "Scans", "Unit": "Count"}]},
+				{"Namespace": "opg-s3-antivirus", "Dimensions": [["Bucket"]], "Metrics": [
+					{"Name": "BytesScanned", "Unit": "Bytes"},
+					{"Name": "ScanDuration", "Unit": "Milliseconds"},
+					{"Name": "RecordFailures", "Unit": "Count"}
+				]}
+			]
+		},
+		"Bucket": "my-bucket",
+		"Verdict": "ok",
+		"Scans": 1,
+		"BytesScanned": 0,
+		"ScanDuration": 50,
+		"RecordFailures": 1
+	}`, buf.String())
+}
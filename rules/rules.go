@@ -0,0 +1,229 @@
+// Package rules lets one scanner deployment treat buckets and key prefixes
+// differently. Rules are read from a JSON file and the first rule whose bucket
+// and key globs match an object decides its antivirus.Policy.
+//
+// In globs "*" matches within a single path segment, "**" matches across
+// segments and "?" matches a single character. An empty glob matches
+// everything.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+)
+
+type Actions struct {
+	// Quarantine moves infected objects to another bucket and prefix.
+	Quarantine *antivirus.Location `json:"quarantine"`
+}
+
+// Rule overrides the default policy for matching objects. Fields that are not
+// set keep the value from the default policy.
+type Rule struct {
+	Bucket    string              `json:"bucket"`
+	Key       string              `json:"key"`
+	Skip      bool                `json:"skip"`
+	TagKey    string              `json:"tagKey"`
+	TagValues antivirus.TagValues `json:"tagValues"`
+	MaxSize   int64               `json:"maxSize"`
+	Actions   Actions             `json:"actions"`
+	// ResultWriter is one of "tags", "sidecar" or "metadata".
+	ResultWriter string `json:"resultWriter"`
+	// AllowedTypes lists the file types clean objects may be, see
+	// antivirus.Policy.
+	AllowedTypes []string `json:"allowedTypes"`
+	// ScanMembers scans each file inside infected archives.
+	ScanMembers bool `json:"scanMembers"`
+	// CheckActiveContent tags clean documents with JavaScript, automatic
+	// actions or macros with the active content value.
+	CheckActiveContent bool `json:"checkActiveContent"`
+
+	bucket *regexp.Regexp
+	key    *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if r.bucket, err = compileGlob(r.Bucket); err != nil {
+		return fmt.Errorf("bucket: %w", err)
+	}
+	if r.key, err = compileGlob(r.Key); err != nil {
+		return fmt.Errorf("key: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Rule) validate() []error {
+	var errs []error
+
+	if r.TagKey != "" {
+		errs = append(errs, prefixErrors("tagKey", antivirus.ValidateTagKey(r.TagKey))...)
+	}
+
+	errs = append(errs, r.TagValues.Validate(func(field string) string { return "tagValues." + field })...)
+
+	if r.MaxSize < 0 {
+		errs = append(errs, errors.New("maxSize must not be negative"))
+	}
+
+	switch r.ResultWriter {
+	case "", antivirus.ResultWriterTags, antivirus.ResultWriterSidecar, antivirus.ResultWriterMetadata:
+	default:
+		errs = append(errs, fmt.Errorf("resultWriter %q is not one of tags, sidecar or metadata", r.ResultWriter))
+	}
+
+	for _, fileType := range r.AllowedTypes {
+		if !antivirus.IsFileType(fileType) {
+			errs = append(errs, fmt.Errorf("allowedTypes %q is not a known file type", fileType))
+		}
+	}
+
+	if q := r.Actions.Quarantine; q != nil && q.Bucket == "" {
+		errs = append(errs, errors.New("actions.quarantine.bucket is required"))
+	}
+
+	return errs
+}
+
+// Matches reports whether the rule applies to the object.
+func (r *Rule) Matches(bucket, key string) bool {
+	return r.bucket.MatchString(bucket) && r.key.MatchString(key)
+}
+
+// Apply overlays the rule on a policy.
+func (r *Rule) Apply(policy antivirus.Policy) antivirus.Policy {
+	policy.Skip = r.Skip
+
+	if r.TagKey != "" {
+		policy.TagKey = r.TagKey
+	}
+	policy.TagValues = policy.TagValues.Overlay(r.TagValues)
+	if r.MaxSize > 0 {
+		policy.MaxSize = r.MaxSize
+	}
+	if r.Actions.Quarantine != nil {
+		policy.Quarantine = r.Actions.Quarantine
+	}
+	if r.ResultWriter != "" {
+		policy.ResultWriter = r.ResultWriter
+	}
+	if len(r.AllowedTypes) > 0 {
+		policy.AllowedTypes = r.AllowedTypes
+	}
+	if r.ScanMembers {
+		policy.ScanMembers = true
+	}
+	if r.CheckActiveContent {
+		policy.CheckActiveContent = true
+	}
+
+	return policy
+}
+
+// Set is an ordered list of rules, it implements antivirus.PolicyResolver.
+type Set struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Load reads a rules file, checking that every glob compiles and every tag is
+// valid.
+func Load(path string) (*Set, error) {
+	file, err := os.Open(path) //nolint:gosec // path is set by infra
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+	defer file.Close() //nolint:errcheck // no need to check error when closing file
+
+	set := &Set{}
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(set); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %w", path, err)
+	}
+
+	if err := set.compile(); err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %w", path, err)
+	}
+
+	return set, nil
+}
+
+func (s *Set) compile() error {
+	var errs []error
+
+	for i, rule := range s.Rules {
+		if err := rule.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+			continue
+		}
+
+		for _, err := range rule.validate() {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Match returns the first rule that applies to the object.
+func (s *Set) Match(bucket, key string) (*Rule, bool) {
+	for _, rule := range s.Rules {
+		if rule.Matches(bucket, key) {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *Set) Resolve(obj antivirus.Object, base antivirus.Policy) antivirus.Policy {
+	if rule, ok := s.Match(obj.Bucket, obj.Key); ok {
+		return rule.Apply(base)
+	}
+
+	return base
+}
+
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if glob == "" {
+		sb.WriteString(".*")
+	}
+	sb.WriteString("$")
+
+	return regexp.Compile(sb.String())
+}
+
+func prefixErrors(name string, errs []error) []error {
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%s %w", name, err)
+	}
+
+	return errs
+}
@@ -0,0 +1,137 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRules(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	set, err := Load(writeRules(t, `{
+		"rules": [
+			{"bucket": "uploads-*", "key": "thumbnails/**", "skip": true},
+			{"bucket": "express--euw1-az1--x-s3", "resultWriter": "sidecar"},
+			{"bucket": "evidence", "tagKey": "scan", "tagValues": {"pass": "clean"}, "maxSize": 1024,
+			 "actions": {"quarantine": {"bucket": "quarantine", "prefix": "evidence/"}}}
+		]
+	}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	base := antivirus.Policy{TagKey: "virus-scan-status", TagValues: antivirus.TagValues{Pass: "ok", Fail: "infected"}}
+
+	assert.Equal(t, antivirus.Policy{
+		Skip:      true,
+		TagKey:    "virus-scan-status",
+		TagValues: antivirus.TagValues{Pass: "ok", Fail: "infected"},
+	}, set.Resolve(antivirus.Object{Bucket: "uploads-a", Key: "thumbnails/2024/a.png"}, base))
+
+	assert.Equal(t, antivirus.Policy{
+		TagKey:     "scan",
+		TagValues:  antivirus.TagValues{Pass: "clean", Fail: "infected"},
+		MaxSize:    1024,
+		Quarantine: &antivirus.Location{Bucket: "quarantine", Prefix: "evidence/"},
+	}, set.Resolve(antivirus.Object{Bucket: "evidence", Key: "case/a.pdf"}, base))
+
+	assert.Equal(t, antivirus.ResultWriterSidecar, set.Resolve(antivirus.Object{Bucket: "express--euw1-az1--x-s3", Key: "a.pdf"}, base).ResultWriter)
+
+	assert.Equal(t, base, set.Resolve(antivirus.Object{Bucket: "uploads-a", Key: "documents/a.pdf"}, base))
+}
+
+func TestLoadWhenInvalid(t *testing.T) {
+	_, err := Load(writeRules(t, `{
+		"rules": [
+			{"tagKey": "aws:scan", "maxSize": -1},
+			{"actions": {"quarantine": {"prefix": "a/"}}},
+			{"resultWriter": "dynamodb"},
+			{"allowedTypes": ["pdf", "docx"]},
+			{"tagValues": {"pass": "same", "fail": "same", "staleDefinitions": "stale!"}}
+		]
+	}`))
+
+	assert.Contains(t, err.Error(), "rule 0: tagKey must not start with aws:")
+	assert.Contains(t, err.Error(), "rule 0: maxSize must not be negative")
+	assert.Contains(t, err.Error(), "rule 1: actions.quarantine.bucket is required")
+	assert.Contains(t, err.Error(), `rule 2: resultWriter "dynamodb" is not one of tags, sidecar or metadata`)
+	assert.Contains(t, err.Error(), `rule 3: allowedTypes "docx" is not a known file type`)
+	assert.Contains(t, err.Error(), `rule 4: tagValues.staleDefinitions contains characters not allowed in S3 tags: "stale!"`)
+	assert.Contains(t, err.Error(), "rule 4: tagValues.pass and tagValues.fail must be different")
+}
+
+func TestLoadWithAllowedTypes(t *testing.T) {
+	set, err := Load(writeRules(t, `{
+		"rules": [
+			{"bucket": "forms", "allowedTypes": ["pdf", "jpeg", "png"], "tagValues": {"disallowedType": "wrong-type"}}
+		]
+	}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	policy := set.Resolve(antivirus.Object{Bucket: "forms", Key: "a.pdf"}, antivirus.Policy{})
+	assert.Equal(t, []string{"pdf", "jpeg", "png"}, policy.AllowedTypes)
+	assert.Equal(t, "wrong-type", policy.TagValues.DisallowedType)
+}
+
+func TestLoadWithActiveContent(t *testing.T) {
+	set, err := Load(writeRules(t, `{
+		"rules": [
+			{"bucket": "public-uploads", "checkActiveContent": true, "tagValues": {"activeContent": "rejected"}}
+		]
+	}`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	policy := set.Resolve(antivirus.Object{Bucket: "public-uploads", Key: "a.pdf"}, antivirus.Policy{})
+	assert.True(t, policy.CheckActiveContent)
+	assert.Equal(t, "rejected", policy.TagValues.ActiveContent)
+
+	policy = set.Resolve(antivirus.Object{Bucket: "internal", Key: "a.pdf"}, antivirus.Policy{})
+	assert.False(t, policy.CheckActiveContent)
+}
+
+func TestLoadWithUnknownField(t *testing.T) {
+	_, err := Load(writeRules(t, `{"rules": [{"prefix": "a/"}]}`))
+	assert.ErrorContains(t, err, `unknown field "prefix"`)
+}
+
+func TestCompileGlob(t *testing.T) {
+	testcases := map[string]struct {
+		glob    string
+		matches []string
+		misses  []string
+	}{
+		"empty":       {glob: "", matches: []string{"", "a/b/c"}},
+		"star":        {glob: "uploads/*.pdf", matches: []string{"uploads/a.pdf"}, misses: []string{"uploads/a/b.pdf", "uploads/a.png"}},
+		"double star": {glob: "uploads/**.pdf", matches: []string{"uploads/a.pdf", "uploads/a/b.pdf"}},
+		"question":    {glob: "file?.txt", matches: []string{"file1.txt"}, misses: []string{"file10.txt", "file/.txt"}},
+		"meta":        {glob: "a+b.(1)", matches: []string{"a+b.(1)"}, misses: []string{"aab.(1)"}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			re, err := compileGlob(tc.glob)
+			assert.Nil(t, err)
+
+			for _, s := range tc.matches {
+				assert.True(t, re.MatchString(s), s)
+			}
+			for _, s := range tc.misses {
+				assert.False(t, re.MatchString(s), s)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Package scanstatus lets services that consume scanned buckets read the
+// verdict written by the opg-s3-antivirus scan lambda, and wait for one to
+// appear after an upload.
+package scanstatus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+)
+
+const (
+	DefaultTagKey    = "virus-scan-status"
+	DefaultPassValue = "ok"
+	DefaultFailValue = "infected"
+)
+
+// Status is the verdict recorded against an object.
+type Status string
+
+const (
+	// StatusPending means the object exists but has not been tagged yet.
+	StatusPending Status = "pending"
+	// StatusClean means the object was tagged with the pass value.
+	StatusClean Status = "clean"
+	// StatusInfected means the object was tagged with the fail value.
+	StatusInfected Status = "infected"
+	// StatusOversize means the object was too large to scan.
+	StatusOversize Status = "oversize"
+	// StatusStaleDefinitions means the object was not scanned because the
+	// virus definitions were out of date.
+	StatusStaleDefinitions Status = "stale-definitions"
+	// StatusDisallowedType means the object was clean but its file type is
+	// not allowed.
+	StatusDisallowedType Status = "disallowed-type"
+	// StatusSuspiciousArchive means the object is an archive that exceeded
+	// the scanner's limits, so was not scanned.
+	StatusSuspiciousArchive Status = "suspicious-archive"
+	// StatusEncrypted means the object is an encrypted archive whose contents
+	// could not be scanned.
+	StatusEncrypted Status = "encrypted"
+	// StatusActiveContent means the object was clean but is a document with
+	// scripts, automatic actions or macros.
+	StatusActiveContent Status = "active-content"
+	// StatusUnknown means the object was tagged with a value that is none of
+	// the scan lambda's tag values, so was most likely set by something else.
+	// The raw value is kept on the Result.
+	StatusUnknown Status = "unknown"
+)
+
+// Result is the scan status of a single object.
+type Result struct {
+	Status Status
+	// Value is the raw tag value, empty when the object is pending.
+	Value string
+}
+
+// Done reports whether the scan lambda has finished with the object.
+func (r Result) Done() bool {
+	return r.Status != StatusPending
+}
+
+type Tagger interface {
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+}
+
+type Option func(*Client)
+
+// WithTagKey sets the tag key the scan lambda was configured with, the
+// equivalent of ANTIVIRUS_TAG_KEY.
+func WithTagKey(key string) Option {
+	return func(c *Client) {
+		c.tagKey = key
+	}
+}
+
+// WithTagValues sets the tag values the scan lambda was configured with, the
+// equivalent of ANTIVIRUS_TAG_VALUE_PASS and ANTIVIRUS_TAG_VALUE_FAIL.
+func WithTagValues(pass, fail string) Option {
+	return func(c *Client) {
+		c.tagValues.Pass = pass
+		c.tagValues.Fail = fail
+	}
+}
+
+// WithAllTagValues sets every tag value the scan lambda was configured with,
+// such as the cfg.TagValues it loads. Values left empty keep their defaults.
+func WithAllTagValues(values antivirus.TagValues) Option {
+	return func(c *Client) {
+		c.tagValues = c.tagValues.Overlay(values)
+	}
+}
+
+type Client struct {
+	tagger    Tagger
+	tagKey    string
+	tagValues antivirus.TagValues
+}
+
+// New creates a Client using the tag key and values from the README unless
+// they are overridden by opts.
+func New(tagger Tagger, opts ...Option) *Client {
+	c := &Client{
+		tagger:    tagger,
+		tagKey:    DefaultTagKey,
+		tagValues: antivirus.TagValues{Pass: DefaultPassValue, Fail: DefaultFailValue}.WithDefaults(),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// GetScanStatus reads the tags of an object and returns its scan status.
+func (c *Client) GetScanStatus(ctx context.Context, bucket, key string) (Result, error) {
+	tagging, err := c.tagger.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	for _, tag := range tagging.TagSet {
+		if aws.ToString(tag.Key) != c.tagKey {
+			continue
+		}
+
+		value := aws.ToString(tag.Value)
+		return Result{Status: c.status(value), Value: value}, nil
+	}
+
+	return Result{Status: StatusPending}, nil
+}
+
+// status is the Status for a tag value, checking the pass and fail values
+// first.
+func (c *Client) status(value string) Status {
+	for _, s := range []struct {
+		value  string
+		status Status
+	}{
+		{c.tagValues.Pass, StatusClean},
+		{c.tagValues.Fail, StatusInfected},
+		{c.tagValues.Oversize, StatusOversize},
+		{c.tagValues.StaleDefinitions, StatusStaleDefinitions},
+		{c.tagValues.DisallowedType, StatusDisallowedType},
+		{c.tagValues.SuspiciousArchive, StatusSuspiciousArchive},
+		{c.tagValues.Encrypted, StatusEncrypted},
+		{c.tagValues.ActiveContent, StatusActiveContent},
+	} {
+		if value == s.value {
+			return s.status
+		}
+	}
+
+	return StatusUnknown
+}
+
+// WaitOptions controls the exponential backoff used by WaitForScanResult. Zero
+// values are replaced with the defaults noted on each field.
+type WaitOptions struct {
+	// InitialInterval is the delay before the second attempt, default 1s.
+	InitialInterval time.Duration
+	// MaxInterval caps the delay between attempts, default 30s.
+	MaxInterval time.Duration
+	// Multiplier is applied to the delay after each attempt, default 2.
+	Multiplier float64
+	// Timeout limits the total time spent waiting, default 5m. The deadline of
+	// ctx is also respected.
+	Timeout time.Duration
+}
+
+func (o WaitOptions) withDefaults() WaitOptions {
+	if o.InitialInterval <= 0 {
+		o.InitialInterval = time.Second
+	}
+	if o.MaxInterval <= 0 {
+		o.MaxInterval = 30 * time.Second
+	}
+	if o.Multiplier < 1 {
+		o.Multiplier = 2
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Minute
+	}
+
+	return o
+}
+
+// ErrTimeout is returned by WaitForScanResult when the object is still pending
+// once the timeout has passed.
+var ErrTimeout = errors.New("timed out waiting for scan result")
+
+// WaitForScanResult polls the tags of an object until the scan lambda has
+// recorded a verdict. An object that does not exist yet is treated as pending,
+// so it is safe to call straight after starting an upload.
+func (c *Client) WaitForScanResult(ctx context.Context, bucket, key string, opts WaitOptions) (Result, error) {
+	opts = opts.withDefaults()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	interval := opts.InitialInterval
+	for {
+		result, err := c.GetScanStatus(ctx, bucket, key)
+		if err != nil && !isNoSuchKey(err) {
+			if ctx.Err() != nil {
+				return Result{}, waitError(ctx)
+			}
+			return Result{}, err
+		}
+
+		if err == nil && result.Done() {
+			return result, nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Result{Status: StatusPending}, waitError(ctx)
+		case <-timer.C:
+		}
+
+		interval = min(time.Duration(float64(interval)*opts.Multiplier), opts.MaxInterval)
+	}
+}
+
+func waitError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+
+	return ctx.Err()
+}
+
+func isNoSuchKey(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey"
+}
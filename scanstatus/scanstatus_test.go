@@ -0,0 +1,146 @@
+package scanstatus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/ministryofjustice/opg-s3-antivirus/antivirus"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockTagger struct {
+	mock.Mock
+}
+
+func (m *mockTagger) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	args := m.Called(*params.Bucket, *params.Key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: args.Get(0).([]types.Tag)}, args.Error(1)
+}
+
+func tags(value string) []types.Tag {
+	return []types.Tag{
+		{Key: aws.String("upload-source"), Value: aws.String("online")},
+		{Key: aws.String("virus-scan-status"), Value: aws.String(value)},
+	}
+}
+
+func TestGetScanStatus(t *testing.T) {
+	testcases := map[string]struct {
+		tags     []types.Tag
+		expected Result
+	}{
+		"clean":              {tags: tags("ok"), expected: Result{Status: StatusClean, Value: "ok"}},
+		"infected":           {tags: tags("infected"), expected: Result{Status: StatusInfected, Value: "infected"}},
+		"oversize":           {tags: tags("too-large"), expected: Result{Status: StatusOversize, Value: "too-large"}},
+		"stale definitions":  {tags: tags("stale-definitions"), expected: Result{Status: StatusStaleDefinitions, Value: "stale-definitions"}},
+		"disallowed type":    {tags: tags("disallowed-type"), expected: Result{Status: StatusDisallowedType, Value: "disallowed-type"}},
+		"suspicious archive": {tags: tags("suspicious-archive"), expected: Result{Status: StatusSuspiciousArchive, Value: "suspicious-archive"}},
+		"encrypted":          {tags: tags("encrypted-unscanned"), expected: Result{Status: StatusEncrypted, Value: "encrypted-unscanned"}},
+		"active content":     {tags: tags("active-content"), expected: Result{Status: StatusActiveContent, Value: "active-content"}},
+		"unknown":            {tags: tags("what"), expected: Result{Status: StatusUnknown, Value: "what"}},
+		"pending":            {tags: []types.Tag{}, expected: Result{Status: StatusPending}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tagger := &mockTagger{}
+			tagger.On("GetObjectTagging", "a-bucket", "a-key").Return(tc.tags, nil)
+
+			result, err := New(tagger).GetScanStatus(context.Background(), "a-bucket", "a-key")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, result)
+
+			mock.AssertExpectationsForObjects(t, tagger)
+		})
+	}
+}
+
+func TestGetScanStatusWithOptions(t *testing.T) {
+	tagger := &mockTagger{}
+	tagger.On("GetObjectTagging", "a-bucket", "a-key").Return([]types.Tag{
+		{Key: aws.String("VIRUS_SCAN"), Value: aws.String("fail")},
+	}, nil)
+
+	client := New(tagger, WithTagKey("VIRUS_SCAN"), WithTagValues("pass", "fail"))
+
+	result, err := client.GetScanStatus(context.Background(), "a-bucket", "a-key")
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Status: StatusInfected, Value: "fail"}, result)
+}
+
+func TestGetScanStatusWithAllTagValues(t *testing.T) {
+	testcases := map[string]Status{
+		"fail":                StatusInfected,
+		"big":                 StatusOversize,
+		"too-large":           StatusUnknown,
+		"encrypted-unscanned": StatusEncrypted,
+	}
+
+	for value, status := range testcases {
+		t.Run(value, func(t *testing.T) {
+			tagger := &mockTagger{}
+			tagger.On("GetObjectTagging", "a-bucket", "a-key").Return(tags(value), nil)
+
+			client := New(tagger, WithAllTagValues(antivirus.TagValues{Pass: "pass", Fail: "fail", Oversize: "big"}))
+
+			result, err := client.GetScanStatus(context.Background(), "a-bucket", "a-key")
+			assert.Nil(t, err)
+			assert.Equal(t, Result{Status: status, Value: value}, result)
+		})
+	}
+}
+
+func TestGetScanStatusWhenError(t *testing.T) {
+	tagger := &mockTagger{}
+	tagger.On("GetObjectTagging", "a-bucket", "a-key").Return(nil, errors.New("access denied"))
+
+	_, err := New(tagger).GetScanStatus(context.Background(), "a-bucket", "a-key")
+	assert.Equal(t, "failed to get tags: access denied", err.Error())
+}
+
+func TestWaitForScanResult(t *testing.T) {
+	tagger := &mockTagger{}
+	tagger.On("GetObjectTagging", "a-bucket", "a-key").Return(nil, &smithy.GenericAPIError{Code: "NoSuchKey"}).Once()
+	tagger.On("GetObjectTagging", "a-bucket", "a-key").Return([]types.Tag{}, nil).Once()
+	tagger.On("GetObjectTagging", "a-bucket", "a-key").Return(tags("ok"), nil).Once()
+
+	result, err := New(tagger).WaitForScanResult(context.Background(), "a-bucket", "a-key", WaitOptions{
+		InitialInterval: time.Millisecond,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Status: StatusClean, Value: "ok"}, result)
+
+	mock.AssertExpectationsForObjects(t, tagger)
+}
+
+func TestWaitForScanResultTimeout(t *testing.T) {
+	tagger := &mockTagger{}
+	tagger.On("GetObjectTagging", "a-bucket", "a-key").Return([]types.Tag{}, nil)
+
+	result, err := New(tagger).WaitForScanResult(context.Background(), "a-bucket", "a-key", WaitOptions{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		Timeout:         20 * time.Millisecond,
+	})
+	assert.Equal(t, ErrTimeout, err)
+	assert.Equal(t, Result{Status: StatusPending}, result)
+}
+
+func TestWaitForScanResultWhenError(t *testing.T) {
+	tagger := &mockTagger{}
+	tagger.On("GetObjectTagging", "a-bucket", "a-key").Return(nil, errors.New("access denied"))
+
+	_, err := New(tagger).WaitForScanResult(context.Background(), "a-bucket", "a-key", WaitOptions{})
+	assert.Equal(t, "failed to get tags: access denied", err.Error())
+}
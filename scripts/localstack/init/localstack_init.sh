@@ -17,6 +17,15 @@ awslocal lambda create-function \
          --timeout 120 \
          --role arn:aws:iam::000000000000:role/lambda-ex
 
+# Create scan ledger table
+awslocal dynamodb create-table \
+    --region eu-west-1 \
+    --table-name "scan-ledger" \
+    --attribute-definitions AttributeName=object,AttributeType=S AttributeName=scannedAt,AttributeType=S AttributeName=verdict,AttributeType=S \
+    --key-schema AttributeName=object,KeyType=HASH AttributeName=scannedAt,KeyType=RANGE \
+    --global-secondary-indexes 'IndexName=verdict-index,KeySchema=[{AttributeName=verdict,KeyType=HASH},{AttributeName=scannedAt,KeyType=RANGE}],Projection={ProjectionType=ALL}' \
+    --billing-mode PAY_PER_REQUEST
+
 # Create Private Bucket
 awslocal s3api create-bucket \
     --acl private \
@@ -0,0 +1,12 @@
+package tracing
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+)
+
+// InstrumentAWS adds a client span around every API call made by clients
+// built from cfg, named after the service and operation such as S3.GetObject.
+func InstrumentAWS(cfg *aws.Config) {
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
+}
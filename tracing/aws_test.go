@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type stubHTTPClient struct {
+	statusCode int
+}
+
+func (c *stubHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: c.statusCode,
+		Header:     http.Header{"X-Amz-Request-Id": []string{"request-id"}},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}, nil
+}
+
+func TestInstrumentAWS(t *testing.T) {
+	recorder := recordSpans(t)
+
+	cfg := aws.Config{
+		Region:      "eu-west-1",
+		Credentials: aws.AnonymousCredentials{},
+		HTTPClient:  &stubHTTPClient{statusCode: http.StatusOK},
+	}
+	InstrumentAWS(&cfg)
+
+	client := s3.NewFromConfig(cfg)
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("my-bucket"),
+		Key:    aws.String("file-key"),
+	})
+	assert.Nil(t, err)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "S3.HeadObject", spans[0].Name())
+		assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind())
+		assert.Contains(t, spans[0].Attributes(), attribute.String("rpc.system.name", "aws-api"))
+		assert.Contains(t, spans[0].Attributes(), attribute.String("rpc.method", "S3/HeadObject"))
+		assert.Contains(t, spans[0].Attributes(), attribute.String("aws.region", "eu-west-1"))
+		assert.Contains(t, spans[0].Attributes(), attribute.String("aws.request_id", "request-id"))
+		assert.Contains(t, spans[0].Attributes(), attribute.Int("http.response.status_code", http.StatusOK))
+	}
+}
@@ -0,0 +1,109 @@
+// Package tracing sets up OpenTelemetry for the lambdas. Spans are exported
+// over OTLP/HTTP, either to the ADOT collector layer which forwards them to
+// X-Ray, or to a local collector when testing. Invocations are parented on the
+// X-Ray trace that Lambda starts when active tracing is enabled, so that the
+// spans created here appear inside the function's segment.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/ministryofjustice/opg-s3-antivirus/tracing"
+
+// xrayTraceKey is the context key aws-lambda-go stores the X-Ray trace header
+// under.
+const xrayTraceKey = "x-amzn-trace-id"
+
+// xrayHeader is the header the X-Ray propagator reads.
+const xrayHeader = "X-Amzn-Trace-Id"
+
+// Provider exports the spans created by the lambda.
+type Provider struct {
+	tp *sdktrace.TracerProvider
+}
+
+// Start installs a global tracer provider exporting to endpoint, such as
+// http://localhost:4318, with spans attributed to service.
+func Start(ctx context.Context, endpoint, service string) (*Provider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", service),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithIDGenerator(xray.NewIDGenerator()),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, xray.Propagator{}))
+
+	return &Provider{tp: tp}, nil
+}
+
+// Shutdown flushes any remaining spans and stops the exporter.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	return p.tp.Shutdown(ctx)
+}
+
+// Wrap runs each invocation of handler in a span named name. Spans are flushed
+// before the invocation returns, as Lambda may freeze the process straight
+// after. A nil Provider creates spans with the global tracer provider and does
+// not flush.
+func Wrap[E, R any](p *Provider, name string, handler func(context.Context, E) (R, error)) func(context.Context, E) (R, error) {
+	tracer := otel.Tracer(instrumentationName)
+
+	return func(ctx context.Context, event E) (R, error) {
+		ctx, span := tracer.Start(withXRayParent(ctx), name, trace.WithSpanKind(trace.SpanKindServer))
+
+		response, err := handler(ctx, event)
+		End(span, err)
+
+		if p != nil {
+			_ = p.tp.ForceFlush(ctx)
+		}
+
+		return response, err
+	}
+}
+
+// End records err on span, if there is one, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// withXRayParent makes the X-Ray trace Lambda started for the invocation the
+// remote parent of any spans started from ctx.
+func withXRayParent(ctx context.Context) context.Context {
+	header, _ := ctx.Value(xrayTraceKey).(string)
+	if header == "" {
+		return ctx
+	}
+
+	return xray.Propagator{}.Extract(ctx, propagation.MapCarrier{xrayHeader: header})
+}
@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return recorder
+}
+
+func TestWrap(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var handlerSpan trace.SpanContext
+	handler := Wrap(nil, "scan", func(ctx context.Context, event string) (string, error) {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return "done " + event, nil
+	})
+
+	ctx := context.WithValue(context.Background(), xrayTraceKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1") //nolint:staticcheck // key set by aws-lambda-go
+	response, err := handler(ctx, "event")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "done event", response)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "scan", spans[0].Name())
+		assert.Equal(t, trace.SpanKindServer, spans[0].SpanKind())
+		assert.Equal(t, "5759e988bd862e3fe1be46a994272793", spans[0].SpanContext().TraceID().String())
+		assert.Equal(t, "53995c3f42cd8ad8", spans[0].Parent().SpanID().String())
+		assert.Equal(t, spans[0].SpanContext().SpanID(), handlerSpan.SpanID())
+	}
+}
+
+func TestWrapWhenXRayHeaderInvalid(t *testing.T) {
+	recorder := recordSpans(t)
+
+	handler := Wrap(nil, "scan", func(ctx context.Context, event string) (string, error) {
+		return "done " + event, nil
+	})
+
+	ctx := context.WithValue(context.Background(), xrayTraceKey, "Root=2-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8") //nolint:staticcheck // key set by aws-lambda-go
+	_, err := handler(ctx, "event")
+	assert.Nil(t, err)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.False(t, spans[0].Parent().IsValid())
+	}
+}
+
+func TestWrapRecordsError(t *testing.T) {
+	recorder := recordSpans(t)
+
+	handler := Wrap(nil, "scan", func(ctx context.Context, event string) (string, error) {
+		return "", errors.New("clamav returned exit code 82")
+	})
+
+	_, err := handler(context.Background(), "event")
+	assert.Equal(t, "clamav returned exit code 82", err.Error())
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.False(t, spans[0].Parent().IsValid())
+		assert.Equal(t, codes.Error, spans[0].Status().Code)
+		assert.Equal(t, "clamav returned exit code 82", spans[0].Status().Description)
+	}
+}